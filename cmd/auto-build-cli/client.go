@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// client 使用 /api/v2 接口,通过 Authorization: Bearer <token> 认证
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+func newClient(server, token string) *client {
+	return &client{
+		server: strings.TrimSuffix(server, "/"),
+		token:  token,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// apiError 接口返回的错误 {"error":{"code","message","field"}}
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field"`
+}
+
+func (e *apiError) Error() string {
+	if len(e.Field) > 0 {
+		return fmt.Sprintf("%s: %s: %s", e.Code, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (c *client) newRequest(method, path string, body interface{}) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.server+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do 发送请求,返回 body,状态码不是 2xx 时返回 apiError
+func (c *client) do(method, path string, body interface{}) ([]byte, error) {
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= 300 {
+		e := &struct {
+			Error *apiError `json:"error"`
+		}{}
+		if json.Unmarshal(data, e) != nil || e.Error == nil {
+			return nil, &apiError{Status: res.StatusCode, Code: res.Status, Message: strings.TrimSpace(string(data))}
+		}
+		e.Error.Status = res.StatusCode
+		return nil, e.Error
+	}
+	return data, nil
+}
+
+// get 请求 json 接口,v 为 nil 时只返回 body
+func (c *client) get(path string, v interface{}) ([]byte, error) {
+	data, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			return nil, fmt.Errorf("decode %s error:%s", path, err)
+		}
+	}
+	return data, nil
+}
+
+// download 下载文件到 dir,文件名为路径的最后一级
+func (c *client) download(path, dir string) (string, error) {
+	req, err := c.newRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// 编译结果可能很大,不设置超时
+	res, err := (&http.Client{}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download %s: %s", path, res.Status)
+	}
+
+	name, err := url.PathUnescape(filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, name)
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, res.Body); err != nil {
+		f.Close()
+		return "", err
+	}
+	return dst, f.Close()
+}
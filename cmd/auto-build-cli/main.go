@@ -0,0 +1,335 @@
+// auto-build-cli 编译服务的命令行客户端,使用 /api/v2 接口
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const usage = `usage: auto-build-cli [-server url] [-token token] [-o table|json] command [args]
+
+commands:
+  projects                                       工程列表
+  tasks [-project id]                            任务列表
+  build [-follow] task_id                        开始编译,-follow 输出日志直到编译结束,失败时退出码为 1
+  rebuild [-follow] task_log_id                  使用相同的 commit 和配置重新编译
+  logs [-follow] task_log_id                     编译日志
+  download [-dir dir] -project id -branch name   下载分支最近一次成功编译的结果
+  goenv list|install version|delete version      管理 go 版本
+
+环境变量 AUTO_BUILD_SERVER,AUTO_BUILD_TOKEN 可以代替 -server,-token
+`
+
+// errBuildFailed 编译失败,退出码为 1 但不输出错误
+var errBuildFailed = errors.New("build failed")
+
+var pollInterval = 2 * time.Second
+
+func main() {
+	fs := flag.NewFlagSet("auto-build-cli", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	server := fs.String("server", envOr("AUTO_BUILD_SERVER", "http://127.0.0.1:8000"), "server url")
+	token := fs.String("token", os.Getenv("AUTO_BUILD_TOKEN"), "api token")
+	output := fs.String("o", "table", "output format: table or json")
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() < 1 || (*output != "table" && *output != "json") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c := newClient(*server, *token)
+	p := &printer{json: *output == "json"}
+	args := fs.Args()[1:]
+
+	var err error
+	switch fs.Arg(0) {
+	case "projects":
+		err = listProjects(c, p)
+	case "tasks":
+		err = listTasks(c, p, args)
+	case "build":
+		err = build(c, args)
+	case "rebuild":
+		err = rebuild(c, args)
+	case "logs":
+		err = logs(c, args)
+	case "download":
+		err = download(c, args)
+	case "goenv":
+		err = goenv(c, p, args)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if errors.Is(err, errBuildFailed) {
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error:%s\n", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); len(v) > 0 {
+		return v
+	}
+	return def
+}
+
+// parseId 解析位置参数中的 id
+func parseId(fs *flag.FlagSet, name string) (int64, error) {
+	if fs.NArg() < 1 {
+		return 0, fmt.Errorf("%s not set", name)
+	}
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be integer", name)
+	}
+	return id, nil
+}
+
+func listProjects(c *client, p *printer) error {
+	ps := make([]*project, 0)
+	data, err := c.get("/api/v2/projects", &ps)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(ps))
+	for _, pr := range ps {
+		rows = append(rows, []string{fmt.Sprint(pr.Id), pr.Name, pr.Url, pr.MainBranch, pr.GoVersion, fmt.Sprint(pr.PollInterval)})
+	}
+	p.print(data, []string{"ID", "NAME", "URL", "MAIN BRANCH", "GO", "POLL"}, rows)
+	return nil
+}
+
+func listTasks(c *client, p *printer, args []string) error {
+	fs := flag.NewFlagSet("tasks", flag.ExitOnError)
+	projectid := fs.Int64("project", 0, "project id")
+	fs.Parse(args)
+
+	ts := make([]*task, 0)
+	data, err := c.get(fmt.Sprintf("/api/v2/tasks?project_id=%d", *projectid), &ts)
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(ts))
+	for _, t := range ts {
+		rows = append(rows, []string{fmt.Sprint(t.Id), t.Name, t.Branch, t.DestOs + "/" + t.DestArch,
+			t.DestFile, strconv.FormatBool(t.AutoBuild), t.Cron})
+	}
+	p.print(data, []string{"ID", "PROJECT", "BRANCH", "TARGET", "FILE", "AUTO", "CRON"}, rows)
+	return nil
+}
+
+func build(c *client, args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	follow := fs.Bool("follow", false, "print log until build finished")
+	fs.Parse(args)
+
+	id, err := parseId(fs, "task_id")
+	if err != nil {
+		return err
+	}
+	return startBuild(c, fmt.Sprintf("/api/v2/tasks/%d/builds", id), *follow)
+}
+
+func rebuild(c *client, args []string) error {
+	fs := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	follow := fs.Bool("follow", false, "print log until build finished")
+	fs.Parse(args)
+
+	id, err := parseId(fs, "task_log_id")
+	if err != nil {
+		return err
+	}
+	return startBuild(c, fmt.Sprintf("/api/v2/task-logs/%d/rebuild", id), *follow)
+}
+
+// startBuild 请求开始编译的接口,返回新的编译记录
+func startBuild(c *client, path string, follow bool) error {
+	tl := &taskLog{}
+	data, err := c.do(http.MethodPost, path, nil)
+	if err == nil {
+		err = json.Unmarshal(data, tl)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "build started, task log id:%d\n", tl.Id)
+
+	if !follow {
+		return nil
+	}
+	return followLog(c, tl.Id)
+}
+
+func logs(c *client, args []string) error {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := fs.Bool("follow", false, "print log until build finished")
+	fs.Parse(args)
+
+	id, err := parseId(fs, "task_log_id")
+	if err != nil {
+		return err
+	}
+
+	if *follow {
+		return followLog(c, id)
+	}
+
+	out, err := c.get(fmt.Sprintf("/api/v2/task-logs/%d/output", id), nil)
+	if err != nil {
+		return err
+	}
+	os.Stdout.Write(out)
+	return nil
+}
+
+// followLog 轮询编译状态和输出,只输出新增的部分,编译失败时返回 errBuildFailed
+func followLog(c *client, id int64) error {
+	printed := 0
+	for {
+		tl := &taskLog{}
+		if _, err := c.get(fmt.Sprintf("/api/v2/task-logs/%d", id), tl); err != nil {
+			return err
+		}
+
+		// 编译开始前没有输出文件
+		out, err := c.get(fmt.Sprintf("/api/v2/task-logs/%d/output", id), nil)
+		var e *apiError
+		if err != nil && !(errors.As(err, &e) && e.Status == http.StatusNotFound) {
+			return err
+		}
+		if len(out) > printed {
+			os.Stdout.Write(out[printed:])
+			printed = len(out)
+		}
+
+		switch tl.Status {
+		case statusSuccess:
+			fmt.Fprintf(os.Stderr, "build success: %s\n", tl.Url)
+			return nil
+		case statusFailed, statusInterrupted:
+			fmt.Fprintf(os.Stderr, "build %s\n", statusName(tl.Status))
+			return errBuildFailed
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+func download(c *client, args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	projectid := fs.Int64("project", 0, "project id")
+	branch := fs.String("branch", "", "branch name")
+	dir := fs.String("dir", ".", "save to dir")
+	fs.Parse(args)
+
+	if *projectid <= 0 || len(*branch) == 0 {
+		return errors.New("-project and -branch must be set")
+	}
+
+	ts := make([]*task, 0)
+	if _, err := c.get(fmt.Sprintf("/api/v2/tasks?project_id=%d", *projectid), &ts); err != nil {
+		return err
+	}
+
+	found := false
+	for _, t := range ts {
+		if t.Branch != *branch {
+			continue
+		}
+		found = true
+
+		tl, err := lastSuccess(c, t.Id)
+		if err != nil {
+			return err
+		}
+		if tl == nil {
+			fmt.Fprintf(os.Stderr, "task:%d has no successful build\n", t.Id)
+			continue
+		}
+
+		u, err := url.Parse(tl.Url)
+		if err != nil {
+			return fmt.Errorf("parse url %s error:%s", tl.Url, err)
+		}
+		// 使用 -server 访问,服务端生成的地址可能是内网地址
+		dst, err := c.download(u.EscapedPath(), *dir)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("task:%d commit:%s saved to %s\n", t.Id, shortSha(tl.Commit), dst)
+	}
+
+	if !found {
+		return fmt.Errorf("no task of branch:%s", *branch)
+	}
+	return nil
+}
+
+// lastSuccess 任务最近一次成功的分支编译,merge request 的编译不算
+func lastSuccess(c *client, taskid int64) (*taskLog, error) {
+	page := &struct {
+		Items []*taskLog `json:"items"`
+	}{}
+	path := fmt.Sprintf("/api/v2/task-logs?task_id=%d&status=%d&merge_request=0&page_size=1", taskid, statusSuccess)
+	if _, err := c.get(path, page); err != nil {
+		return nil, err
+	}
+	if len(page.Items) == 0 {
+		return nil, nil
+	}
+	return page.Items[0], nil
+}
+
+func goenv(c *client, p *printer, args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: goenv list|install version|delete version")
+	}
+
+	switch args[0] {
+	case "list":
+		vs := make([]string, 0)
+		data, err := c.get("/api/v2/goenvs", &vs)
+		if err != nil {
+			return err
+		}
+		rows := make([][]string, 0, len(vs))
+		for _, v := range vs {
+			rows = append(rows, []string{v})
+		}
+		p.print(data, []string{"VERSION"}, rows)
+		return nil
+	case "install":
+		if len(args) < 2 {
+			return errors.New("version not set")
+		}
+		if _, err := c.do(http.MethodPost, "/api/v2/goenvs", map[string]string{"version": args[1]}); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "installing %s in background\n", args[1])
+		return nil
+	case "delete":
+		if len(args) < 2 {
+			return errors.New("version not set")
+		}
+		if _, err := c.do(http.MethodDelete, "/api/v2/goenvs/"+url.PathEscape(args[1]), nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "%s deleted\n", args[1])
+		return nil
+	}
+	return fmt.Errorf("unknown goenv command:%s", args[0])
+}
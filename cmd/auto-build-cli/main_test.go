@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeServer 第一次查询时编译中,之后编译完成
+func fakeServer(t *testing.T, final int) *httptest.Server {
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/task-logs/1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		status := statusRunning
+		if polls > 0 {
+			status = final
+		}
+		polls++
+		fmt.Fprintf(w, `{"id":1,"task_id":2,"status":%d}`, status)
+	})
+	mux.HandleFunc("/api/v2/task-logs/1/output", func(w http.ResponseWriter, r *http.Request) {
+		if polls < 2 {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"error":{"code":"not_found","message":"no output"}}`)
+			return
+		}
+		fmt.Fprint(w, "go build\n")
+	})
+	mux.HandleFunc("/api/v2/task-logs", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("status") != "2" || r.FormValue("merge_request") != "0" {
+			t.Errorf("list task logs query:%s", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `{"total":2,"items":[{"id":1,"status":2,"commit":"0123456789","url":"http://10.0.0.1/output/p/master/app"}]}`)
+	})
+	mux.HandleFunc("/output/p/master/app", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "binary")
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestFollowLog(t *testing.T) {
+	pollInterval = 0
+
+	s := fakeServer(t, statusSuccess)
+	defer s.Close()
+	if err := followLog(newClient(s.URL, "token"), 1); err != nil {
+		t.Errorf("follow success build error:%s", err)
+	}
+
+	s = fakeServer(t, statusFailed)
+	defer s.Close()
+	if err := followLog(newClient(s.URL, "token"), 1); err != errBuildFailed {
+		t.Errorf("follow failed build error:%v", err)
+	}
+
+	if err := followLog(newClient(s.URL, "bad"), 1); err == nil {
+		t.Error("follow without token should fail")
+	}
+}
+
+func TestDownloadLastSuccess(t *testing.T) {
+	s := fakeServer(t, statusSuccess)
+	defer s.Close()
+	c := newClient(s.URL, "token")
+
+	tl, err := lastSuccess(c, 2)
+	if err != nil || tl == nil || tl.Id != 1 {
+		t.Fatalf("last success:%+v error:%v", tl, err)
+	}
+
+	dir := t.TempDir()
+	dst, err := c.download("/output/p/master/app", dir)
+	if err != nil {
+		t.Fatalf("download error:%s", err)
+	}
+	if data, _ := os.ReadFile(dst); dst != filepath.Join(dir, "app") || string(data) != "binary" {
+		t.Errorf("download to %s:%q", dst, data)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// 以下类型只包含命令行需要的字段,对应接口返回的 json
+
+type project struct {
+	Id           int64  `json:"id"`
+	Name         string `json:"name"`
+	Url          string `json:"url"`
+	MainBranch   string `json:"main_branch"`
+	GoVersion    string `json:"go_version_id"`
+	PollInterval int    `json:"poll_interval"`
+}
+
+type task struct {
+	Id        int64  `json:"id"`
+	ProjectId int64  `json:"project_id"`
+	Name      string `json:"name"` // 工程名
+	Branch    string `json:"branch"`
+	DestFile  string `json:"dest_file"`
+	DestOs    string `json:"dest_os"`
+	DestArch  string `json:"dest_arch"`
+	AutoBuild bool   `json:"auto_build"`
+	Cron      string `json:"cron"`
+}
+
+type taskLog struct {
+	Id           int64     `json:"id"`
+	TaskId       int64     `json:"task_id"`
+	MergeRequest int64     `json:"merge_request"`
+	Commit       string    `json:"commit"`
+	Status       int       `json:"status"`
+	Url          string    `json:"url"`
+	CreateAt     time.Time `json:"create_at"`
+}
+
+// 编译状态,和 model 中一致
+const (
+	statusInit = iota
+	statusRunning
+	statusSuccess
+	statusFailed
+	statusInterrupted
+)
+
+func statusName(s int) string {
+	switch s {
+	case statusInit:
+		return "init"
+	case statusRunning:
+		return "running"
+	case statusSuccess:
+		return "success"
+	case statusFailed:
+		return "failed"
+	case statusInterrupted:
+		return "interrupted"
+	}
+	return fmt.Sprint(s)
+}
+
+// printer 按 -o 参数输出表格或 json
+type printer struct {
+	json bool
+}
+
+// print json 时原样输出接口返回的数据,避免 id 转换为浮点数丢失精度
+func (p *printer) print(data []byte, header []string, rows [][]string) {
+	if p.json {
+		var out bytes.Buffer
+		if err := json.Indent(&out, data, "", "  "); err != nil {
+			out.Write(data)
+		}
+		fmt.Println(out.String())
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, r := range rows {
+		fmt.Fprintln(w, strings.Join(r, "\t"))
+	}
+	w.Flush()
+}
+
+func shortSha(sha string) string {
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	return sha
+}
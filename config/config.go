@@ -6,16 +6,28 @@ import (
 )
 
 type Config struct {
-	Port          int    `toml:"port"`
-	LogPath       string `toml:"log_path"`
-	LogLevel      string `toml:"log_level"`       // default: DEBUG
-	RecordPath    string `toml:"record_path"`     // 存放编译日志
-	BarePath      string `toml:"bare_path"`       // bare 路径
-	GoEnvPath     string `toml:"go_env_path"`     // 存放 golang 环境的
-	DefaultGoPath string `toml:"default_go_path"` // 默认 go_path,主要用于 gomod
-	DestPath      string `toml:"dest_path"`       // 编译完成的文件存放位置
-	SqlFile       string `toml:"sql_file"`        // sqlite3文件路径
-	WebPath       string `toml:"web_path"`        // 前端路径
+	Port           int      `toml:"port"`
+	LogPath        string   `toml:"log_path"`
+	LogLevel       string   `toml:"log_level"`       // default: DEBUG
+	RecordPath     string   `toml:"record_path"`     // 存放编译日志
+	BarePath       string   `toml:"bare_path"`       // bare 路径
+	GoEnvPath      string   `toml:"go_env_path"`     // 存放 golang 环境的
+	DefaultGoPath  string   `toml:"default_go_path"` // 默认 go_path,主要用于 gomod
+	DestPath       string   `toml:"dest_path"`       // 编译完成的文件存放位置
+	SqlFile        string   `toml:"sql_file"`        // sqlite3文件路径
+	WebPath        string   `toml:"web_path"`        // 前端路径
+	ExternalUrl    string   `toml:"external_url"`    // 对外访问地址,用于生成下载和日志链接,默认 http://本机ip:port
+	KnownHosts     string   `toml:"known_hosts"`     // ssh 仓库校验主机使用的 known_hosts 文件,默认 ~/.ssh/known_hosts
+	SecretKey      string   `toml:"secret_key"`      // 加密仓库 token 等敏感信息的 key,必须配置
+	OrphanPolicy   string   `toml:"orphan_policy"`   // 重启时没有完成的编译:interrupt 标记为中断(默认),requeue 标记为中断后重新编译
+	ShutdownGrace  int      `toml:"shutdown_grace"`  // 收到 SIGTERM 后等待正在进行的编译完成的秒数,超时后取消,默认 60
+	TrustedProxies []string `toml:"trusted_proxies"` // 可信的反向代理 ip 或 CIDR,只有来自它们的请求才使用 X-Forwarded-For
+	AgentToken     string   `toml:"agent_token"`     // agent 和服务端共用的 token,服务端为空时不接受 agent
+	AgentServer    string   `toml:"agent_server"`    // agent 模式下服务端地址
+	AgentName      string   `toml:"agent_name"`      // agent 名称,默认 hostname
+	AgentLabels    []string `toml:"agent_labels"`    // agent 额外的标签,如 ["gpu=true"]
+	WorkPath       string   `toml:"work_path"`       // agent 模式下 clone 代码的目录
+	Container      string   `toml:"container"`       // 在容器中编译使用的命令,docker 或 podman,默认 docker
 }
 
 var C *Config
@@ -1,9 +1,12 @@
 package env
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 
 	"github.com/hash-rabbit/auto-build/config"
 	"github.com/hash-rabbit/auto-build/util"
@@ -12,8 +15,28 @@ import (
 )
 
 var c *cron.Cron
+var cmu sync.Mutex
+var stopped bool // Stop 之后不再启动定时任务
 var Updating bool
 
+// installing 正在安装的版本
+var installing = struct {
+	sync.Mutex
+	versions map[string]bool
+}{versions: make(map[string]bool)}
+
+// removedMark 手动删除的版本
+const removedMark = ".removed"
+
+var versionReg = regexp.MustCompile(`^go1\.\d+(\.\d+)?((rc|beta)\d+)?$`)
+
+// Schedule 定时任务,Spec 为标准 crontab 格式
+type Schedule struct {
+	Name string
+	Spec string
+	Job  func()
+}
+
 func Init() {
 	if _, err := os.Stat(getDlpath()); os.IsNotExist(err) {
 		err := util.Clone(getDlpath(), "https://github.com/golang/dl.git")
@@ -24,11 +47,60 @@ func Init() {
 
 	go updatingVersions()
 
-	c = cron.New()
-	c.AddFunc("@daily", updatingVersions)
+	cmu.Lock()
+	defer cmu.Unlock()
+	c = newCron()
 	c.Start()
 }
 
+func newCron() *cron.Cron {
+	nc := cron.New()
+	nc.AddFunc("@daily", updatingVersions)
+	return nc
+}
+
+// Reload 替换全部定时任务,robfig/cron v1 不支持删除任务,所以重新创建 cron
+func Reload(schedules []*Schedule) {
+	nc := newCron()
+	for _, s := range schedules {
+		sched, err := cron.ParseStandard(s.Spec)
+		if err != nil {
+			log.Errorf("schedule:%s parse spec:%s error:%s", s.Name, s.Spec, err)
+			continue
+		}
+		nc.Schedule(sched, cron.FuncJob(s.Job))
+		log.Debugf("add schedule:%s spec:%s", s.Name, s.Spec)
+	}
+
+	cmu.Lock()
+	defer cmu.Unlock()
+	if stopped {
+		return
+	}
+	if c != nil {
+		c.Stop()
+	}
+	c = nc
+	c.Start()
+}
+
+// Stop 停止全部定时任务,已经开始的任务不会被中断
+func Stop() {
+	cmu.Lock()
+	defer cmu.Unlock()
+	stopped = true
+	if c != nil {
+		c.Stop()
+		c = nil
+	}
+}
+
+// CheckSpec 检查 crontab 表达式
+func CheckSpec(spec string) error {
+	_, err := cron.ParseStandard(spec)
+	return err
+}
+
 func updatingVersions() {
 	if Updating {
 		return
@@ -55,12 +127,17 @@ func updatingVersions() {
 			continue
 		}
 
+		// 已经安装,或者删除过的版本
 		if _, err := os.Stat(GetGoPath(version)); err == nil {
 			continue
 		}
 
+		if !markInstalling(version) {
+			continue
+		}
 		log.Infof("installing go version:%s", version)
 		err := Install(GetGoPath(version), version)
+		unmarkInstalling(version)
 		if err != nil {
 			log.Errorf("install version:%s error:%s", version, err)
 			continue
@@ -98,3 +175,80 @@ func ListEnv() ([]string, error) {
 
 	return envs, nil
 }
+
+// CheckVersion 检查版本名称,如 go1.20.6,go1.21rc2
+func CheckVersion(version string) error {
+	if !versionReg.MatchString(version) {
+		return fmt.Errorf("version:%s not allowed", version)
+	}
+	return nil
+}
+
+// Installed 版本是否已经安装完成
+func Installed(version string) bool {
+	_, err := os.Stat(filepath.Join(GetGoPath(version), unpackedOkay))
+	return err == nil
+}
+
+func markInstalling(version string) bool {
+	installing.Lock()
+	defer installing.Unlock()
+	if installing.versions[version] {
+		return false
+	}
+	installing.versions[version] = true
+	return true
+}
+
+func unmarkInstalling(version string) {
+	installing.Lock()
+	delete(installing.versions, version)
+	installing.Unlock()
+}
+
+// InstallAsync 在后台安装版本,已经安装或正在安装时返回错误
+func InstallAsync(version string) error {
+	if err := CheckVersion(version); err != nil {
+		return err
+	}
+	if Installed(version) {
+		return fmt.Errorf("version:%s has installed", version)
+	}
+	if !markInstalling(version) {
+		return fmt.Errorf("version:%s is installing", version)
+	}
+
+	go func() {
+		defer unmarkInstalling(version)
+
+		os.Remove(filepath.Join(GetGoPath(version), removedMark))
+		log.Infof("installing go version:%s", version)
+		if err := Install(GetGoPath(version), version); err != nil {
+			log.Errorf("install version:%s error:%s", version, err)
+		}
+	}()
+	return nil
+}
+
+// Remove 删除已安装的版本,保留空目录和标记文件,避免每天更新版本时重新安装
+func Remove(version string) error {
+	if err := CheckVersion(version); err != nil {
+		return err
+	}
+	if !markInstalling(version) {
+		return fmt.Errorf("version:%s is installing", version)
+	}
+	defer unmarkInstalling(version)
+
+	dir := GetGoPath(version)
+	if _, err := os.Stat(filepath.Join(dir, "bin", "go")); err != nil {
+		return fmt.Errorf("version:%s not installed", version)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, removedMark), nil, 0644)
+}
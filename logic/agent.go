@@ -0,0 +1,856 @@
+package logic
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hash-rabbit/auto-build/config"
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/hash-rabbit/auto-build/util"
+	"github.com/subchen/go-log"
+)
+
+// agent 请求使用的 header,X-Agent-Token 在第一次注册时为共用的 agent_token,之后为注册时生成的凭证
+const (
+	agentTokenHeader = "X-Agent-Token"
+	agentNameHeader  = "X-Agent-Name"
+)
+
+var (
+	// agentPollWait 领取编译的最长等待时间,需要小于 http 服务的 WriteTimeout
+	agentPollWait = 10 * time.Second
+	// agentLostAfter agent 超过这个时间没有请求时,中断它领取的编译
+	agentLostAfter = 2 * time.Minute
+	// agentChunkSize agent 上传编译输出和编译结果时每次请求的最大长度
+	agentChunkSize = 4 << 20
+	// agentQueueTimeout 超过这个时间没有 agent 领取的编译标记为失败
+	agentQueueTimeout = time.Hour
+)
+
+var agentNameReg = regexp.MustCompile(`^[0-9a-zA-Z._-]{1,50}$`)
+var labelReg = regexp.MustCompile(`^[0-9a-zA-Z._/-]+=[0-9a-zA-Z._/+-]+$`)
+
+// agentInfo agent 注册和领取编译时上报的信息
+type agentInfo struct {
+	Name   string   `json:"name"`
+	Labels []string `json:"labels"` // key=value
+}
+
+// agentJob 发送给 agent 的编译,包含仓库的认证信息和 secret
+type agentJob struct {
+	Id           int64              `json:"id"` // 编译记录 id
+	ProjectId    int64              `json:"project_id"`
+	ProjectName  string             `json:"project_name"`
+	RepoUrl      string             `json:"repo_url"`
+	Path         string             `json:"path"` // 不使用 go mod 的工程在 GOPATH 中的相对路径
+	Token        string             `json:"token"`
+	SshKey       string             `json:"ssh_key"`
+	TaskId       int64              `json:"task_id"`
+	MergeRequest int64              `json:"merge_request"`
+	Ref          string             `json:"ref"` // merge request 在远端仓库中的 ref
+	Pin          string             `json:"pin"` // 重新编译时固定的 commit
+	Config       *model.BuildConfig `json:"config"`
+	Secrets      []agentSecret      `json:"secrets"`
+}
+
+// agentCredential 注册的返回,Token 只在第一次注册时返回,agent 需要保存
+type agentCredential struct {
+	model.Agent
+	Token string `json:"token,omitempty"`
+}
+
+type agentSecret struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// agentUpdate agent 上报的编译状态,只处理不为空的字段
+type agentUpdate struct {
+	Status *int           `json:"status,omitempty"`
+	Commit *model.TaskLog `json:"commit,omitempty"` // 只使用提交相关的字段
+	Report string         `json:"report,omitempty"` // commit status,由服务端写回 git 仓库
+}
+
+// 有新的编译等待领取时唤醒所有等待中的 agent
+var agentQueue = struct {
+	sync.Mutex
+	wake chan struct{}
+}{wake: make(chan struct{})}
+
+func wakeAgents() {
+	agentQueue.Lock()
+	defer agentQueue.Unlock()
+	close(agentQueue.wake)
+	agentQueue.wake = make(chan struct{})
+}
+
+func agentWake() <-chan struct{} {
+	agentQueue.Lock()
+	defer agentQueue.Unlock()
+	return agentQueue.wake
+}
+
+// parseSelector 解析任务的标签选择 "key=value,key=value"
+func parseSelector(selector string) ([]string, error) {
+	labels := make([]string, 0)
+	for _, l := range strings.Split(selector, ",") {
+		l = strings.TrimSpace(l)
+		if len(l) == 0 {
+			continue
+		}
+		if !labelReg.MatchString(l) {
+			return nil, fmt.Errorf("label %q must be key=value", l)
+		}
+		labels = append(labels, l)
+	}
+	return labels, nil
+}
+
+// matchLabels agent 包含选择中的所有标签时返回 true
+func matchLabels(selector []string, labels []string) bool {
+	for _, s := range selector {
+		if !containsString(labels, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// enqueue 保存配置快照,等待标签匹配的 agent 领取,没有已批准的 agent 匹配时直接失败
+func (t *task) enqueue() {
+	defer t.slot.release()
+
+	if t.cfg == nil {
+		t.cfg = model.NewBuildConfig(t.p, t.t)
+	}
+	selector, err := parseSelector(t.t.Labels)
+	if err != nil {
+		t.failQueued(fmt.Sprintf("invalid labels %q: %s", t.t.Labels, err))
+		return
+	}
+	selector = append(selector, "go="+t.cfg.GoVersion)
+	ok, err := hasAgentFor(selector)
+	if err != nil {
+		log.Errorf("list agent error:%s", err)
+		model.UpdateTaskLog(t.id, model.Failed)
+		return
+	}
+	if !ok {
+		t.failQueued(fmt.Sprintf("no approved agent has labels:%s", strings.Join(selector, ",")))
+		return
+	}
+
+	if err := model.QueueTaskLog(t.id, t.t.Labels, t.cfg); err != nil {
+		log.Errorf("task log:%d queue error:%s", t.id, err)
+		model.UpdateTaskLog(t.id, model.Failed)
+		return
+	}
+	log.Infof("task log:%d wait for agent with labels:%s", t.id, t.t.Labels)
+	wakeAgents()
+}
+
+// hasAgentFor 有已批准的 agent 包含全部标签时返回 true
+func hasAgentFor(selector []string) (bool, error) {
+	as, err := model.ListAgent()
+	if err != nil {
+		return false, err
+	}
+	for _, a := range as {
+		if a.Approved && matchLabels(selector, a.Labels) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// failQueued 等待 agent 的编译无法开始,原因写入编译输出
+func (t *task) failQueued(msg string) {
+	log.Warnf("task log:%d %s", t.id, msg)
+	if len(t.outfile) == 0 {
+		t.outfile = t.outFilePath()
+		if f, err := newLogFile(t.outfile); err == nil {
+			f.Close()
+			model.UpdateTaskLogOut(t.id, t.outfile)
+		}
+	}
+	appendOutput(t.outfile, "build failed: "+msg)
+	model.UpdateTaskLog(t.id, model.Failed)
+	t.report(util.StatusFailed)
+}
+
+func agentEnabled() error {
+	if len(config.C.AgentToken) == 0 {
+		return errForbidden("agent is not enabled, set agent_token in config")
+	}
+	return nil
+}
+
+// checkAgentToken 校验 agent 和服务端共用的 token,只用于第一次注册
+func checkAgentToken(r *http.Request) error {
+	if err := agentEnabled(); err != nil {
+		return err
+	}
+	token := r.Header.Get(agentTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(config.C.AgentToken)) != 1 {
+		return errUnauthorized("invalid agent token")
+	}
+	return nil
+}
+
+// checkAgentKey 校验注册时为该 agent 生成的凭证
+func checkAgentKey(r *http.Request, a *model.Agent) bool {
+	hash := util.HashToken(r.Header.Get(agentTokenHeader))
+	return len(a.Hash) > 0 && subtle.ConstantTimeCompare([]byte(hash), []byte(a.Hash)) == 1
+}
+
+// currentAgent 返回发送请求的 agent,同时更新最后请求时间
+func currentAgent(r *http.Request) (*model.Agent, error) {
+	if err := agentEnabled(); err != nil {
+		return nil, err
+	}
+
+	a, err := model.GetAgentByName(r.Header.Get(agentNameHeader))
+	if err != nil {
+		log.Errorf("get agent error:%s", err)
+		return nil, errUnauthorized("agent not registered")
+	}
+	if !checkAgentKey(r, a) {
+		return nil, errUnauthorized("invalid agent token")
+	}
+	model.TouchAgent(a.Id)
+	return a, nil
+}
+
+func checkAgentInfo(info *agentInfo) error {
+	if !agentNameReg.MatchString(info.Name) {
+		return errInvalid("name", "agent name not allowed")
+	}
+	for _, l := range info.Labels {
+		if !labelReg.MatchString(l) {
+			return errInvalid("labels", "label %q must be key=value", l)
+		}
+	}
+	return nil
+}
+
+// saveAgent 保存 agent 上报的标签,服务端添加 agent=名称 的标签,hash 为空时不修改凭证
+func saveAgent(r *http.Request, info *agentInfo, hash string) (*model.Agent, error) {
+	a := &model.Agent{
+		Name:     info.Name,
+		Labels:   append(info.Labels, "agent="+info.Name),
+		Hash:     hash,
+		Ip:       clientIp(r),
+		LastSeen: time.Now(),
+	}
+	if err := model.SaveAgent(a); err != nil {
+		log.Errorf("save agent error:%s", err)
+		return nil, errInternal(err)
+	}
+	return a, nil
+}
+
+// registerAgent agent 启动时注册,之前领取的编译不会再上报,标记为中断。
+// 新的名称使用共用的 agent_token 注册,服务端生成只属于该名称的凭证,admin 批准后才能领取编译;
+// 已经注册的名称只能使用它的凭证重新注册,其他持有 agent_token 的机器不能冒用
+func registerAgent(r *http.Request, info *agentInfo) (*agentCredential, error) {
+	if err := agentEnabled(); err != nil {
+		return nil, err
+	}
+	if err := checkAgentInfo(info); err != nil {
+		return nil, err
+	}
+
+	old, err := model.GetAgentByName(info.Name)
+	if err != nil && !errors.Is(err, model.ErrNotFound) {
+		log.Errorf("get agent error:%s", err)
+		return nil, errInternal(err)
+	}
+
+	token, hash := "", ""
+	if old == nil || len(old.Hash) == 0 {
+		if err := checkAgentToken(r); err != nil {
+			return nil, err
+		}
+		if token, err = util.RandomToken(32); err != nil {
+			return nil, errInternal(err)
+		}
+		hash = util.HashToken(token)
+	} else if !checkAgentKey(r, old) {
+		log.Warnf("agent:%s register from %s with invalid token", info.Name, clientIp(r))
+		return nil, errForbidden(fmt.Sprintf("agent name %s already registered", info.Name))
+	}
+
+	a, err := saveAgent(r, info, hash)
+	if err != nil {
+		return nil, err
+	}
+	if old != nil {
+		interruptAgentBuilds(a, "agent restarted")
+	}
+	if !a.Approved {
+		log.Warnf("agent:%s registered from %s, waiting for admin approval", a.Name, a.Ip)
+	}
+	log.Infof("agent:%s registered from %s, labels:%s", a.Name, a.Ip, strings.Join(a.Labels, ","))
+	return &agentCredential{Agent: *a, Token: token}, nil
+}
+
+// pollAgent 等待并领取一个标签匹配的编译,没有时返回 nil
+func pollAgent(r *http.Request, info *agentInfo) (*agentJob, error) {
+	cur, err := currentAgent(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAgentInfo(info); err != nil {
+		return nil, err
+	}
+	if info.Name != cur.Name {
+		return nil, errInvalid("name", "agent name not match header")
+	}
+	if !cur.Approved {
+		return nil, errForbidden(fmt.Sprintf("agent %s not approved", cur.Name))
+	}
+
+	// 每次领取时更新标签,安装新的 go 版本后不需要重新注册
+	a, err := saveAgent(r, info, "")
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(agentPollWait)
+	defer timeout.Stop()
+	for {
+		wake := agentWake()
+		job, err := nextAgentJob(a)
+		if err != nil || job != nil {
+			return job, err
+		}
+
+		select {
+		case <-wake:
+		case <-timeout.C:
+			return nil, nil
+		case <-r.Context().Done():
+			return nil, nil
+		}
+	}
+}
+
+// nextAgentJob 按创建时间领取第一个标签匹配的编译,编译使用的 go 版本也需要匹配
+func nextAgentJob(a *model.Agent) (*agentJob, error) {
+	tls, err := model.ListQueuedTaskLog()
+	if err != nil {
+		log.Errorf("list queued task log error:%s", err)
+		return nil, errQuery(err)
+	}
+
+	for _, tl := range tls {
+		selector, err := parseSelector(tl.Selector)
+		if err != nil || tl.Config == nil {
+			continue
+		}
+		selector = append(selector, "go="+tl.Config.GoVersion)
+		if !matchLabels(selector, a.Labels) {
+			continue
+		}
+
+		ok, err := model.AssignTaskLog(tl.Id, a)
+		if err != nil {
+			log.Errorf("assign task log error:%s", err)
+			return nil, errInternal(err)
+		}
+		if !ok {
+			continue
+		}
+		tl.AgentId = a.Id
+
+		job, err := newAgentJob(tl)
+		if err != nil {
+			log.Errorf("task log:%d create agent job error:%s", tl.Id, err)
+			model.UpdateTaskLog(tl.Id, model.Failed)
+			continue
+		}
+		log.Infof("task log:%d assigned to agent:%s", tl.Id, a.Name)
+		return job, nil
+	}
+	return nil, nil
+}
+
+// agentTask 服务端处理 agent 上报时使用的编译,工程和任务的配置使用编译时的快照
+func agentTask(tl *model.TaskLog) (*task, error) {
+	tk, err := model.GetTask(tl.TaskId)
+	if err != nil {
+		return nil, err
+	}
+	p, err := model.GetProject(tk.ProjectId)
+	if err != nil {
+		return nil, err
+	}
+	if tl.Config != nil {
+		tl.Config.Apply(p, tk)
+	}
+
+	return &task{
+		id:      tl.Id,
+		p:       p,
+		t:       tk,
+		tl:      tl,
+		mr:      tl.MergeRequest,
+		sha:     tl.Commit,
+		outfile: tl.OutFilePath,
+	}, nil
+}
+
+func newAgentJob(tl *model.TaskLog) (*agentJob, error) {
+	t, err := agentTask(tl)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets, err := model.ListBuildSecretVar(t.p.Id, t.t.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	// 服务端保存 agent 上报的编译输出
+	t.outfile = t.outFilePath()
+	f, err := newLogFile(t.outfile)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	model.UpdateTaskLogOut(t.id, t.outfile)
+
+	job := &agentJob{
+		Id:           tl.Id,
+		ProjectId:    t.p.Id,
+		ProjectName:  t.p.Name,
+		RepoUrl:      t.p.Url,
+		Token:        string(t.p.Token),
+		SshKey:       string(t.p.SshKey),
+		TaskId:       t.t.Id,
+		MergeRequest: tl.MergeRequest,
+		Ref:          tl.Ref,
+		Config:       tl.Config,
+		Secrets:      make([]agentSecret, 0, len(secrets)),
+	}
+	for _, s := range secrets {
+		job.Secrets = append(job.Secrets, agentSecret{Name: s.Name, Value: string(s.Value)})
+	}
+	if !t.p.GoMod {
+		if rel, err := filepath.Rel(t.p.WorkSpace, t.p.LocalPath); err == nil && !strings.HasPrefix(rel, "..") {
+			job.Path = rel
+		}
+	}
+	if tl.RebuildOf > 0 {
+		if orig, err := model.GetTaskLog(tl.RebuildOf); err == nil {
+			job.Pin = orig.Commit
+		}
+	}
+	return job, nil
+}
+
+// agentBuild 返回分配给当前 agent 且没有完成的编译
+func agentBuild(r *http.Request, id int64) (*task, error) {
+	a, err := currentAgent(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tl, err := model.GetTaskLog(id)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return nil, errQuery(err)
+	}
+	if tl.AgentId != a.Id {
+		return nil, errForbidden(fmt.Sprintf("task log:%d is not assigned to agent:%s", id, a.Name))
+	}
+	if tl.Status != model.Init && tl.Status != model.Running {
+		return nil, errConflict("task log:%d already finished", id)
+	}
+
+	t, err := agentTask(tl)
+	if err != nil {
+		log.Errorf("get task error:%s", err)
+		return nil, errQuery(err)
+	}
+	return t, nil
+}
+
+func updateAgentBuild(r *http.Request, id int64, u *agentUpdate) error {
+	t, err := agentBuild(r, id)
+	if err != nil {
+		return err
+	}
+
+	if u.Commit != nil {
+		localSink{}.commit(t, u.Commit)
+		t.sha = u.Commit.Commit
+	}
+	if u.Status != nil {
+		if *u.Status <= model.Init || *u.Status > model.Interrupted {
+			return errInvalid("status", "must be 1-4")
+		}
+		localSink{}.status(t, *u.Status)
+	}
+	if len(u.Report) > 0 {
+		localSink{}.report(t, u.Report)
+	}
+	return nil
+}
+
+// writeAgentChunk 将 agent 上传的一段数据写入文件的 offset 处,重复上传相同的段不影响结果
+func writeAgentChunk(r *http.Request, filename string) (int64, error) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, errInvalid("offset", "must not be negative")
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, int64(agentChunkSize)+1))
+	if err != nil {
+		return 0, errInvalid("body", err.Error())
+	}
+	if len(data) > agentChunkSize {
+		return 0, errInvalid("body", "chunk larger than %d bytes", agentChunkSize)
+	}
+
+	os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		log.Errorf("open file error:%s", err)
+		return 0, errInternal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(data, offset); err != nil {
+		log.Errorf("write file error:%s", err)
+		return 0, errInternal(err)
+	}
+	return offset + int64(len(data)), nil
+}
+
+func appendAgentLog(r *http.Request, id int64) error {
+	t, err := agentBuild(r, id)
+	if err != nil {
+		return err
+	}
+	_, err = writeAgentChunk(r, t.outfile)
+	return err
+}
+
+// uploadAgentArtifact 保存 agent 上传的编译结果,收到最后一段后替换原来的文件,返回下载地址
+func uploadAgentArtifact(r *http.Request, id int64) (string, error) {
+	t, err := agentBuild(r, id)
+	if err != nil {
+		return "", err
+	}
+
+	size, err := queryInt(r, "size", -1)
+	if err != nil {
+		return "", err
+	}
+	if size < 0 {
+		return "", errInvalid("size", "size not set")
+	}
+
+	tmp := t.destPath() + ".upload"
+	end, err := writeAgentChunk(r, tmp)
+	if err != nil {
+		return "", err
+	}
+	if end < size {
+		return "", nil
+	}
+
+	if err := os.Truncate(tmp, size); err != nil {
+		log.Errorf("truncate file error:%s", err)
+		return "", errInternal(err)
+	}
+	if err := os.Rename(tmp, t.destPath()); err != nil {
+		log.Errorf("rename file error:%s", err)
+		return "", errInternal(err)
+	}
+	return localSink{}.artifact(t)
+}
+
+// interruptAgentBuilds 中断 agent 领取后没有完成的编译
+func interruptAgentBuilds(a *model.Agent, reason string) {
+	tls, err := model.ListAgentTaskLog(a.Id)
+	if err != nil {
+		log.Errorf("list agent task log error:%s", err)
+		return
+	}
+
+	for _, tl := range tls {
+		log.Warnf("task log:%d on agent:%s interrupted, %s", tl.Id, a.Name, reason)
+		model.UpdateTaskLog(tl.Id, model.Interrupted)
+		appendOutput(tl.OutFilePath, "build interrupted: "+reason)
+		if t, err := agentTask(tl); err == nil {
+			t.report(util.StatusFailed)
+		}
+	}
+}
+
+// checkAgents 定时检查,agent 超过 agentLostAfter 没有请求时中断它的编译,
+// 等待超过 agentQueueTimeout 没有被领取的编译标记为失败
+func checkAgents() {
+	as, err := model.ListLostAgent(time.Now().Add(-agentLostAfter))
+	if err != nil {
+		log.Errorf("list lost agent error:%s", err)
+		return
+	}
+	for _, a := range as {
+		interruptAgentBuilds(a, fmt.Sprintf("agent not seen since %s", a.LastSeen.Format("2006-01-02 15:04:05")))
+	}
+
+	tls, err := model.ListQueuedTaskLog()
+	if err != nil {
+		log.Errorf("list queued task log error:%s", err)
+		return
+	}
+	for _, tl := range tls {
+		if time.Since(tl.CreateAt) < agentQueueTimeout {
+			continue
+		}
+		t, err := agentTask(tl)
+		if err != nil {
+			log.Errorf("task log:%d get task error:%s", tl.Id, err)
+			model.UpdateTaskLog(tl.Id, model.Failed)
+			continue
+		}
+		t.failQueued(fmt.Sprintf("no agent with labels:%s took the build in %s", tl.Selector, agentQueueTimeout))
+	}
+}
+
+func setTaskLabels(r *http.Request, id int64, labels string) error {
+	old, err := requireTaskRole(r, id, model.RoleMaintainer)
+	if err != nil {
+		return err
+	}
+
+	if _, err := parseSelector(labels); err != nil {
+		return errInvalid("labels", err.Error())
+	}
+
+	if err := model.UpdateTaskLabels(id, labels); err != nil {
+		log.Errorf("update sql error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "task.labels", "task", old.Id, old.ProjectId,
+		map[string]interface{}{"labels": old.Labels}, map[string]interface{}{"labels": labels})
+	return nil
+}
+
+func listAgents(r *http.Request) ([]*model.Agent, error) {
+	if err := requireAdmin(r); err != nil {
+		return nil, err
+	}
+
+	as, err := model.ListAgent()
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return nil, errQuery(err)
+	}
+	return as, nil
+}
+
+// approveAgent 批准后 agent 才能领取编译,取消批准不影响已经领取的编译
+func approveAgent(r *http.Request, id int64, approved bool) error {
+	if err := requireAdmin(r); err != nil {
+		return err
+	}
+
+	old, err := model.GetAgent(id)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return errQuery(err)
+	}
+	if err := model.ApproveAgent(id, approved); err != nil {
+		log.Errorf("update sql error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "agent.approve", "agent", old.Id, 0,
+		map[string]interface{}{"approved": old.Approved}, map[string]interface{}{"approved": approved})
+	if approved {
+		wakeAgents()
+	}
+	return nil
+}
+
+// deleteAgent 删除 agent 和它的凭证,中断它领取的编译,之后需要使用 agent_token 重新注册
+func deleteAgent(r *http.Request, id int64) error {
+	if err := requireAdmin(r); err != nil {
+		return err
+	}
+
+	old, err := model.GetAgent(id)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return errQuery(err)
+	}
+	if err := model.DelAgent(id); err != nil {
+		log.Errorf("delete sql error:%s", err)
+		return errInternal(err)
+	}
+	interruptAgentBuilds(old, "agent deleted")
+
+	audit(r, "agent.delete", "agent", old.Id, 0, old, nil)
+	return nil
+}
+
+func RegisterAgent(wr http.ResponseWriter, r *http.Request) {
+	info := &agentInfo{}
+	if err := decodeBody(r, info); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	a, err := registerAgent(r, info)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, a)
+}
+
+// PollAgent 返回 200 和编译,没有等待的编译时返回 204
+func PollAgent(wr http.ResponseWriter, r *http.Request) {
+	info := &agentInfo{}
+	if err := decodeBody(r, info); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	job, err := pollAgent(r, info)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	if job == nil {
+		writeV2(wr, http.StatusNoContent, nil)
+		return
+	}
+	writeV2(wr, http.StatusOK, job)
+}
+
+func UpdateAgentBuild(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	u := &agentUpdate{}
+	if err := decodeBody(r, u); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := updateAgentBuild(r, id, u); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// AppendAgentLog body 为编译输出从 offset 开始的一段,body 为空时只更新 agent 的最后请求时间
+func AppendAgentLog(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := appendAgentLog(r, id); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// UploadAgentArtifact body 为编译结果从 offset 开始的一段,size 为文件大小,最后一段返回下载地址
+func UploadAgentArtifact(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	url, err := uploadAgentArtifact(r, id)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	if len(url) == 0 {
+		writeV2(wr, http.StatusNoContent, nil)
+		return
+	}
+	writeV2(wr, http.StatusOK, &outputLink{Url: url})
+}
+
+func ListAgent(wr http.ResponseWriter, r *http.Request) {
+	as, err := listAgents(r)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, as)
+}
+
+func ApproveAgent(wr http.ResponseWriter, r *http.Request) {
+	a := &model.Agent{}
+	if err := ParseParam(r, a); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := approveAgent(r, a.Id, a.Approved); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "更新成功")
+}
+
+func DelAgent(wr http.ResponseWriter, r *http.Request) {
+	a := &model.Agent{}
+	if err := ParseParam(r, a); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := deleteAgent(r, a.Id); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "删除成功")
+}
+
+func SetTaskLabels(wr http.ResponseWriter, r *http.Request) {
+	t := &model.Task{}
+	if err := ParseParam(r, t); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := setTaskLabels(r, t.Id, t.Labels); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "更新成功")
+}
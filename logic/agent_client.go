@@ -0,0 +1,553 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hash-rabbit/auto-build/config"
+	goenv "github.com/hash-rabbit/auto-build/env"
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/hash-rabbit/auto-build/util"
+	"github.com/subchen/go-log"
+)
+
+var (
+	// agentRetryWait 请求服务端失败后重试的间隔
+	agentRetryWait = 10 * time.Second
+	// agentLogInterval agent 上传编译输出的间隔
+	agentLogInterval = 2 * time.Second
+	// agentHeartbeat 编译没有输出时发送心跳的间隔,需要小于 agentLostAfter
+	agentHeartbeat = 30 * time.Second
+)
+
+// cgoCompilers 检测的 c 编译器,找到时添加 cgo=名称 的标签
+var cgoCompilers = []string{
+	"gcc", "clang",
+	"aarch64-linux-gnu-gcc", "arm-linux-gnueabihf-gcc", "x86_64-linux-gnu-gcc", "i686-linux-gnu-gcc",
+	"x86_64-w64-mingw32-gcc", "i686-w64-mingw32-gcc",
+	"o64-clang", "oa64-clang",
+}
+
+// agentClient agent 访问服务端的 http 客户端
+type agentClient struct {
+	server string
+	name   string
+	shared string // 共用的 agent_token,只用于第一次注册
+	token  string // 注册时服务端生成的凭证,没有时为 shared
+	client *http.Client
+}
+
+// tokenFile 保存凭证的文件,和 agent 名称对应
+func (c *agentClient) tokenFile() string {
+	return filepath.Join(config.C.WorkPath, fmt.Sprintf(".agent-%s.token", c.name))
+}
+
+// loadToken 读取之前注册时保存的凭证,没有时使用 agent_token
+func (c *agentClient) loadToken() {
+	c.token = c.shared
+	data, err := os.ReadFile(c.tokenFile())
+	if err != nil {
+		return
+	}
+	if token := strings.TrimSpace(string(data)); len(token) > 0 {
+		c.token = token
+	}
+}
+
+func (c *agentClient) saveToken(token string) error {
+	os.MkdirAll(filepath.Dir(c.tokenFile()), os.ModePerm)
+	if err := os.WriteFile(c.tokenFile(), []byte(token), 0600); err != nil {
+		return err
+	}
+	c.token = token
+	return nil
+}
+
+// do 发送请求,out 不为空时解析 200 的返回,返回 http 状态码,服务端的错误转换为 ApiError
+func (c *agentClient) do(ctx context.Context, method, uri string, body io.Reader, out interface{}) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.server+uri, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(agentTokenHeader, c.token)
+	req.Header.Set(agentNameHeader, c.name)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		e := &errorBody{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil || e.Error == nil {
+			return resp.StatusCode, fmt.Errorf("%s %s: %s", method, uri, resp.Status)
+		}
+		return resp.StatusCode, e.Error
+	}
+	if resp.StatusCode == http.StatusOK && out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+func (c *agentClient) post(ctx context.Context, uri string, in, out interface{}) (int, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return 0, err
+	}
+	return c.do(ctx, http.MethodPost, uri, bytes.NewReader(data), out)
+}
+
+func (c *agentClient) info() *agentInfo {
+	return &agentInfo{Name: c.name, Labels: agentLabels()}
+}
+
+// register 注册,第一次注册时保存服务端返回的凭证;
+// 保存的凭证被拒绝时(如 agent 被 admin 删除)下次使用 agent_token 重新注册
+func (c *agentClient) register(ctx context.Context) error {
+	a := &agentCredential{}
+	if _, err := c.post(ctx, "/agent/register", c.info(), a); err != nil {
+		var e *ApiError
+		if errors.As(err, &e) && e.Code == CodeUnauthorized && c.token != c.shared {
+			log.Warnf("agent:%s saved token rejected, register with agent_token next time", c.name)
+			c.token = c.shared
+		}
+		return err
+	}
+	if len(a.Token) > 0 {
+		if err := c.saveToken(a.Token); err != nil {
+			return fmt.Errorf("save agent token error:%s", err)
+		}
+	}
+	if !a.Approved {
+		log.Warnf("agent:%s waiting for admin approval", c.name)
+	}
+	log.Infof("agent:%s registered to %s, labels:%s", c.name, c.server, strings.Join(a.Labels, ","))
+	return nil
+}
+
+// poll 领取编译,服务端没有编译时返回 nil
+func (c *agentClient) poll(ctx context.Context) (*agentJob, error) {
+	job := &agentJob{}
+	status, err := c.post(ctx, "/agent/poll", c.info(), job)
+	if err != nil || status != http.StatusOK {
+		return nil, err
+	}
+	return job, nil
+}
+
+func (c *agentClient) update(id int64, u *agentUpdate) error {
+	_, err := c.post(context.Background(), fmt.Sprintf("/agent/jobs/%d", id), u, nil)
+	return err
+}
+
+// agentLabels 检测本机的系统,架构,已安装的 go 版本和 c 编译器,加上配置中的标签
+func agentLabels() []string {
+	labels := []string{"os=" + runtime.GOOS, "arch=" + runtime.GOARCH}
+
+	versions, err := goenv.ListEnv()
+	if err != nil {
+		log.Errorf("list go env error:%s", err)
+	}
+	for _, v := range versions {
+		labels = append(labels, "go="+v)
+	}
+
+	for _, cc := range cgoCompilers {
+		if _, err := exec.LookPath(cc); err == nil {
+			labels = append(labels, "cgo="+cc)
+		}
+	}
+
+	// 可以编译设置了镜像的任务
+	runtime := config.C.Container
+	if len(runtime) == 0 {
+		runtime = "docker"
+	}
+	if _, err := exec.LookPath(runtime); err == nil {
+		labels = append(labels, "container="+runtime)
+	}
+	return append(labels, config.C.AgentLabels...)
+}
+
+// RunAgent agent 模式:注册后循环领取并编译,一次编译一个,ctx 取消后不再领取
+func RunAgent(ctx context.Context) error {
+	if len(config.C.AgentServer) == 0 || len(config.C.AgentToken) == 0 {
+		return errors.New("agent_server and agent_token must be set")
+	}
+
+	c := &agentClient{
+		server: strings.TrimSuffix(config.C.AgentServer, "/"),
+		name:   config.C.AgentName,
+		shared: config.C.AgentToken,
+		client: &http.Client{Timeout: agentPollWait + 20*time.Second},
+	}
+	if len(c.name) == 0 {
+		c.name, _ = os.Hostname()
+	}
+	c.loadToken()
+
+	registered := false
+	for ctx.Err() == nil {
+		if !registered {
+			if err := c.register(ctx); err != nil {
+				log.Errorf("agent register error:%s", err)
+				sleepContext(ctx, agentRetryWait)
+				continue
+			}
+			registered = true
+		}
+
+		job, err := c.poll(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Errorf("agent poll error:%s", err)
+			// 服务端数据被清理等情况下重新注册
+			var e *ApiError
+			if errors.As(err, &e) && e.Code == CodeUnauthorized {
+				registered = false
+			}
+			sleepContext(ctx, agentRetryWait)
+			continue
+		}
+		if job != nil {
+			runAgentJob(c, job)
+		}
+	}
+	log.Infof("agent:%s stopped", c.name)
+	return nil
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
+
+// runAgentJob 使用服务端的编译流程在本机编译,状态和输出通过 agentSink 上报
+func runAgentJob(c *agentClient, job *agentJob) {
+	log.Infof("agent start task log:%d project:%s", job.Id, job.ProjectName)
+	s := newAgentSink(c, job)
+
+	slot, err := acquireBuild()
+	if err != nil {
+		s.fail(err, model.Interrupted)
+		return
+	}
+	// clone 大的仓库可能超过 agentLostAfter,在准备仓库之前开始发送心跳
+	s.start(slot)
+
+	p := &model.Project{
+		Id:     job.ProjectId,
+		Name:   job.ProjectName,
+		Url:    job.RepoUrl,
+		Token:  model.Secret(job.Token),
+		SshKey: model.Secret(job.SshKey),
+	}
+	tk := &model.Task{Id: job.TaskId, ProjectId: job.ProjectId}
+
+	// 工作目录使用 agent 本机的路径
+	if job.Config.GoMod {
+		job.Config.WorkSpace = config.C.DefaultGoPath
+		p.LocalPath = filepath.Join(config.C.WorkPath, job.ProjectName)
+	} else {
+		job.Config.WorkSpace = filepath.Join(config.C.WorkPath, "gopath", job.ProjectName)
+		p.LocalPath = filepath.Join(job.Config.WorkSpace, job.Path)
+	}
+	job.Config.Apply(p, tk)
+	os.RemoveAll(p.LocalPath)
+
+	if err := prepareAgentRepo(p, job); err != nil {
+		s.fail(err, model.Failed)
+		slot.release()
+		return
+	}
+
+	t := &task{
+		id:    job.Id,
+		p:     p,
+		t:     tk,
+		tl:    &model.TaskLog{Id: job.Id, TaskId: job.TaskId, MergeRequest: job.MergeRequest},
+		mr:    job.MergeRequest,
+		pin:   job.Pin,
+		cfg:   job.Config,
+		slot:  slot,
+		sink:  s,
+		files: make([]*os.File, 0),
+	}
+	if len(job.Pin) == 0 {
+		t.ref = job.Ref
+	}
+
+	t.start()
+	log.Infof("agent finish task log:%d", job.Id)
+}
+
+// prepareAgentRepo 更新本机的 bare 仓库,merge request 和重新编译需要的提交不会在编译时 fetch
+func prepareAgentRepo(p *model.Project, job *agentJob) error {
+	bare := getBarePath(p.Name)
+	cred := credential(p)
+
+	if _, err := os.Stat(bare); os.IsNotExist(err) {
+		if err := util.CloenWithBare(bare, p.Url, cred); err != nil {
+			return fmt.Errorf("git clone %s error:%s", p.Url, err)
+		}
+	} else if len(job.Pin) > 0 || len(job.Ref) > 0 {
+		if err := util.Fetch(bare, "origin", cred); err != nil {
+			log.Warnf("project:%s git fetch error:%s", p.Name, err)
+		}
+	}
+
+	if len(job.Ref) > 0 {
+		if err := util.FetchRef(bare, "origin", job.Ref, cred); err != nil {
+			return fmt.Errorf("git fetch %s error:%s", job.Ref, err)
+		}
+	}
+	return nil
+}
+
+// agentSink agent 编译时将状态和输出上报给服务端,最终状态在编译输出上传完成后上报
+type agentSink struct {
+	c      *agentClient
+	job    *agentJob
+	stream *logStream
+
+	final int // 最终状态,编译输出上传完成后和 commit status 一起上报
+	done  bool
+}
+
+func newAgentSink(c *agentClient, job *agentJob) *agentSink {
+	return &agentSink{c: c, job: job}
+}
+
+func (s *agentSink) send(u *agentUpdate) {
+	if err := s.c.update(s.job.Id, u); err != nil {
+		log.Errorf("task log:%d update error:%s", s.job.Id, err)
+	}
+}
+
+func (s *agentSink) secrets(t *task) ([]*model.SecretVar, error) {
+	ss := make([]*model.SecretVar, 0, len(s.job.Secrets))
+	for _, v := range s.job.Secrets {
+		ss = append(ss, &model.SecretVar{Name: v.Name, Value: model.Secret(v.Value)})
+	}
+	return ss, nil
+}
+
+// config 领取编译时服务端已经保存了配置快照
+func (s *agentSink) config(t *task) {}
+
+// start 开始发送心跳,创建编译输出文件后开始上传
+func (s *agentSink) start(slot *buildSlot) {
+	s.stream = newLogStream(s.c, s.job.Id, slot)
+	go s.stream.run()
+}
+
+func (s *agentSink) outFile(t *task) {
+	if s.stream == nil {
+		s.start(t.slot)
+	}
+	s.stream.setFile(t.outfile)
+}
+
+func (s *agentSink) commit(t *task, c *model.TaskLog) {
+	s.send(&agentUpdate{Commit: c})
+}
+
+func (s *agentSink) status(t *task, status int) {
+	if status == model.Running {
+		s.send(&agentUpdate{Status: &status})
+		return
+	}
+	s.final = status
+}
+
+// report checkError 在最终状态之后调用,此时结束编译
+func (s *agentSink) report(t *task, state string) {
+	if s.final > 0 {
+		s.finish(state)
+		return
+	}
+	s.send(&agentUpdate{Report: state})
+}
+
+// artifact 分段上传编译结果,返回服务端的下载地址
+func (s *agentSink) artifact(t *task) (string, error) {
+	f, err := os.Open(t.destfile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, agentChunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+
+		link := &outputLink{}
+		uri := fmt.Sprintf("/agent/jobs/%d/artifact?offset=%d&size=%d", s.job.Id, offset, fi.Size())
+		if _, err := s.c.do(context.Background(), http.MethodPut, uri, bytes.NewReader(buf[:n]), link); err != nil {
+			return "", err
+		}
+		offset += int64(n)
+		if offset >= fi.Size() {
+			// 编译结果保存在服务端
+			os.Remove(t.destfile)
+			return link.Url, nil
+		}
+	}
+}
+
+// fail 开始编译之前出错,上传错误信息并结束编译
+func (s *agentSink) fail(err error, status int) {
+	log.Errorf("task log:%d error:%s", s.job.Id, err)
+	if s.stream != nil {
+		s.stream.close()
+	}
+	msg := fmt.Sprintf("%s agent %s: %s\n", time.Now().Format("2006-01-02 15:04:05"), s.c.name, err)
+	uri := fmt.Sprintf("/agent/jobs/%d/log?offset=0", s.job.Id)
+	if _, err := s.c.do(context.Background(), http.MethodPost, uri, strings.NewReader(msg), nil); err != nil {
+		log.Errorf("task log:%d upload log error:%s", s.job.Id, err)
+	}
+	s.send(&agentUpdate{Status: &status, Report: util.StatusFailed})
+}
+
+// finish 上传剩余的编译输出后上报最终状态
+func (s *agentSink) finish(state string) {
+	if s.done {
+		return
+	}
+	s.done = true
+
+	if s.stream != nil {
+		s.stream.close()
+	}
+	s.send(&agentUpdate{Status: &s.final, Report: state})
+}
+
+// logStream 定时上传编译输出新增的部分,没有输出时发送心跳
+type logStream struct {
+	c      *agentClient
+	id     int64
+	slot   *buildSlot
+	offset int64
+	last   time.Time
+
+	mu   sync.Mutex
+	file string // 创建编译输出文件之前为空,只发送心跳
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newLogStream(c *agentClient, id int64, slot *buildSlot) *logStream {
+	return &logStream{
+		c:    c,
+		id:   id,
+		slot: slot,
+		last: time.Now(),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+func (l *logStream) run() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(agentLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			l.flush()
+			return
+		case <-ticker.C:
+			l.flush()
+			if time.Since(l.last) > agentHeartbeat {
+				l.send(nil)
+			}
+		}
+	}
+}
+
+func (l *logStream) setFile(file string) {
+	l.mu.Lock()
+	l.file = file
+	l.mu.Unlock()
+}
+
+// flush 上传文件中 offset 之后的内容
+func (l *logStream) flush() {
+	l.mu.Lock()
+	file := l.file
+	l.mu.Unlock()
+	if len(file) == 0 {
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	buf := make([]byte, agentChunkSize)
+	for {
+		n, _ := f.ReadAt(buf, l.offset)
+		if n == 0 {
+			return
+		}
+		if !l.send(buf[:n]) {
+			return
+		}
+		l.offset += int64(n)
+	}
+}
+
+// send 上传一段编译输出,服务端已经结束这次编译时取消本机的编译
+func (l *logStream) send(data []byte) bool {
+	uri := fmt.Sprintf("/agent/jobs/%d/log?offset=%d", l.id, l.offset)
+	status, err := l.c.do(context.Background(), http.MethodPost, uri, bytes.NewReader(data), nil)
+	if err != nil {
+		log.Errorf("task log:%d upload log error:%s", l.id, err)
+		if status == http.StatusConflict || status == http.StatusForbidden {
+			log.Warnf("task log:%d finished on server, cancel build", l.id)
+			l.slot.stop("server")
+		}
+		return false
+	}
+	l.last = time.Now()
+	return true
+}
+
+func (l *logStream) close() {
+	l.once.Do(func() { close(l.stop) })
+	<-l.done
+}
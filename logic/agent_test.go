@@ -0,0 +1,336 @@
+package logic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hash-rabbit/auto-build/config"
+	"github.com/hash-rabbit/auto-build/model"
+)
+
+func TestParseSelector(t *testing.T) {
+	labels, err := parseSelector(" os=linux, arch=arm64 ,,cgo=aarch64-linux-gnu-gcc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(labels) != 3 || labels[1] != "arch=arm64" {
+		t.Errorf("labels:%v", labels)
+	}
+
+	if labels, err := parseSelector(""); err != nil || len(labels) != 0 {
+		t.Errorf("empty selector:%v %v", labels, err)
+	}
+
+	for _, s := range []string{"linux", "os=", "os=linux;rm -rf", "os=a b"} {
+		if _, err := parseSelector(s); err == nil {
+			t.Errorf("selector %q should be invalid", s)
+		}
+	}
+}
+
+func TestMatchLabels(t *testing.T) {
+	agent := []string{"os=linux", "arch=amd64", "go=go1.20.6", "go=go1.21.0", "agent=build-1"}
+
+	cases := []struct {
+		selector []string
+		want     bool
+	}{
+		{nil, true},
+		{[]string{"os=linux"}, true},
+		{[]string{"os=linux", "go=go1.21.0"}, true},
+		{[]string{"agent=build-1"}, true},
+		{[]string{"os=linux", "arch=arm64"}, false},
+		{[]string{"go=go1.19"}, false},
+	}
+	for _, c := range cases {
+		if got := matchLabels(c.selector, agent); got != c.want {
+			t.Errorf("match %v:%v, want %v", c.selector, got, c.want)
+		}
+	}
+}
+
+// agentEnv 使用真实的 agent 接口的测试环境,agent 已经注册并批准
+type agentEnv struct {
+	dir string
+	srv *httptest.Server
+	c   *agentClient
+	p   *model.Project
+	tk  *model.Task
+}
+
+func newAgentEnv(t *testing.T) *agentEnv {
+	dir := initTestDB(t)
+	config.C.DestPath = filepath.Join(dir, "dest")
+	config.C.WorkPath = filepath.Join(dir, "work")
+	config.C.AgentToken = "shared token"
+	config.C.AgentLabels = []string{"go=go1.20.6"}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/agent/register", RegisterAgent).Methods(http.MethodPost)
+	r.HandleFunc("/agent/poll", PollAgent).Methods(http.MethodPost)
+	r.HandleFunc("/agent/jobs/{id}", UpdateAgentBuild).Methods(http.MethodPost)
+	r.HandleFunc("/agent/jobs/{id}/log", AppendAgentLog).Methods(http.MethodPost)
+	r.HandleFunc("/agent/jobs/{id}/artifact", UploadAgentArtifact).Methods(http.MethodPut)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	p := &model.Project{Name: "remote", LocalPath: filepath.Join(dir, "remote"), GoMod: true, GoVersion: "go1.20.6"}
+	if err := model.InsertProject(p); err != nil {
+		t.Fatal(err)
+	}
+	tk := &model.Task{ProjectId: p.Id, Branch: "master", MainFile: "main.go", DestFile: "demo", Labels: "os=" + runtime.GOOS}
+	if err := model.InsertTask(tk); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &agentEnv{dir: dir, srv: srv, p: p, tk: tk}
+	e.c = e.register(t, "build-1")
+	a, _ := model.GetAgentByName("build-1")
+	admin := withUser(httptest.NewRequest(http.MethodPut, "/api/v2/agents/1/approval", nil), &model.User{Id: 1, Name: "admin", Admin: true})
+	if err := approveAgent(admin, a.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func (e *agentEnv) register(t *testing.T, name string) *agentClient {
+	c := &agentClient{server: e.srv.URL, name: name, shared: config.C.AgentToken, client: e.srv.Client()}
+	c.loadToken()
+	if err := c.register(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// queue 开始一次编译,等待 agent 领取
+func (e *agentEnv) queue(t *testing.T) *model.TaskLog {
+	tl := &model.TaskLog{TaskId: e.tk.Id, Status: model.Init}
+	if err := model.InsertTaskLog(tl); err != nil {
+		t.Fatal(err)
+	}
+	bt := &task{id: tl.Id, p: e.p, t: e.tk, tl: tl}
+	bt.enqueue()
+	return tl
+}
+
+// poll 领取编译,agent 端的编译使用 agentSink 上报
+func (e *agentEnv) poll(t *testing.T) (*agentJob, *agentSink, *task) {
+	job, err := e.c.poll(context.Background())
+	if err != nil || job == nil {
+		t.Fatalf("poll job:%v error:%v", job, err)
+	}
+	slot, err := acquireBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(slot.release)
+
+	s := newAgentSink(e.c, job)
+	bt := &task{
+		id:      job.Id,
+		p:       &model.Project{Id: job.ProjectId, Name: job.ProjectName},
+		t:       &model.Task{Id: job.TaskId, DestFile: "demo"},
+		slot:    slot,
+		sink:    s,
+		outfile: filepath.Join(e.dir, "agent", "out.log"),
+	}
+	return job, s, bt
+}
+
+func TestAgentRegister(t *testing.T) {
+	e := newAgentEnv(t)
+
+	if e.c.token == config.C.AgentToken {
+		t.Fatal("agent token not issued")
+	}
+	data, err := os.ReadFile(e.c.tokenFile())
+	if err != nil || string(data) != e.c.token {
+		t.Fatalf("token file:%q error:%v", data, err)
+	}
+
+	// 其他持有 agent_token 的机器不能使用已经注册的名称
+	other := &agentClient{server: e.srv.URL, name: "build-1", shared: config.C.AgentToken, token: config.C.AgentToken, client: e.srv.Client()}
+	if err := other.register(context.Background()); toApiError(err).Code != CodeForbidden {
+		t.Errorf("register with shared token:%v", err)
+	}
+	if _, err := other.poll(context.Background()); toApiError(err).Code != CodeUnauthorized {
+		t.Errorf("poll with shared token:%v", err)
+	}
+
+	// 重新启动后使用保存的凭证
+	if c := e.register(t, "build-1"); c.token != e.c.token {
+		t.Errorf("token changed after restart")
+	}
+
+	// 新注册的 agent 批准前不能领取编译
+	c2 := e.register(t, "build-2")
+	if _, err := c2.poll(context.Background()); toApiError(err).Code != CodeForbidden {
+		t.Errorf("poll before approval:%v", err)
+	}
+
+	viewer := withUser(httptest.NewRequest(http.MethodGet, "/api/v2/agents", nil), &model.User{Id: 2, Name: "viewer"})
+	if _, err := listAgents(viewer); toApiError(err).Code != CodeForbidden {
+		t.Errorf("list agents by viewer:%v", err)
+	}
+}
+
+// TestAgentPollWake 等待中的 agent 在新的编译进入队列后立即领取
+func TestAgentPollWake(t *testing.T) {
+	e := newAgentEnv(t)
+	defer func(d time.Duration) { agentPollWait = d }(agentPollWait)
+	agentPollWait = 20 * time.Second
+
+	type result struct {
+		job *agentJob
+		err error
+	}
+	ch := make(chan result, 1)
+	start := time.Now()
+	go func() {
+		job, err := e.c.poll(context.Background())
+		ch <- result{job, err}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	tl := e.queue(t)
+
+	res := <-ch
+	if res.err != nil || res.job == nil {
+		t.Fatalf("poll job:%v error:%v", res.job, res.err)
+	}
+	if res.job.Id != tl.Id {
+		t.Errorf("job:%d, want:%d", res.job.Id, tl.Id)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("poll returned after %s, not woken", d)
+	}
+
+	got, _ := model.GetTaskLog(tl.Id)
+	if got.AgentName != "build-1" {
+		t.Errorf("agent name:%s", got.AgentName)
+	}
+}
+
+// TestAgentQueueNoMatch 没有 agent 匹配标签时编译直接失败
+func TestAgentQueueNoMatch(t *testing.T) {
+	e := newAgentEnv(t)
+	e.tk.Labels = "os=plan9"
+
+	tl := e.queue(t)
+	got, _ := model.GetTaskLog(tl.Id)
+	if got.Status != model.Failed {
+		t.Fatalf("status:%d", got.Status)
+	}
+	data, _ := os.ReadFile(got.OutFilePath)
+	if !strings.Contains(string(data), "no approved agent has labels:os=plan9") {
+		t.Errorf("output:%s", data)
+	}
+}
+
+// TestAgentSinkFinish 最终状态在编译输出上传完成后和 commit status 一起上报
+func TestAgentSinkFinish(t *testing.T) {
+	e := newAgentEnv(t)
+	tl := e.queue(t)
+	_, s, bt := e.poll(t)
+
+	f, err := newLogFile(bt.outfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.outFile(bt)
+	out := strings.Repeat("build output\n", 100)
+	f.WriteString(out)
+	f.Close()
+
+	s.status(bt, model.Success)
+	if got, _ := model.GetTaskLog(tl.Id); got.Status != model.Init {
+		t.Fatalf("status reported before finish:%d", got.Status)
+	}
+	s.report(bt, "success")
+
+	got, _ := model.GetTaskLog(tl.Id)
+	if got.Status != model.Success {
+		t.Errorf("status:%d", got.Status)
+	}
+	data, _ := os.ReadFile(got.OutFilePath)
+	if string(data) != out {
+		t.Errorf("output:%d bytes, want:%d", len(data), len(out))
+	}
+}
+
+// TestAgentArtifact 编译结果分段上传,最后一段返回下载地址
+func TestAgentArtifact(t *testing.T) {
+	e := newAgentEnv(t)
+	defer func(n int) { agentChunkSize = n }(agentChunkSize)
+	agentChunkSize = 8
+
+	tl := e.queue(t)
+	job, s, bt := e.poll(t)
+
+	bt.destfile = filepath.Join(e.dir, "agent", "demo")
+	content := "0123456789abcdefghij"
+	os.MkdirAll(filepath.Dir(bt.destfile), os.ModePerm)
+	if err := os.WriteFile(bt.destfile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	url, err := s.artifact(bt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(url, "/output/remote/master/demo") {
+		t.Errorf("url:%s", url)
+	}
+	srvTask, _ := agentTask(tl)
+	data, err := os.ReadFile(srvTask.destPath())
+	if err != nil || string(data) != content {
+		t.Errorf("artifact:%q error:%v", data, err)
+	}
+
+	uri := fmt.Sprintf("/agent/jobs/%d/artifact?offset=0&size=9", job.Id)
+	status, err := e.c.do(context.Background(), http.MethodPut, uri, strings.NewReader("012345678"), nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("chunk larger than limit:%d %v", status, err)
+	}
+	status, err = e.c.do(context.Background(), http.MethodPut, uri[:len(uri)-len("&size=9")], bytes.NewReader(nil), nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("size not set:%d %v", status, err)
+	}
+}
+
+// TestAgentLogCancel 服务端已经结束或者编译不属于该 agent 时取消 agent 的编译
+func TestAgentLogCancel(t *testing.T) {
+	e := newAgentEnv(t)
+	tl := e.queue(t)
+	_, _, bt := e.poll(t)
+
+	// 不属于该 agent
+	c2 := e.register(t, "build-2")
+	slot, err := acquireBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slot.release()
+	if newLogStream(c2, tl.Id, slot).send([]byte("x")) || !slot.cancelled() {
+		t.Error("build of other agent not cancelled")
+	}
+
+	// 服务端已经结束
+	model.UpdateTaskLog(tl.Id, model.Interrupted)
+	l := newLogStream(e.c, tl.Id, bt.slot)
+	if l.send([]byte("x")) || !bt.slot.cancelled() {
+		t.Fatal("finished build not cancelled")
+	}
+	if reason := bt.slot.cancelReason(); reason != "server" {
+		t.Errorf("reason:%s", reason)
+	}
+}
@@ -0,0 +1,839 @@
+package logic
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/hash-rabbit/auto-build/model"
+)
+
+// v2 接口: 资源路径,使用状态码表示结果,错误返回 {"error":{"code","message","field"}}
+// 和 v1 共用 createProject 等核心函数
+
+// pathId 路径中的 id 参数
+func pathId(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)[name], 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errInvalid(name, "must be positive integer")
+	}
+	return id, nil
+}
+
+// queryInt 可选的整数查询参数,没有时返回 def
+func queryInt(r *http.Request, name string, def int64) (int64, error) {
+	v := r.URL.Query().Get(name)
+	if len(v) == 0 {
+		return def, nil
+	}
+
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, errInvalid(name, "must be integer")
+	}
+	return i, nil
+}
+
+// queryPage 分页参数,page_size 默认 20 最大 100,page_num 从 1 开始(0 视为 1),返回 limit 和 offset
+func queryPage(r *http.Request) (int, int, error) {
+	size, err := queryInt(r, "page_size", 20)
+	if err != nil {
+		return 0, 0, err
+	}
+	if size <= 0 || size > 100 {
+		return 0, 0, errInvalid("page_size", "must be between 1 and 100")
+	}
+
+	num, err := queryInt(r, "page_num", 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if num < 0 {
+		return 0, 0, errInvalid("page_num", "must be positive")
+	}
+	if num == 0 {
+		num = 1
+	}
+	return int(size), int((num - 1) * size), nil
+}
+
+// OptionsV2 跨域预检请求
+func OptionsV2(wr http.ResponseWriter, r *http.Request) {
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// session
+
+func LoginV2(wr http.ResponseWriter, r *http.Request) {
+	param := &loginParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	u, token, err := login(wr, r, param)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusCreated, &loginResult{User: u, Token: token})
+}
+
+func LogoutV2(wr http.ResponseWriter, r *http.Request) {
+	logout(wr, r)
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+func GetMeV2(wr http.ResponseWriter, r *http.Request) {
+	writeV2(wr, http.StatusOK, currentUser(r))
+}
+
+func ChangePasswordV2(wr http.ResponseWriter, r *http.Request) {
+	param := &passwordParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := changePassword(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// users
+
+func ListUsersV2(wr http.ResponseWriter, r *http.Request) {
+	us, err := listUsers(r)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, us)
+}
+
+func CreateUserV2(wr http.ResponseWriter, r *http.Request) {
+	param := &userParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	u, err := createUser(r, param)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusCreated, u)
+}
+
+func DeleteUserV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err == nil {
+		err = deleteUser(r, id)
+	}
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// tokens
+
+func ListTokensV2(wr http.ResponseWriter, r *http.Request) {
+	ts, err := listTokens(r)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, ts)
+}
+
+func CreateTokenV2(wr http.ResponseWriter, r *http.Request) {
+	param := &tokenParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	token, err := createToken(r, param)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusCreated, &tokenResult{Name: param.Name, Token: token})
+}
+
+func DeleteTokenV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err == nil {
+		err = deleteToken(r, id)
+	}
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+type outputLinkParam struct {
+	Path   string `json:"path"`   // 工程名/分支/文件名
+	Expire int    `json:"expire"` // 秒,默认 3600
+}
+
+type outputLink struct {
+	Url string `json:"url"`
+}
+
+func CreateOutputLinkV2(wr http.ResponseWriter, r *http.Request) {
+	param := &outputLinkParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	url, err := signOutput(r, param.Path, param.Expire)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusCreated, &outputLink{Url: url})
+}
+
+// home, goenv
+
+func GetHomeV2(wr http.ResponseWriter, r *http.Request) {
+	info, err := homeInfo()
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, info)
+}
+
+func ListGoEnvsV2(wr http.ResponseWriter, r *http.Request) {
+	envs, err := listEnvs()
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, envs)
+}
+
+type goEnvParam struct {
+	Version string `json:"version"` // 如 go1.20.6
+}
+
+// InstallGoEnvV2 安装在后台进行,返回 202
+func InstallGoEnvV2(wr http.ResponseWriter, r *http.Request) {
+	param := &goEnvParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := installEnv(r, param.Version); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusAccepted, nil)
+}
+
+func DeleteGoEnvV2(wr http.ResponseWriter, r *http.Request) {
+	if err := deleteEnv(r, mux.Vars(r)["version"]); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// projects
+
+func ListProjectsV2(wr http.ResponseWriter, r *http.Request) {
+	ps, err := listProjects(r, r.URL.Query().Get("name"))
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, ps)
+}
+
+func CreateProjectV2(wr http.ResponseWriter, r *http.Request) {
+	p := &model.Project{}
+	if err := decodeBody(r, p); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := createProject(r, p); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	wr.Header().Set("Location", fmt.Sprintf("/api/v2/projects/%d", p.Id))
+	writeV2(wr, http.StatusCreated, p)
+}
+
+func GetProjectV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	p, err := getProject(r, id)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, p)
+}
+
+func DeleteProjectV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err == nil {
+		err = deleteProject(r, id)
+	}
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+func ListBranchesV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	bs, err := listBranches(r, id)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, bs)
+}
+
+type pollParam struct {
+	PollInterval *int `json:"poll_interval"`
+}
+
+func SetProjectPollV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	param := &pollParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	if param.PollInterval == nil {
+		writeV2Error(wr, errInvalid("poll_interval", "required"))
+		return
+	}
+
+	if err := setProjectPoll(r, id, *param.PollInterval); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// members
+
+func ListMembersV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	ms, err := listMembers(r, id)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, ms)
+}
+
+type memberParam struct {
+	Role int `json:"role"`
+}
+
+func SetMemberV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	userid, err := pathId(r, "user_id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	param := &memberParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := saveMember(r, &model.ProjectMember{ProjectId: id, UserId: userid, Role: param.Role}); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+func DeleteMemberV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	userid, err := pathId(r, "user_id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := deleteMember(r, id, userid); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// secrets
+
+func ListSecretsV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	// 不传 task_id 时返回工程下所有变量
+	taskid, err := queryInt(r, "task_id", -1)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	vs, err := listSecrets(r, id, taskid)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, vs)
+}
+
+type secretParam struct {
+	TaskId int64  `json:"task_id"` // 0 为工程变量
+	Value  string `json:"value"`
+}
+
+func SetSecretV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	param := &secretParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	v := &model.SecretVar{
+		ProjectId: id,
+		TaskId:    param.TaskId,
+		Name:      mux.Vars(r)["name"],
+		Value:     model.Secret(param.Value),
+	}
+	if err := saveSecret(r, v); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, v)
+}
+
+func DeleteSecretV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err == nil {
+		err = deleteSecret(r, id)
+	}
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// tasks
+
+func ListTasksV2(wr http.ResponseWriter, r *http.Request) {
+	projectid, err := queryInt(r, "project_id", 0)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	ts, err := listTasks(r, projectid)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, ts)
+}
+
+func CreateTaskV2(wr http.ResponseWriter, r *http.Request) {
+	t := &model.Task{}
+	if err := decodeBody(r, t); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := createTask(r, t); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	wr.Header().Set("Location", fmt.Sprintf("/api/v2/tasks/%d", t.Id))
+	writeV2(wr, http.StatusCreated, t)
+}
+
+func GetTaskV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	t, err := requireTaskRole(r, id, model.RoleViewer)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, t)
+}
+
+func DeleteTaskV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err == nil {
+		err = deleteTask(r, id)
+	}
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+type autoBuildParam struct {
+	AutoBuild *bool `json:"auto_build"`
+}
+
+func SetTaskAutoBuildV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	param := &autoBuildParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	if param.AutoBuild == nil {
+		writeV2Error(wr, errInvalid("auto_build", "required"))
+		return
+	}
+
+	if err := setTaskAutoBuild(r, id, *param.AutoBuild); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+type cronParam struct {
+	Cron     string `json:"cron"` // 为空时取消定时编译
+	CronSkip bool   `json:"cron_skip"`
+}
+
+func SetTaskCronV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	param := &cronParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := setTaskCron(r, id, param.Cron, param.CronSkip); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+type labelsParam struct {
+	Labels string `json:"labels"` // 为空时在服务端编译
+}
+
+func SetTaskLabelsV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	param := &labelsParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := setTaskLabels(r, id, param.Labels); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+type imageParam struct {
+	Image string `json:"image"` // 为空时在主机上编译
+}
+
+func SetTaskImageV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	param := &imageParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := setTaskImage(r, id, param.Image); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+func ListAgentsV2(wr http.ResponseWriter, r *http.Request) {
+	as, err := listAgents(r)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, as)
+}
+
+type approvalParam struct {
+	Approved *bool `json:"approved"`
+}
+
+func ApproveAgentV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	param := &approvalParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	if param.Approved == nil {
+		writeV2Error(wr, errInvalid("approved", "required"))
+		return
+	}
+
+	if err := approveAgent(r, id, *param.Approved); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+func DeleteAgentV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err == nil {
+		err = deleteAgent(r, id)
+	}
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// StartTaskV2 编译在后台进行,返回 202 和编译记录
+func StartTaskV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	tl, err := startTask(r, id)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	wr.Header().Set("Location", fmt.Sprintf("/api/v2/task-logs/%d", tl.Id))
+	writeV2(wr, http.StatusAccepted, tl)
+}
+
+// task logs
+
+type taskLogPage struct {
+	Total int64                `json:"total"`
+	Items []*model.TaskLogInfo `json:"items"`
+}
+
+// ListTaskLogsV2 默认查询分支和 merge request 的编译
+func ListTaskLogsV2(wr http.ResponseWriter, r *http.Request) {
+	f, err := parseTaskLogFilter(r, -1)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	limit, offset, err := queryPage(r)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	ts, total, err := listTaskLogs(r, f, limit, offset)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, &taskLogPage{Total: total, Items: ts})
+}
+
+func GetTaskLogV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	tl, err := getTaskLog(r, id)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, tl)
+}
+
+// RebuildTaskLogV2 使用相同的 commit 和配置重新编译,返回 202 和新的编译记录
+func RebuildTaskLogV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	tl, err := rebuildTaskLog(r, id)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	wr.Header().Set("Location", fmt.Sprintf("/api/v2/task-logs/%d", tl.Id))
+	writeV2(wr, http.StatusAccepted, tl)
+}
+
+// CancelTaskLogV2 取消编译,返回 204
+func CancelTaskLogV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	if err := cancelTaskLog(r, id); err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusNoContent, nil)
+}
+
+// GetTaskLogChangelogV2 本次编译和上一次成功编译之间的提交
+func GetTaskLogChangelogV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	cl, err := taskLogChangelog(r, id)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, cl)
+}
+
+// GetTaskLogOutputV2 返回纯文本的编译输出
+func GetTaskLogOutputV2(wr http.ResponseWriter, r *http.Request) {
+	id, err := pathId(r, "id")
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	out, err := taskLogOutput(r, id)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	wr.Header().Set("Access-Control-Allow-Origin", "*")
+	wr.Write([]byte(out))
+}
+
+// audit logs
+
+func ListAuditLogsV2(wr http.ResponseWriter, r *http.Request) {
+	f, err := parseAuditFilter(r)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	limit, offset, err := queryPage(r)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+
+	as, err := listAuditLogs(r, f, limit, offset)
+	if err != nil {
+		writeV2Error(wr, err)
+		return
+	}
+	writeV2(wr, http.StatusOK, as)
+}
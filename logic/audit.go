@@ -0,0 +1,162 @@
+package logic
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hash-rabbit/auto-build/config"
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/subchen/go-log"
+)
+
+// audit 记录修改操作,before/after 为修改前后的值,序列化为 json,写入失败不影响请求
+func audit(r *http.Request, action, target string, targetId, projectId int64, before, after interface{}) {
+	a := &model.AuditLog{
+		Action:    action,
+		Target:    target,
+		TargetId:  targetId,
+		ProjectId: projectId,
+		Before:    auditValue(before),
+		After:     auditValue(after),
+		Ip:        clientIp(r),
+	}
+	if u := currentUser(r); u != nil {
+		a.UserId = u.Id
+		a.UserName = u.Name
+	}
+
+	if err := model.InsertAuditLog(a); err != nil {
+		log.Errorf("insert audit log %s error:%s", action, err)
+	}
+}
+
+func auditValue(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("marshal audit value error:%s", err)
+		return ""
+	}
+	return string(data)
+}
+
+// clientIp 使用连接的地址,只有来自 trusted_proxies 的请求才使用 X-Forwarded-For,
+// 从右往左取第一个不是可信代理的地址
+func clientIp(r *http.Request) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+
+	fs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(fs) - 1; i >= 0; i-- {
+		f := strings.TrimSpace(fs[i])
+		if len(f) == 0 {
+			continue
+		}
+		ip = f
+		if !trustedProxy(f) {
+			break
+		}
+	}
+	return ip
+}
+
+// trustedProxy ip 是否在配置的 trusted_proxies 中,支持 ip 和 CIDR
+func trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil || config.C == nil {
+		return false
+	}
+	for _, p := range config.C.TrustedProxies {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			if n.Contains(addr) {
+				return true
+			}
+		} else if other := net.ParseIP(p); other != nil && other.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuditFilter 解析查询参数
+func parseAuditFilter(r *http.Request) (*model.AuditFilter, error) {
+	f := &model.AuditFilter{
+		UserName: r.FormValue("user_name"),
+		Action:   r.FormValue("action"),
+		Target:   r.FormValue("target"),
+	}
+	f.TargetId, _ = strconv.ParseInt(r.FormValue("target_id"), 10, 64)
+	f.ProjectId, _ = strconv.ParseInt(r.FormValue("project_id"), 10, 64)
+
+	var err error
+	if f.Start, f.End, err = parseDateRange(r); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseDateRange 解析 start/end 参数,日期格式为 2006-01-02,end 包含当天
+func parseDateRange(r *http.Request) (start, end time.Time, err error) {
+	if v := r.FormValue("start"); len(v) > 0 {
+		if start, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil {
+			return start, end, errInvalid("start", "must be 2006-01-02")
+		}
+	}
+	if v := r.FormValue("end"); len(v) > 0 {
+		if end, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil {
+			return start, end, errInvalid("end", "must be 2006-01-02")
+		}
+		end = end.AddDate(0, 0, 1)
+	}
+	return start, end, nil
+}
+
+// listAuditLogs 管理员可以查看所有记录,工程 maintainer 可以查看工程的记录
+func listAuditLogs(r *http.Request, f *model.AuditFilter, limit, offset int) ([]*model.AuditLog, error) {
+	if f.ProjectId > 0 {
+		if err := requireRole(r, f.ProjectId, model.RoleMaintainer); err != nil {
+			return nil, err
+		}
+	} else if err := requireAdmin(r); err != nil {
+		return nil, err
+	}
+
+	as, err := model.ListAuditLog(f, limit, offset)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return nil, errInternal(err)
+	}
+	return as, nil
+}
+
+func ListAuditLog(wr http.ResponseWriter, r *http.Request) {
+	f, err := parseAuditFilter(r)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+
+	limit, offset, err := queryPage(r)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+
+	as, err := listAuditLogs(r, f, limit, offset)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, as)
+}
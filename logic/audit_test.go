@@ -0,0 +1,39 @@
+package logic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hash-rabbit/auto-build/config"
+)
+
+func TestClientIp(t *testing.T) {
+	config.C = &config.Config{TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"}}
+	defer func() { config.C = nil }()
+
+	cases := []struct {
+		remote string
+		header string
+		ip     string
+	}{
+		{"1.2.3.4:1234", "", "1.2.3.4"},
+		// 不可信的来源伪造 X-Forwarded-For
+		{"1.2.3.4:1234", "5.6.7.8", "1.2.3.4"},
+		{"10.0.0.1:1234", "5.6.7.8", "5.6.7.8"},
+		// 只信任可信代理追加的地址
+		{"10.0.0.1:1234", "9.9.9.9, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"192.168.1.1:1234", "10.0.0.1", "10.0.0.1"},
+		{"10.0.0.1:1234", "", "10.0.0.1"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/api/task/list", nil)
+		r.RemoteAddr = c.remote
+		if len(c.header) > 0 {
+			r.Header.Set("X-Forwarded-For", c.header)
+		}
+		if ip := clientIp(r); ip != c.ip {
+			t.Errorf("remote:%s header:%s ip:%s, want:%s", c.remote, c.header, ip, c.ip)
+		}
+	}
+}
@@ -0,0 +1,609 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hash-rabbit/auto-build/config"
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/hash-rabbit/auto-build/util"
+	"github.com/subchen/go-log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	sessionCookie  = "auto_build_session"
+	sessionExpire  = 7 * 24 * time.Hour
+	maxSignExpire  = 7 * 24 * time.Hour
+	minPasswordLen = 8
+)
+
+type ctxKey int
+
+const (
+	userKey ctxKey = iota
+	tokenKey
+)
+
+// 不需要登录的接口,webhook 由仓库调用
+var publicPrefix = []string{"/web/", "/webhook/", "/agent/", "/api/user/login"}
+
+// Auth 校验 /api/*, /output/ 和 /logs/ 的 session 或 token,/output/ 同时支持签名链接
+func Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || isPublic(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if isSignable(r) && len(r.URL.Query().Get("sign")) > 0 {
+			if err := checkSignedUrl(r); err != nil {
+				log.Warnf("check signed url %s error:%s", r.URL.Path, err)
+				writeV1Error(w, errUnauthorized(err.Error()))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u, t, err := authenticate(r)
+		if err != nil {
+			log.Debugf("auth %s error:%s", r.URL.Path, err)
+			if isV2(r) {
+				writeV2Error(w, errUnauthorized(err.Error()))
+			} else {
+				writeV1Error(w, errUnauthorized(err.Error()))
+			}
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userKey, u)
+		ctx = context.WithValue(ctx, tokenKey, t)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func isPublic(r *http.Request) bool {
+	path := r.URL.Path
+	// 登录,退出登录需要当前 session
+	if path == "/" || path == "/api/openapi.json" || (path == "/api/v2/session" && r.Method == http.MethodPost) {
+		return true
+	}
+	for _, p := range publicPrefix {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSignable 编译结果可以使用签名链接访问,编译日志需要登录
+func isSignable(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/output/")
+}
+
+// authenticate 优先使用 Authorization: Bearer <token>,其次使用登录 cookie
+func authenticate(r *http.Request) (*model.User, *model.ApiToken, error) {
+	token := ""
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	} else if c, err := r.Cookie(sessionCookie); err == nil {
+		token = c.Value
+	}
+	if len(token) == 0 {
+		return nil, nil, errors.New("login required")
+	}
+
+	t, err := model.GetApiTokenByHash(util.HashToken(token))
+	if err != nil {
+		return nil, nil, errors.New("invalid token")
+	}
+	if t.Expired() {
+		return nil, nil, errors.New("token expired")
+	}
+
+	u, err := model.GetUser(t.UserId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u, t, nil
+}
+
+func currentUser(r *http.Request) *model.User {
+	u, _ := r.Context().Value(userKey).(*model.User)
+	return u
+}
+
+func isAdmin(r *http.Request) bool {
+	u := currentUser(r)
+	return u != nil && u.Admin
+}
+
+// InitAdmin 没有用户时创建 admin,随机密码只在标准错误中输出一次,不写入日志文件
+func InitAdmin() error {
+	n, err := model.CountUser()
+	if err != nil || n > 0 {
+		return err
+	}
+
+	password, err := util.RandomToken(8)
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	err = model.InsertUser(&model.User{Name: "admin", Password: string(hash), Admin: true})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "create user admin with password:%s, please change it after login\n", password)
+	log.Warn("create user admin, the initial password is printed to stderr")
+	return nil
+}
+
+// ResetPassword 用于命令行重置密码
+func ResetPassword(name, password string) error {
+	if len(password) < minPasswordLen {
+		return fmt.Errorf("password must be at least %d characters", minPasswordLen)
+	}
+
+	u, err := model.GetUserByName(name)
+	if err != nil {
+		return err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return model.UpdateUserPassword(u.Id, string(hash))
+}
+
+func isV2(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/v2/")
+}
+
+type loginParam struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+}
+
+type loginResult struct {
+	User  *model.User `json:"user"`
+	Token string      `json:"token"` // session token,也可以作为 Bearer token 使用
+}
+
+// login 校验密码并创建 session,返回 session token
+func login(wr http.ResponseWriter, r *http.Request, param *loginParam) (*model.User, string, error) {
+	u, err := model.GetUserByName(param.Name)
+	if err == nil {
+		err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(param.Password))
+	}
+	if err != nil {
+		log.Warnf("user:%s login from %s failed:%s", param.Name, r.RemoteAddr, err)
+		return nil, "", errUnauthorized("wrong user name or password")
+	}
+
+	if n, err := model.DelExpiredApiToken(); err != nil {
+		log.Errorf("delete expired token error:%s", err)
+	} else if n > 0 {
+		log.Debugf("delete %d expired tokens", n)
+	}
+
+	token, err := newApiToken(u.Id, "login", true, sessionExpire)
+	if err != nil {
+		log.Errorf("create session error:%s", err)
+		return nil, "", errInternal(err)
+	}
+
+	http.SetCookie(wr, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(sessionExpire),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return u, token, nil
+}
+
+func logout(wr http.ResponseWriter, r *http.Request) {
+	if t, ok := r.Context().Value(tokenKey).(*model.ApiToken); ok && t.Session {
+		if err := model.DelApiToken(t.Id, t.UserId); err != nil {
+			log.Errorf("delete session error:%s", err)
+		}
+	}
+
+	http.SetCookie(wr, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+}
+
+func Login(wr http.ResponseWriter, r *http.Request) {
+	param := &loginParam{}
+	if err := ParseParam(r, param); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	u, token, err := login(wr, r, param)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, &loginResult{User: u, Token: token})
+}
+
+func Logout(wr http.ResponseWriter, r *http.Request) {
+	logout(wr, r)
+	writeSuccess(wr, "logout")
+}
+
+func UserInfo(wr http.ResponseWriter, r *http.Request) {
+	writeJson(wr, currentUser(r))
+}
+
+type userParam struct {
+	Name     string `json:"name"`
+	Password string `json:"password"`
+	Admin    bool   `json:"admin"`
+}
+
+func createUser(r *http.Request, param *userParam) (*model.User, error) {
+	if err := requireAdmin(r); err != nil {
+		return nil, err
+	}
+
+	if len(param.Name) == 0 {
+		return nil, errInvalid("name", "user name not set")
+	}
+	if len(param.Password) < minPasswordLen {
+		return nil, errInvalid("password", "password must be at least %d characters", minPasswordLen)
+	}
+	if _, err := model.GetUserByName(param.Name); err == nil {
+		return nil, errConflict("user:%s already exists", param.Name)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(param.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Errorf("hash password error:%s", err)
+		return nil, errInternal(err)
+	}
+
+	u := &model.User{Name: param.Name, Password: string(hash), Admin: param.Admin}
+	if err := model.InsertUser(u); err != nil {
+		log.Errorf("insert sql error:%s", err)
+		return nil, errInternal(err)
+	}
+
+	audit(r, "user.add", "user", u.Id, 0, nil, u)
+	return u, nil
+}
+
+// userBrief 工程维护者添加成员时只需要用户 id 和名称
+type userBrief struct {
+	Id   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// listUsers admin 查看所有用户信息,工程维护者只返回 id 和名称用于添加工程成员
+func listUsers(r *http.Request) (interface{}, error) {
+	if !isAdmin(r) {
+		ok, err := model.IsProjectMaintainer(currentUser(r).Id)
+		if err != nil {
+			log.Errorf("select sql error:%s", err)
+			return nil, errInternal(err)
+		}
+		if !ok {
+			return nil, requireAdmin(r)
+		}
+	}
+
+	us, err := model.ListUser()
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return nil, errInternal(err)
+	}
+	if isAdmin(r) {
+		return us, nil
+	}
+
+	bs := make([]*userBrief, 0, len(us))
+	for _, u := range us {
+		bs = append(bs, &userBrief{Id: u.Id, Name: u.Name})
+	}
+	return bs, nil
+}
+
+func deleteUser(r *http.Request, id int64) error {
+	if err := requireAdmin(r); err != nil {
+		return err
+	}
+
+	if id == currentUser(r).Id {
+		return errConflict("couldn't delete yourself")
+	}
+
+	old, err := model.GetUser(id)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return errQuery(err)
+	}
+
+	if err := model.DelUser(id); err != nil {
+		log.Errorf("delete sql error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "user.delete", "user", old.Id, 0, old, nil)
+	return nil
+}
+
+type passwordParam struct {
+	OldPassword string `json:"old_password"`
+	Password    string `json:"password"`
+}
+
+func changePassword(r *http.Request, param *passwordParam) error {
+	u := currentUser(r)
+	if err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(param.OldPassword)); err != nil {
+		return errInvalid("old_password", "wrong old password")
+	}
+
+	if len(param.Password) < minPasswordLen {
+		return errInvalid("password", "password must be at least %d characters", minPasswordLen)
+	}
+
+	if err := ResetPassword(u.Name, param.Password); err != nil {
+		log.Errorf("reset password error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "user.password", "user", u.Id, 0, nil, nil)
+	return nil
+}
+
+func AddUser(wr http.ResponseWriter, r *http.Request) {
+	param := &userParam{}
+	if err := ParseParam(r, param); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	u, err := createUser(r, param)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, u)
+}
+
+func ListUser(wr http.ResponseWriter, r *http.Request) {
+	us, err := listUsers(r)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, us)
+}
+
+func DelUser(wr http.ResponseWriter, r *http.Request) {
+	u := &model.User{}
+	if err := ParseParam(r, u); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := deleteUser(r, u.Id); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "删除成功")
+}
+
+func ChangePassword(wr http.ResponseWriter, r *http.Request) {
+	param := &passwordParam{}
+	if err := ParseParam(r, param); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := changePassword(r, param); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "password changed")
+}
+
+// newApiToken 生成 token 并保存 hash,expire 为 0 时不过期
+func newApiToken(userId int64, name string, session bool, expire time.Duration) (string, error) {
+	token, err := util.RandomToken(20)
+	if err != nil {
+		return "", err
+	}
+
+	t := &model.ApiToken{
+		UserId:  userId,
+		Name:    name,
+		Hash:    util.HashToken(token),
+		Session: session,
+	}
+	if expire > 0 {
+		t.ExpireAt = time.Now().Add(expire)
+	}
+
+	return token, model.InsertApiToken(t)
+}
+
+type tokenParam struct {
+	Name       string `json:"name"`
+	ExpireDays int    `json:"expire_days"` // 0 不过期
+}
+
+type tokenResult struct {
+	Name  string `json:"name"`
+	Token string `json:"token"` // 只在创建时返回
+}
+
+// createToken 创建个人 api token,token 只在创建时返回一次
+func createToken(r *http.Request, param *tokenParam) (string, error) {
+	if len(param.Name) == 0 {
+		return "", errInvalid("name", "token name not set")
+	}
+	if param.ExpireDays < 0 {
+		return "", errInvalid("expire_days", "must not be negative")
+	}
+
+	token, err := newApiToken(currentUser(r).Id, param.Name, false, time.Duration(param.ExpireDays)*24*time.Hour)
+	if err != nil {
+		log.Errorf("create token error:%s", err)
+		return "", errInternal(err)
+	}
+
+	audit(r, "token.add", "token", 0, 0, nil, param)
+	return token, nil
+}
+
+func listTokens(r *http.Request) ([]*model.ApiToken, error) {
+	ts, err := model.ListApiToken(currentUser(r).Id)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return nil, errInternal(err)
+	}
+	return ts, nil
+}
+
+func deleteToken(r *http.Request, id int64) error {
+	if err := model.DelApiToken(id, currentUser(r).Id); err != nil {
+		log.Errorf("delete sql error:%s", err)
+		return errNotFound("%s", err)
+	}
+
+	audit(r, "token.delete", "token", id, 0, nil, nil)
+	return nil
+}
+
+func AddToken(wr http.ResponseWriter, r *http.Request) {
+	param := &tokenParam{}
+	if err := ParseParam(r, param); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	token, err := createToken(r, param)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, &tokenResult{Name: param.Name, Token: token})
+}
+
+func ListToken(wr http.ResponseWriter, r *http.Request) {
+	ts, err := listTokens(r)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, ts)
+}
+
+func DelToken(wr http.ResponseWriter, r *http.Request) {
+	t := &model.ApiToken{}
+	if err := ParseParam(r, t); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := deleteToken(r, t.Id); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "删除成功")
+}
+
+// signOutput 生成有过期时间的下载链接,供脚本不登录下载编译结果,expire 为秒,默认 1 小时
+func signOutput(r *http.Request, path string, expire int) (string, error) {
+	path = strings.TrimPrefix(path, "/")
+	if len(path) == 0 || strings.Contains(path, "..") {
+		return "", errInvalid("path", "path not allowed")
+	}
+
+	d := time.Hour
+	if expire < 0 {
+		return "", errInvalid("expire", "must be positive seconds")
+	} else if expire > 0 {
+		d = time.Duration(expire) * time.Second
+	}
+	if d > maxSignExpire {
+		d = maxSignExpire
+	}
+
+	if err := checkOutputPath(r, path); err != nil {
+		return "", err
+	}
+
+	url, err := signOutputUrl("/output/"+path, time.Now().Add(d))
+	if err != nil {
+		log.Errorf("sign output error:%s", err)
+		return "", errConflict("%s", err)
+	}
+	return url, nil
+}
+
+func SignOutput(wr http.ResponseWriter, r *http.Request) {
+	expire := 0
+	if v := r.FormValue("expire"); len(v) > 0 {
+		var err error
+		if expire, err = strconv.Atoi(v); err != nil || expire <= 0 {
+			writeV1Error(wr, errInvalid("expire", "must be positive seconds"))
+			return
+		}
+	}
+
+	url, err := signOutput(r, r.FormValue("path"), expire)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, url)
+}
+
+func signOutputUrl(path string, expire time.Time) (string, error) {
+	if len(config.C.SecretKey) == 0 {
+		return "", errors.New("secret_key not set, signed url disabled")
+	}
+
+	expires := strconv.FormatInt(expire.Unix(), 10)
+	sign := util.Sign(config.C.SecretKey, path+"\n"+expires)
+	return fmt.Sprintf("%s%s?expires=%s&sign=%s", serverUrl(), path, expires, sign), nil
+}
+
+func checkSignedUrl(r *http.Request) error {
+	if len(config.C.SecretKey) == 0 {
+		return errors.New("signed url disabled")
+	}
+
+	expires := r.URL.Query().Get("expires")
+	if !util.CheckSign(config.C.SecretKey, r.URL.Path+"\n"+expires, r.URL.Query().Get("sign")) {
+		return errors.New("invalid sign")
+	}
+
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > t {
+		return errors.New("url expired")
+	}
+	return nil
+}
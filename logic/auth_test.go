@@ -0,0 +1,57 @@
+package logic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hash-rabbit/auto-build/config"
+)
+
+func TestAuth(t *testing.T) {
+	config.C = &config.Config{SecretKey: "test key", ExternalUrl: "http://auto-build.test"}
+	defer func() { config.C = nil }()
+
+	h := Auth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	url, err := signOutputUrl("/output/demo/master/demo", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := signOutputUrl("/output/demo/master/demo", time.Now().Add(-time.Minute))
+	logUrl := taskLogLink(1)
+	if logUrl != "http://auto-build.test/logs/1" {
+		t.Errorf("log link:%s", logUrl)
+	}
+	signedLog, _ := signOutputUrl("/logs/1", time.Now().Add(time.Minute))
+
+	cases := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{http.MethodGet, "/api/task/list", http.StatusUnauthorized},
+		{http.MethodOptions, "/api/task/add", http.StatusOK},
+		{http.MethodPost, "/webhook/demo", http.StatusOK},
+		{http.MethodGet, "/output/demo/master/demo", http.StatusUnauthorized},
+		{http.MethodGet, url, http.StatusOK},
+		{http.MethodGet, expired, http.StatusUnauthorized},
+		{http.MethodGet, strings.Replace(url, "sign=", "sign=00", 1), http.StatusUnauthorized},
+		{http.MethodGet, "/output/demo/master/other" + url[len("http://auto-build.test/output/demo/master/demo"):], http.StatusUnauthorized},
+		{http.MethodGet, "/logs/1", http.StatusUnauthorized},
+		{http.MethodGet, logUrl, http.StatusUnauthorized},
+		{http.MethodGet, signedLog, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(c.method, c.url, nil))
+		if w.Code != c.status {
+			t.Errorf("%s %s status:%d, want:%d", c.method, c.url, w.Code, c.status)
+		}
+	}
+}
@@ -2,25 +2,28 @@ package logic
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
+	"github.com/hash-rabbit/auto-build/config"
+	"github.com/hash-rabbit/auto-build/util"
 	"github.com/subchen/go-log"
 )
 
-func checkParam(r *http.Request) (map[string]interface{}, error) {
-	data, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Errorf("read body error:%s", err)
-		return nil, err
+// serverUrl 对外访问地址,未配置 external_url 时使用本机 ip
+func serverUrl() string {
+	if len(config.C.ExternalUrl) > 0 {
+		return strings.TrimSuffix(config.C.ExternalUrl, "/")
 	}
-	param := make(map[string]interface{})
-	err = json.Unmarshal(data, &param)
+
+	ip, err := util.GetLocalIp()
 	if err != nil {
-		log.Errorf("json unmarshal error:%s", err)
-		return nil, err
+		log.Errorf("get local ip error:%s", err)
+		ip = "127.0.0.1"
 	}
-	return param, nil
+	return fmt.Sprintf("http://%s:%d", ip, config.C.Port)
 }
 
 func ParseParam(r *http.Request, v interface{}) error {
@@ -50,11 +53,15 @@ func write500(w http.ResponseWriter, err error) {
 }
 
 func writeResponseInfo(w http.ResponseWriter, code, msg string, data interface{}) {
+	writeResponse(w, http.StatusOK, code, msg, data)
+}
+
+func writeResponse(w http.ResponseWriter, status int, code, msg string, data interface{}) {
 	w.Header().Set("Content-type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, DELETE, PATCH, PUT")
 	w.Header().Set("Access-Control-Max-Age", "3600")
-	w.Header().Set("Access-Control-Allow-Headers", "x-requested-with,content-type")
+	w.Header().Set("Access-Control-Allow-Headers", "x-requested-with,content-type,authorization")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	res := &ResponseInfo{code, msg, data}
 	bytes, err := json.Marshal(res)
@@ -63,6 +70,9 @@ func writeResponseInfo(w http.ResponseWriter, code, msg string, data interface{}
 		return
 	}
 	log.Debug(string(bytes))
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
 	_, err = w.Write(bytes)
 	if err != nil {
 		write500(w, err)
@@ -81,3 +91,8 @@ func writeJson(w http.ResponseWriter, obj interface{}) {
 func writeError(w http.ResponseWriter, code, msg string) {
 	writeResponseInfo(w, code, msg, nil)
 }
+
+// writeStatusError 返回非 200 的状态码,用于认证失败等需要脚本识别的错误
+func writeStatusError(w http.ResponseWriter, status int, code, msg string) {
+	writeResponse(w, status, code, msg, nil)
+}
@@ -4,14 +4,73 @@ import (
 	"net/http"
 
 	"github.com/hash-rabbit/auto-build/env"
+	"github.com/hash-rabbit/auto-build/model"
 	"github.com/subchen/go-log"
 )
 
-func ListEnv(wr http.ResponseWriter, r *http.Request) {
+func listEnvs() ([]string, error) {
 	envs, err := env.ListEnv()
 	if err != nil {
 		log.Errorf("list env error:%s", err)
-		writeError(wr, "", "")
+		return nil, errInternal(err)
+	}
+	return envs, nil
+}
+
+// installEnv 在后台下载安装 go 版本
+func installEnv(r *http.Request, version string) error {
+	if err := requireAdmin(r); err != nil {
+		return err
+	}
+
+	if err := env.CheckVersion(version); err != nil {
+		return errInvalid("version", err.Error())
+	}
+
+	if err := env.InstallAsync(version); err != nil {
+		log.Errorf("install version:%s error:%s", version, err)
+		return errConflict("%s", err)
+	}
+
+	audit(r, "goenv.install", "goenv", 0, 0, nil, map[string]interface{}{"version": version})
+	return nil
+}
+
+// deleteEnv 还有工程使用的版本不能删除
+func deleteEnv(r *http.Request, version string) error {
+	if err := requireAdmin(r); err != nil {
+		return err
+	}
+
+	if err := env.CheckVersion(version); err != nil {
+		return errInvalid("version", err.Error())
+	}
+
+	ps, err := model.ListProject("")
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return errInternal(err)
+	}
+	for _, p := range ps {
+		if p.GoVersion == version {
+			return errConflict("version:%s used by project:%s", version, p.Name)
+		}
+	}
+
+	if err := env.Remove(version); err != nil {
+		log.Errorf("remove version:%s error:%s", version, err)
+		return errConflict("%s", err)
+	}
+
+	audit(r, "goenv.delete", "goenv", 0, 0, map[string]interface{}{"version": version}, nil)
+	return nil
+}
+
+func ListEnv(wr http.ResponseWriter, r *http.Request) {
+	envs, err := listEnvs()
+	if err != nil {
+		// 原来的接口 code 为空
+		writeError(wr, "", err.Error())
 		return
 	}
 
@@ -0,0 +1,198 @@
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/subchen/go-log"
+)
+
+// v2 接口的错误码
+const (
+	CodeInvalidParam = "invalid_param" // 参数格式错误或校验失败,Field 为参数名
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden    = "forbidden"
+	CodeNotFound     = "not_found"
+	CodeConflict     = "conflict" // 名称重复,存在依赖等
+	CodeGitError     = "git_error"
+	CodeInternal     = "internal_error"
+	CodeUnavailable  = "unavailable" // 服务正在关闭
+)
+
+var codeStatus = map[string]int{
+	CodeInvalidParam: http.StatusBadRequest,
+	CodeUnauthorized: http.StatusUnauthorized,
+	CodeForbidden:    http.StatusForbidden,
+	CodeNotFound:     http.StatusNotFound,
+	CodeConflict:     http.StatusConflict,
+	CodeGitError:     http.StatusBadGateway,
+	CodeInternal:     http.StatusInternalServerError,
+	CodeUnavailable:  http.StatusServiceUnavailable,
+}
+
+// v1 接口返回的 code
+var legacyCode = map[string]string{
+	CodeInvalidParam: "params error",
+	CodeUnauthorized: "auth error",
+	CodeForbidden:    "auth error",
+	CodeNotFound:     "sql error",
+	CodeConflict:     "logic error",
+	CodeGitError:     "git error",
+	CodeInternal:     "logic error",
+	CodeUnavailable:  "logic error",
+}
+
+// ApiError 接口错误,v2 返回对应的状态码,v1 转换为原来的 code
+type ApiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+	Legacy  string `json:"-"` // v1 接口的 code,为空时使用 legacyCode
+}
+
+func (e *ApiError) Error() string {
+	if len(e.Field) > 0 {
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return e.Message
+}
+
+func (e *ApiError) Status() int {
+	if s, ok := codeStatus[e.Code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+func errInvalid(field, format string, a ...interface{}) error {
+	return &ApiError{Code: CodeInvalidParam, Field: field, Message: fmt.Sprintf(format, a...)}
+}
+
+func errNotFound(format string, a ...interface{}) error {
+	return &ApiError{Code: CodeNotFound, Message: fmt.Sprintf(format, a...)}
+}
+
+func errConflict(format string, a ...interface{}) error {
+	return &ApiError{Code: CodeConflict, Message: fmt.Sprintf(format, a...)}
+}
+
+func errForbidden(msg string) error {
+	return &ApiError{Code: CodeForbidden, Message: msg}
+}
+
+func errUnauthorized(msg string) error {
+	return &ApiError{Code: CodeUnauthorized, Message: msg}
+}
+
+func errUnavailable(msg string) error {
+	return &ApiError{Code: CodeUnavailable, Message: msg}
+}
+
+func errGit(err error) error {
+	return &ApiError{Code: CodeGitError, Message: err.Error()}
+}
+
+// errInternal 数据库等内部错误
+func errInternal(err error) error {
+	return toApiError(err)
+}
+
+// errQuery 查询错误,记录不存在时为 not_found
+func errQuery(err error) error {
+	if errors.Is(err, model.ErrNotFound) {
+		return &ApiError{Code: CodeNotFound, Message: err.Error()}
+	}
+	return errInternal(err)
+}
+
+// legacy 设置 v1 接口返回的 code,和原来的接口保持一致;
+// 已经设置过的,认证错误和关闭服务的错误不修改
+func legacy(err error, code string) error {
+	e := toApiError(err)
+	if len(e.Legacy) > 0 {
+		return e
+	}
+	switch e.Code {
+	case CodeUnauthorized, CodeForbidden, CodeUnavailable:
+		return e
+	}
+	c := *e
+	c.Legacy = code
+	return &c
+}
+
+// toApiError 没有分类的错误作为内部错误
+func toApiError(err error) *ApiError {
+	var e *ApiError
+	if errors.As(err, &e) {
+		return e
+	}
+	return &ApiError{Code: CodeInternal, Message: err.Error()}
+}
+
+// decodeBody 解析 json body,类型错误时返回字段名
+func decodeBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err == nil || err == io.EOF {
+		return nil
+	}
+
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return errInvalid(te.Field, "must be %s", te.Type.String())
+	}
+	return errInvalid("body", "invalid json:%s", err)
+}
+
+// writeV1Error v1 接口的错误,除认证错误外状态码都是 200
+func writeV1Error(w http.ResponseWriter, err error) {
+	e := toApiError(err)
+	code := e.Legacy
+	if len(code) == 0 {
+		code = legacyCode[e.Code]
+	}
+	switch e.Code {
+	case CodeUnauthorized, CodeForbidden:
+		writeStatusError(w, e.Status(), code, e.Error())
+	default:
+		writeError(w, code, e.Error())
+	}
+}
+
+type errorBody struct {
+	Error *ApiError `json:"error"`
+}
+
+func writeV2(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "x-requested-with,content-type,authorization")
+	if v == nil {
+		w.WriteHeader(status)
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		write500(w, err)
+		return
+	}
+	w.Header().Set("Content-type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(data); err != nil {
+		log.Errorf("write response error:%s", err)
+	}
+}
+
+// writeV2Error 内部错误只记录日志,不把 sql 和文件系统的错误返回给调用方
+func writeV2Error(w http.ResponseWriter, err error) {
+	e := toApiError(err)
+	if e.Code == CodeInternal {
+		log.Errorf("internal error:%s", e.Message)
+		e = &ApiError{Code: CodeInternal, Message: "internal error"}
+	}
+	writeV2(w, e.Status(), &errorBody{Error: e})
+}
@@ -0,0 +1,167 @@
+package logic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hash-rabbit/auto-build/config"
+	"github.com/hash-rabbit/auto-build/model"
+)
+
+func TestDecodeBody(t *testing.T) {
+	param := &pollParam{}
+	r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(`{"poll_interval":"10"}`))
+	err := decodeBody(r, param)
+	if e := toApiError(err); e.Code != CodeInvalidParam || e.Field != "poll_interval" {
+		t.Errorf("decode error:%+v", e)
+	}
+
+	r = httptest.NewRequest(http.MethodPut, "/", strings.NewReader(""))
+	if err := decodeBody(r, param); err != nil {
+		t.Errorf("empty body error:%s", err)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeV2Error(w, errInvalid("name", "required"))
+	body := &errorBody{}
+	json.Unmarshal(w.Body.Bytes(), body)
+	if w.Code != http.StatusBadRequest || body.Error == nil || body.Error.Field != "name" {
+		t.Errorf("v2 error status:%d body:%s", w.Code, w.Body.String())
+	}
+
+	// v1 除认证错误外状态码为 200,code 保持原来的值
+	w = httptest.NewRecorder()
+	writeV1Error(w, errConflict("name:a 已存在"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "logic error") {
+		t.Errorf("v1 error status:%d body:%s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	writeV1Error(w, errForbidden("permission denied"))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("v1 forbidden status:%d", w.Code)
+	}
+
+	// v2 不返回内部错误的详情,v1 和原来一样返回
+	internal := errInternal(errors.New("open /data/record/demo.log: permission denied"))
+	w = httptest.NewRecorder()
+	writeV2Error(w, internal)
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), "/data/record") ||
+		!strings.Contains(w.Body.String(), "internal error") {
+		t.Errorf("v2 internal error status:%d body:%s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	writeV1Error(w, internal)
+	if !strings.Contains(w.Body.String(), "/data/record") {
+		t.Errorf("v1 internal error body:%s", w.Body.String())
+	}
+}
+
+// initTestDB 使用临时目录中的数据库和配置
+func initTestDB(t *testing.T) string {
+	dir := t.TempDir()
+	config.C = &config.Config{
+		BarePath:      filepath.Join(dir, "bare"),
+		DefaultGoPath: filepath.Join(dir, "gopath"),
+		RecordPath:    filepath.Join(dir, "record"),
+		SecretKey:     "test key",
+		ExternalUrl:   "http://auto-build.test",
+	}
+	t.Cleanup(func() { config.C = nil })
+
+	if err := model.InitSqlLite(filepath.Join(dir, "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(model.Close)
+	if err := model.AuthMergeTable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.InitNode(); err != nil {
+		t.Fatal(err)
+	}
+	model.SetSecretKey(config.C.SecretKey)
+	t.Cleanup(func() { model.SetSecretKey("") })
+	return dir
+}
+
+func withUser(r *http.Request, u *model.User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey, u))
+}
+
+// TestV1ErrorCode v1 接口的错误 code 和原来的接口保持一致
+func TestV1ErrorCode(t *testing.T) {
+	dir := initTestDB(t)
+
+	p := &model.Project{Name: "legacy", LocalPath: filepath.Join(dir, "legacy")}
+	if err := model.InsertProject(p); err != nil {
+		t.Fatal(err)
+	}
+	tk := &model.Task{ProjectId: p.Id, Branch: "master", MainFile: "main.go", DestFile: "demo"}
+	if err := model.InsertTask(tk); err != nil {
+		t.Fatal(err)
+	}
+	tl := &model.TaskLog{TaskId: tk.Id, Status: model.Success, OutFilePath: filepath.Join(dir, "missing.log")}
+	if err := model.InsertTaskLog(tl); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, nil, 0644)
+
+	admin := &model.User{Id: 1, Name: "admin", Admin: true}
+	viewer := &model.User{Id: 2, Name: "viewer"}
+	cases := []struct {
+		handler http.HandlerFunc
+		method  string
+		url     string
+		body    string
+		user    *model.User
+		code    string
+	}{
+		{AddPorject, http.MethodPost, "/api/project/add", `{`, admin, "param error"},
+		{AddPorject, http.MethodPost, "/api/project/add", `{"name":""}`, admin, "param error"},
+		{AddPorject, http.MethodPost, "/api/project/add", `{"name":"legacy"}`, admin, "param error"},
+		{AddPorject, http.MethodPost, "/api/project/add", `{"name":"demo","url":"https://example.com/demo.git"}`, admin, "git error"},
+		{AddPorject, http.MethodPost, "/api/project/add", `{"name":"demo","url":"https://example.com/demo.git","workspace":"` + dir + `","path":"` + file + `"}`, admin, "path error"},
+		{AddPorject, http.MethodPost, "/api/project/add", `{"name":"demo","url":"https://example.com/demo.git","workspace":"` + dir + `","path":"` + dir + `"}`, admin, "path error"},
+		{DelPorject, http.MethodDelete, "/api/project/delete", `{"id":999}`, admin, "sql error"},
+		{DelPorject, http.MethodDelete, "/api/project/delete", `{"id":` + itoa(p.Id) + `}`, admin, "logic error"},
+		{DelPorject, http.MethodDelete, "/api/project/delete", `{"id":` + itoa(p.Id) + `}`, viewer, "auth error"},
+		{ListBranch, http.MethodGet, "/api/project/branch/list?id=abc", "", admin, "param error"},
+		{ListBranch, http.MethodGet, "/api/project/branch/list?id=999", "", admin, "sql error"},
+		{AddTask, http.MethodPost, "/api/task/add", `{"project_id":` + itoa(p.Id) + `}`, admin, "check error"},
+		{AddTask, http.MethodPost, "/api/task/add", `{"project_id":999,"branch":"master","main_file":"main.go","dest_file":"demo"}`, admin, "sql error"},
+		{StartTask, http.MethodPost, "/api/task/start", ``, admin, "sql error"},
+		{StartTask, http.MethodPost, "/api/task/start", `{"task_id":"1"}`, admin, "sql error"},
+		{StartTask, http.MethodPost, "/api/task/start", `{"task_id":999}`, admin, "sql error"},
+		{SetTaskAutoBuild, http.MethodPost, "/api/task/auto-build", `{"id":999}`, admin, "sql error"},
+		{DelTask, http.MethodDelete, "/api/task/delete", `{"id":999}`, admin, "sql error"},
+		{GetTaskLogOutput, http.MethodGet, "/api/task/log/output?task_log_id=abc", "", admin, "check param error"},
+		{GetTaskLogOutput, http.MethodGet, "/api/task/log/output?task_log_id=999", "", admin, "sql error"},
+		{GetTaskLogOutput, http.MethodGet, "/api/task/log/output?task_log_id=" + itoa(tl.Id), "", admin, "logic error"},
+		{ListTaskLog, http.MethodGet, "/api/task/log/list?project_id=abc&page_num=x", "", admin, "success"},
+		{ListTask, http.MethodGet, "/api/task/list?project_id=abc", "", admin, "success"},
+	}
+
+	for i, c := range cases {
+		w := httptest.NewRecorder()
+		c.handler(w, withUser(httptest.NewRequest(c.method, c.url, strings.NewReader(c.body)), c.user))
+		resp := &ResponseInfo{}
+		if err := json.Unmarshal(w.Body.Bytes(), resp); err != nil || resp.Code != c.code {
+			t.Errorf("case %d %s %s code:%s, want:%s, body:%s", i, c.method, c.url, resp.Code, c.code, w.Body.String())
+		}
+	}
+}
+
+func itoa(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
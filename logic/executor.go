@@ -0,0 +1,250 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/hash-rabbit/auto-build/config"
+	goenv "github.com/hash-rabbit/auto-build/env"
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/subchen/go-log"
+)
+
+// executor 执行编译过程中的 go build 和编译前后命令
+type executor interface {
+	// command 返回在 dir 中执行的命令,name 和参数中的路径需要先经过 path 转换
+	command(ctx context.Context, dir string, env []string, name string, args ...string) *exec.Cmd
+	// path 主机上的路径在执行环境中的路径
+	path(p string) string
+	// stop 取消编译后结束仍在运行的命令
+	stop()
+	// clean 编译结束后删除临时目录
+	clean()
+}
+
+// hostExecutor 直接在主机上执行
+type hostExecutor struct{}
+
+func (hostExecutor) command(ctx context.Context, dir string, env []string, name string, args ...string) *exec.Cmd {
+	c := exec.CommandContext(ctx, name, args...)
+	c.Dir = dir
+	c.Env = append(os.Environ(), env...)
+	return c
+}
+
+func (hostExecutor) path(p string) string {
+	return p
+}
+
+func (hostExecutor) stop() {}
+
+func (hostExecutor) clean() {}
+
+var imageReg = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/:@-]{0,254}$`)
+
+// 容器中的目录
+const (
+	containerSrc    = "/src"
+	containerGoPath = "/go"
+	containerOut    = "/out"
+	containerGoRoot = "/usr/local/go"
+	containerCache  = "/cache" // 本次编译的 GOCACHE 和新下载的模块
+)
+
+type mount struct {
+	host      string
+	container string
+	readOnly  bool
+}
+
+// containerExecutor 每个命令在一个新的容器中执行,只挂载代码,输出目录,go 环境,
+// 只读的共用模块缓存和本次编译的缓存目录,容器不能修改其他编译使用的文件
+type containerExecutor struct {
+	runtime string
+	image   string
+	prefix  string // 容器名称前缀
+	mounts  []mount
+	cache   string // 主机上本次编译的缓存目录
+
+	mu    sync.Mutex
+	names []string
+}
+
+// newExecutor 任务设置了镜像时在容器中编译,否则在主机上编译
+func (t *task) newExecutor() executor {
+	if len(t.t.Image) == 0 {
+		return hostExecutor{}
+	}
+
+	runtime := config.C.Container
+	if len(runtime) == 0 {
+		runtime = "docker"
+	}
+
+	prefix := fmt.Sprintf("auto-build-%d", t.id)
+	cache := filepath.Join(os.TempDir(), prefix)
+	os.RemoveAll(cache)
+	os.MkdirAll(filepath.Join(cache, "build"), os.ModePerm)
+	os.MkdirAll(filepath.Join(cache, "mod"), os.ModePerm)
+	modCache := filepath.Join(t.p.WorkSpace, "pkg", "mod")
+	os.MkdirAll(filepath.Join(modCache, "cache", "download"), os.ModePerm)
+
+	mounts := []mount{
+		{host: goenv.GetGoPath(t.goversion), container: containerGoRoot, readOnly: true},
+		{host: modCache, container: containerGoPath + "/pkg/mod", readOnly: true},
+		{host: cache, container: containerCache},
+		{host: filepath.Dir(t.destfile), container: containerOut},
+	}
+	// 不使用 go mod 的工程只挂载代码在 GOPATH 中的目录,依赖需要在 vendor 中
+	src := containerSrc
+	if rel, err := filepath.Rel(t.p.WorkSpace, t.p.LocalPath); err == nil && !strings.HasPrefix(rel, "..") {
+		src = path.Join(containerGoPath, filepath.ToSlash(rel))
+	}
+	mounts = append(mounts, mount{host: t.p.LocalPath, container: src})
+
+	return &containerExecutor{
+		runtime: runtime,
+		image:   t.t.Image,
+		prefix:  prefix,
+		mounts:  mounts,
+		cache:   cache,
+	}
+}
+
+// goEnv 容器中的 GOPATH 和缓存,共用的模块缓存只读,作为 GOPROXY 的第一个来源,
+// 没有的模块下载到本次编译的缓存目录
+func (e *containerExecutor) goEnv(proxy string) []string {
+	return []string{
+		"GOPATH=" + containerGoPath,
+		"GOCACHE=" + containerCache + "/build",
+		"GOMODCACHE=" + containerCache + "/mod",
+		"GOFLAGS=-modcacherw",
+		"GOPROXY=file://" + containerGoPath + "/pkg/mod/cache/download," + proxy,
+	}
+}
+
+func (e *containerExecutor) command(ctx context.Context, dir string, env []string, name string, args ...string) *exec.Cmd {
+	e.mu.Lock()
+	cname := fmt.Sprintf("%s-%d", e.prefix, len(e.names))
+	e.names = append(e.names, cname)
+	e.mu.Unlock()
+
+	run := []string{"run", "--rm", "--name", cname, "-w", e.path(dir)}
+	if uid := os.Getuid(); uid >= 0 {
+		// 容器中生成的文件属于服务端的用户,编译结束后可以清理
+		run = append(run, "--user", fmt.Sprintf("%d:%d", uid, os.Getgid()))
+	}
+	for _, m := range e.mounts {
+		v := m.host + ":" + m.container
+		if m.readOnly {
+			v += ":ro"
+		}
+		run = append(run, "-v", v)
+	}
+
+	// 只传变量名,值从 docker 命令的环境变量中读取,secret 不会出现在命令参数中
+	run = append(run, "-e", "PATH="+containerGoRoot+"/bin:"+containerGoPath+"/bin:/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
+	run = append(run, "-e", "HOME=/tmp")
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 {
+			run = append(run, "-e", kv[:i])
+		}
+	}
+
+	run = append(run, e.image, name)
+	run = append(run, args...)
+
+	c := exec.CommandContext(ctx, e.runtime, run...)
+	c.Env = append(os.Environ(), env...)
+	return c
+}
+
+// path 使用最长的挂载目录转换
+func (e *containerExecutor) path(p string) string {
+	best := -1
+	for i, m := range e.mounts {
+		if p != m.host && !strings.HasPrefix(p, m.host+"/") {
+			continue
+		}
+		if best < 0 || len(m.host) > len(e.mounts[best].host) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return p
+	}
+	m := e.mounts[best]
+	return m.container + strings.TrimPrefix(p, m.host)
+}
+
+// clean 删除本次编译的缓存目录,模块缓存中的目录可能是只读的
+func (e *containerExecutor) clean() {
+	filepath.WalkDir(e.cache, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(p, 0755)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(e.cache); err != nil {
+		log.Warnf("remove build cache %s error:%s", e.cache, err)
+	}
+}
+
+// stop 取消时只结束了 docker 命令,需要删除容器
+func (e *containerExecutor) stop() {
+	e.mu.Lock()
+	names := e.names
+	e.mu.Unlock()
+	if len(names) == 0 {
+		return
+	}
+
+	out, err := exec.Command(e.runtime, append([]string{"rm", "-f"}, names...)...).CombinedOutput()
+	if err != nil {
+		log.Debugf("remove container %s error:%s %s", strings.Join(names, ","), err, out)
+	}
+}
+
+func setTaskImage(r *http.Request, id int64, image string) error {
+	old, err := requireTaskRole(r, id, model.RoleMaintainer)
+	if err != nil {
+		return err
+	}
+
+	if len(image) > 0 && !imageReg.MatchString(image) {
+		return errInvalid("image", "image name not allowed")
+	}
+
+	if err := model.UpdateTaskImage(id, image); err != nil {
+		log.Errorf("update sql error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "task.image", "task", old.Id, old.ProjectId,
+		map[string]interface{}{"image": old.Image}, map[string]interface{}{"image": image})
+	return nil
+}
+
+func SetTaskImage(wr http.ResponseWriter, r *http.Request) {
+	t := &model.Task{}
+	if err := ParseParam(r, t); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := setTaskImage(r, t.Id, t.Image); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "更新成功")
+}
@@ -0,0 +1,102 @@
+package logic
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hash-rabbit/auto-build/config"
+	"github.com/hash-rabbit/auto-build/model"
+)
+
+func TestContainerExecutor(t *testing.T) {
+	d := t.TempDir()
+	config.C = &config.Config{GoEnvPath: d + "/goenv", DestPath: d + "/output", Container: "podman"}
+	defer func() { config.C = nil }()
+
+	tk := &task{
+		id:        7,
+		goversion: "go1.20.6",
+		p:         &model.Project{Name: "demo", GoMod: true, LocalPath: d + "/src/demo", WorkSpace: d + "/workspace"},
+		t:         &model.Task{Branch: "master", DestFile: "demo", Image: "debian:bookworm"},
+	}
+	tk.destfile = tk.destPath()
+
+	e, ok := tk.newExecutor().(*containerExecutor)
+	if !ok {
+		t.Fatal("task with image should use container executor")
+	}
+	defer e.clean()
+
+	paths := map[string]string{
+		d + "/src/demo/cmd/main.go":    "/src/cmd/main.go",
+		d + "/workspace/pkg/mod/a@v1":  "/go/pkg/mod/a@v1",
+		d + "/workspace/.cache":        d + "/workspace/.cache",
+		d + "/workspace/src/other":     d + "/workspace/src/other",
+		d + "/output/demo/master/demo": "/out/demo",
+		d + "/goenv/go1.20.6/bin/go":   "/usr/local/go/bin/go",
+		d + "/src/demo-other/main.go":  d + "/src/demo-other/main.go",
+	}
+	for host, want := range paths {
+		if got := e.path(host); got != want {
+			t.Errorf("path %s:%s, want %s", host, got, want)
+		}
+	}
+
+	c := e.command(context.Background(), d+"/src/demo", []string{"GOOS=linux", "TOKEN=secret-value"}, "/usr/local/go/bin/go", "build")
+	args := strings.Join(c.Args, " ")
+	if c.Args[0] != "podman" || !strings.Contains(args, "-w /src") {
+		t.Errorf("args:%s", args)
+	}
+	if strings.Contains(args, "secret-value") || !strings.Contains(args, "-e TOKEN") {
+		t.Errorf("secret should be passed by name:%s", args)
+	}
+	if !strings.HasSuffix(args, "debian:bookworm /usr/local/go/bin/go build") {
+		t.Errorf("args:%s", args)
+	}
+
+	// 只挂载 go 环境,只读的模块缓存,本次编译的缓存,输出目录和代码,不挂载共用的 GOPATH
+	wantVolumes := []string{
+		d + "/goenv/go1.20.6:/usr/local/go:ro",
+		d + "/workspace/pkg/mod:/go/pkg/mod:ro",
+		filepath.Join(os.TempDir(), "auto-build-7") + ":/cache",
+		d + "/output/demo/master:/out",
+		d + "/src/demo:/src",
+	}
+	if got := volumes(c.Args); !reflect.DeepEqual(got, wantVolumes) {
+		t.Errorf("volumes:%v, want:%v", got, wantVolumes)
+	}
+
+	// 不使用 go mod 的工程只挂载代码在 GOPATH 中的目录
+	tk.p.GoMod = false
+	tk.p.LocalPath = d + "/workspace/src/example.com/demo"
+	e2 := tk.newExecutor().(*containerExecutor)
+	defer e2.clean()
+	c = e2.command(context.Background(), tk.p.LocalPath, nil, "/usr/local/go/bin/go", "build")
+	wantVolumes[4] = d + "/workspace/src/example.com/demo:/go/src/example.com/demo"
+	if got := volumes(c.Args); !reflect.DeepEqual(got, wantVolumes) {
+		t.Errorf("gopath volumes:%v, want:%v", got, wantVolumes)
+	}
+	if !strings.Contains(strings.Join(c.Args, " "), "-w /go/src/example.com/demo") {
+		t.Errorf("args:%v", c.Args)
+	}
+
+	// 没有设置镜像时在主机上执行
+	tk.t.Image = ""
+	if _, ok := tk.newExecutor().(hostExecutor); !ok {
+		t.Error("task without image should use host executor")
+	}
+}
+
+func volumes(args []string) []string {
+	vs := make([]string, 0)
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-v" {
+			vs = append(vs, args[i+1])
+		}
+	}
+	return vs
+}
@@ -17,6 +17,16 @@ type CommonInfo struct {
 }
 
 func HomeInfo(w http.ResponseWriter, r *http.Request) {
+	info, err := homeInfo()
+	if err != nil {
+		writeV1Error(w, legacy(err, "logic error"))
+		return
+	}
+	writeJson(w, info)
+}
+
+// homeInfo 今天,昨天,本月,上月的编译次数和最近 30 天每天的编译次数
+func homeInfo() (*CommonInfo, error) {
 	info := &CommonInfo{
 		MonthCountDate:  make([]string, 0),
 		MonthCountGraph: make([]int, 0),
@@ -28,15 +38,13 @@ func HomeInfo(w http.ResponseWriter, r *http.Request) {
 
 	count, err := model.CountTaskLog(today, cur)
 	if err != nil {
-		writeError(w, "logic error", err.Error())
-		return
+		return nil, errInternal(err)
 	}
 	info.TodayCount = int(count)
 
 	count, err = model.CountTaskLog(yesterday, today)
 	if err != nil {
-		writeError(w, "logic error", err.Error())
-		return
+		return nil, errInternal(err)
 	}
 	info.YesterdayCount = int(count)
 
@@ -44,22 +52,19 @@ func HomeInfo(w http.ResponseWriter, r *http.Request) {
 	lastMonth := tomonth.AddDate(0, -1, 0)
 	count, err = model.CountTaskLog(tomonth, cur)
 	if err != nil {
-		writeError(w, "logic error", err.Error())
-		return
+		return nil, errInternal(err)
 	}
 
 	info.MonthCount = int(count)
 	count, err = model.CountTaskLog(lastMonth, tomonth)
 	if err != nil {
-		writeError(w, "logic error", err.Error())
-		return
+		return nil, errInternal(err)
 	}
 	info.LastMontCount = int(count)
 
 	ds, err := model.Count30DayTaskLog()
 	if err != nil {
-		writeError(w, "logic error", err.Error())
-		return
+		return nil, errInternal(err)
 	}
 
 	dateMap := make(map[string]int)
@@ -76,5 +81,5 @@ func HomeInfo(w http.ResponseWriter, r *http.Request) {
 		start = start.AddDate(0, 0, 1)
 	}
 
-	writeJson(w, info)
+	return info, nil
 }
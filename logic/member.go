@@ -0,0 +1,217 @@
+package logic
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/subchen/go-log"
+)
+
+// projectRole 当前用户在工程中的角色,管理员拥有所有工程的权限
+func projectRole(r *http.Request, projectId int64) (int, error) {
+	u := currentUser(r)
+	if u == nil {
+		return model.RoleNone, nil
+	}
+	if u.Admin {
+		return model.RoleAdmin, nil
+	}
+	return model.GetProjectRole(projectId, u.Id)
+}
+
+// requireRole 角色低于 role 时返回 forbidden
+func requireRole(r *http.Request, projectId int64, role int) error {
+	cur, err := projectRole(r, projectId)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return errInternal(err)
+	}
+
+	if cur < role {
+		log.Warnf("user:%s project:%d role:%d less than %d", userName(r), projectId, cur, role)
+		return errForbidden("permission denied")
+	}
+	return nil
+}
+
+// requireTaskRole 校验任务所属工程的角色
+func requireTaskRole(r *http.Request, taskId int64, role int) (*model.Task, error) {
+	t, err := model.GetTask(taskId)
+	if err != nil {
+		log.Errorf("get task error:%s", err)
+		return nil, errQuery(err)
+	}
+	return t, requireRole(r, t.ProjectId, role)
+}
+
+func requireAdmin(r *http.Request) error {
+	if isAdmin(r) {
+		return nil
+	}
+	log.Warnf("user:%s %s admin required", userName(r), r.URL.Path)
+	return errForbidden("admin required")
+}
+
+func userName(r *http.Request) string {
+	if u := currentUser(r); u != nil {
+		return u.Name
+	}
+	return ""
+}
+
+// visibleProjectIds 当前用户可以查看的工程,nil 表示所有工程
+func visibleProjectIds(r *http.Request) ([]int64, error) {
+	u := currentUser(r)
+	if u == nil {
+		return []int64{}, nil
+	}
+	if u.Admin {
+		return nil, nil
+	}
+	return model.ListUserProjectIds(u.Id)
+}
+
+func containsId(ids []int64, id int64) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOutput 下载编译结果需要工程的查看权限,路径第一级为工程名,签名链接不检查
+func CheckOutput(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if currentUser(r) != nil {
+			if err := checkOutputPath(r, r.URL.Path); err != nil {
+				writeV1Error(w, err)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func checkOutputPath(r *http.Request, path string) error {
+	name := strings.SplitN(strings.TrimPrefix(strings.TrimPrefix(path, "/output"), "/"), "/", 2)[0]
+	p, err := model.GetProjectByName(name)
+	if err != nil {
+		return errQuery(err)
+	}
+	return requireRole(r, p.Id, model.RoleViewer)
+}
+
+// saveMember 添加成员或修改成员的角色
+func saveMember(r *http.Request, m *model.ProjectMember) error {
+	if err := requireRole(r, m.ProjectId, model.RoleMaintainer); err != nil {
+		return err
+	}
+
+	if m.Role < model.RoleViewer || m.Role > model.RoleMaintainer {
+		return errInvalid("role", "role not allowed")
+	}
+
+	if _, err := model.GetUser(m.UserId); err != nil {
+		log.Errorf("get user error:%s", err)
+		return errInvalid("user_id", err.Error())
+	}
+
+	old, err := model.GetProjectRole(m.ProjectId, m.UserId)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return errInternal(err)
+	}
+
+	if err := model.SaveProjectMember(m); err != nil {
+		log.Errorf("save sql error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "member.save", "user", m.UserId, m.ProjectId,
+		map[string]interface{}{"role": old}, map[string]interface{}{"role": m.Role})
+	return nil
+}
+
+func listMembers(r *http.Request, projectid int64) ([]*model.ProjectMemberInfo, error) {
+	if err := requireRole(r, projectid, model.RoleViewer); err != nil {
+		return nil, err
+	}
+
+	ms, err := model.ListProjectMember(projectid)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return nil, errInternal(err)
+	}
+	return ms, nil
+}
+
+func deleteMember(r *http.Request, projectid, userid int64) error {
+	if err := requireRole(r, projectid, model.RoleMaintainer); err != nil {
+		return err
+	}
+
+	old, err := model.GetProjectRole(projectid, userid)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return errInternal(err)
+	}
+
+	if err := model.DelProjectMember(projectid, userid); err != nil {
+		log.Errorf("delete sql error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "member.delete", "user", userid, projectid, map[string]interface{}{"role": old}, nil)
+	return nil
+}
+
+func AddMember(wr http.ResponseWriter, r *http.Request) {
+	m := &model.ProjectMember{}
+	if err := ParseParam(r, m); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := saveMember(r, m); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+
+	writeSuccess(wr, "save member ok")
+}
+
+func ListMember(wr http.ResponseWriter, r *http.Request) {
+	projectid, err := strconv.ParseInt(r.FormValue("project_id"), 10, 64)
+	if err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	ms, err := listMembers(r, projectid)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, ms)
+}
+
+func DelMember(wr http.ResponseWriter, r *http.Request) {
+	m := &model.ProjectMember{}
+	if err := ParseParam(r, m); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := deleteMember(r, m.ProjectId, m.UserId); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+
+	writeSuccess(wr, "删除成功")
+}
@@ -0,0 +1,417 @@
+package logic
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hash-rabbit/auto-build/model"
+)
+
+// apiOp 一个接口的说明,用于生成 openapi 文档,添加路由时需要同时添加说明
+type apiOp struct {
+	Method  string
+	Path    string // mux 的路径模板,如 /api/v2/projects/{id}
+	Summary string
+	Query   []apiParam
+	Body    interface{} // json body 的类型
+	Resp    interface{} // 返回数据的类型,nil 时没有返回数据
+	Status  int         // 成功时的状态码,默认 200
+	Text    string      // 返回的不是 json 时的 content type
+	Public  bool        // 不需要登录
+}
+
+type apiParam struct {
+	Name     string
+	Type     string // integer/string/boolean
+	Desc     string
+	Required bool
+}
+
+func queryParam(name, typ, desc string) apiParam {
+	return apiParam{Name: name, Type: typ, Desc: desc}
+}
+
+func requiredParam(name, typ, desc string) apiParam {
+	return apiParam{Name: name, Type: typ, Desc: desc, Required: true}
+}
+
+// 以下类型只用于文档,说明 v1 接口实际使用的 body 字段
+
+type idParam struct {
+	Id int64 `json:"id"`
+}
+
+type v1PollParam struct {
+	Id           int64 `json:"id"`
+	PollInterval int   `json:"poll_interval"`
+}
+
+type v1AutoBuildParam struct {
+	Id        int64 `json:"id"`
+	AutoBuild bool  `json:"auto_build"`
+}
+
+type v1CronParam struct {
+	Id       int64  `json:"id"`
+	Cron     string `json:"cron"`
+	CronSkip bool   `json:"cron_skip"`
+}
+
+type v1LabelsParam struct {
+	Id     int64  `json:"id"`
+	Labels string `json:"labels"`
+}
+
+type v1ImageParam struct {
+	Id    int64  `json:"id"`
+	Image string `json:"image"`
+}
+
+var pageParams = []apiParam{
+	queryParam("page_size", "integer", "每页数量"),
+	queryParam("page_num", "integer", "页码,从 1 开始"),
+}
+
+var auditParams = []apiParam{
+	queryParam("user_name", "string", "操作用户"),
+	queryParam("action", "string", "操作,如 task.delete"),
+	queryParam("target", "string", "对象类型"),
+	queryParam("target_id", "integer", "对象 id"),
+	queryParam("project_id", "integer", "工程 id,工程 maintainer 可以查看"),
+	queryParam("start", "string", "开始日期 2006-01-02"),
+	queryParam("end", "string", "结束日期 2006-01-02,包含当天"),
+}
+
+var taskLogParams = []apiParam{
+	queryParam("project_id", "integer", "工程 id"),
+	queryParam("task_id", "integer", "任务 id"),
+	queryParam("merge_request", "integer", "merge request 编号,0 为分支编译,默认 -1 为所有"),
+	queryParam("status", "integer", "0:init,1:running,2:success,3:failed,4:interrupted"),
+	queryParam("branch", "string", "任务的分支"),
+	queryParam("commit", "string", "提交 sha 前缀"),
+	queryParam("trigger", "string", "触发方式 manual/push/merge_request/cron/poll/rebuild"),
+	queryParam("user", "string", "手动触发的用户或 webhook 中的推送者"),
+	queryParam("start", "string", "开始日期 2006-01-02"),
+	queryParam("end", "string", "结束日期 2006-01-02,包含当天"),
+	queryParam("sort", "string", "排序字段 create_at/finish_at/status/size,前缀 - 为倒序,默认 -create_at"),
+}
+
+// apiOps 所有接口的说明,v1 接口返回 {code,msg,data},v2 接口直接返回数据
+var apiOps = []apiOp{
+	{Method: http.MethodGet, Path: "/", Summary: "前端页面", Text: "text/html", Public: true},
+	{Method: http.MethodGet, Path: "/api/openapi.json", Summary: "openapi 文档", Text: "application/json", Public: true},
+	{Method: http.MethodPost, Path: "/webhook/{project}", Summary: "gitlab/github webhook", Body: Event{}, Public: true},
+
+	// agent,使用 X-Agent-Token 和 X-Agent-Name 认证
+	{Method: http.MethodPost, Path: "/agent/register", Summary: "agent 注册,中断该 agent 之前没有完成的编译;新名称使用 agent_token 注册,返回该 agent 的凭证", Body: agentInfo{}, Resp: agentCredential{}, Public: true},
+	{Method: http.MethodPost, Path: "/agent/poll", Summary: "agent 领取编译,最多等待 10 秒,没有编译时返回 204,没有批准时返回 403", Body: agentInfo{}, Resp: agentJob{}, Public: true},
+	{Method: http.MethodPost, Path: "/agent/jobs/{id}", Summary: "agent 上报编译状态", Body: agentUpdate{}, Status: http.StatusNoContent, Public: true},
+	{Method: http.MethodPost, Path: "/agent/jobs/{id}/log", Summary: "agent 上传编译输出,body 为从 offset 开始的一段,为空时只作为心跳", Status: http.StatusNoContent, Public: true,
+		Query: []apiParam{queryParam("offset", "integer", "本段在编译输出中的位置")}},
+	{Method: http.MethodPut, Path: "/agent/jobs/{id}/artifact", Summary: "agent 分段上传编译结果,最后一段返回下载地址,其他返回 204", Resp: outputLink{}, Public: true,
+		Query: []apiParam{queryParam("offset", "integer", "本段在文件中的位置"), requiredParam("size", "integer", "文件大小")}},
+
+	// v1
+	{Method: http.MethodGet, Path: "/api/home/info", Summary: "首页编译统计", Resp: CommonInfo{}},
+
+	{Method: http.MethodPost, Path: "/api/user/login", Summary: "登录", Body: loginParam{}, Resp: loginResult{}, Public: true},
+	{Method: http.MethodPost, Path: "/api/user/logout", Summary: "退出登录"},
+	{Method: http.MethodGet, Path: "/api/user/info", Summary: "当前用户", Resp: model.User{}},
+	{Method: http.MethodPost, Path: "/api/user/password", Summary: "修改密码", Body: passwordParam{}},
+	{Method: http.MethodPost, Path: "/api/user/add", Summary: "添加用户(admin)", Body: userParam{}, Resp: model.User{}},
+	{Method: http.MethodGet, Path: "/api/user/list", Summary: "用户列表(admin),工程维护者只返回 id 和 name", Resp: []model.User{}},
+	{Method: http.MethodDelete, Path: "/api/user/delete", Summary: "删除用户(admin)", Body: idParam{}},
+	{Method: http.MethodPost, Path: "/api/token/add", Summary: "创建个人 token", Body: tokenParam{}, Resp: tokenResult{}},
+	{Method: http.MethodGet, Path: "/api/token/list", Summary: "个人 token 列表", Resp: []model.ApiToken{}},
+	{Method: http.MethodDelete, Path: "/api/token/delete", Summary: "删除个人 token", Body: idParam{}},
+	{Method: http.MethodGet, Path: "/api/output/sign", Summary: "生成编译结果的签名下载链接", Resp: "",
+		Query: []apiParam{requiredParam("path", "string", "工程名/分支/文件名"), queryParam("expire", "integer", "有效期(秒),默认 3600")}},
+	{Method: http.MethodGet, Path: "/api/audit/list", Summary: "审计日志", Resp: []model.AuditLog{},
+		Query: append(auditParams, pageParams...)},
+
+	{Method: http.MethodGet, Path: "/api/goenv/list", Summary: "已安装的 go 版本", Resp: []string{}},
+	{Method: http.MethodGet, Path: "/api/agent/list", Summary: "agent 列表(admin)", Resp: []model.Agent{}},
+	{Method: http.MethodPost, Path: "/api/agent/approve", Summary: "批准 agent 领取编译(admin)", Body: model.Agent{}},
+	{Method: http.MethodDelete, Path: "/api/agent/delete", Summary: "删除 agent(admin),中断它的编译", Body: idParam{}},
+
+	{Method: http.MethodPost, Path: "/api/project/add", Summary: "添加工程(admin)", Body: model.Project{}},
+	{Method: http.MethodGet, Path: "/api/project/branch/list", Summary: "工程的远端分支", Resp: []string{},
+		Query: []apiParam{requiredParam("id", "integer", "工程 id")}},
+	{Method: http.MethodDelete, Path: "/api/project/delete", Summary: "删除工程(admin)", Body: idParam{}},
+	{Method: http.MethodGet, Path: "/api/project/list", Summary: "工程列表", Resp: []model.Project{},
+		Query: []apiParam{queryParam("project_name", "string", "工程名")}},
+	{Method: http.MethodPost, Path: "/api/project/poll", Summary: "设置轮询间隔(分钟)", Body: v1PollParam{}},
+
+	{Method: http.MethodPost, Path: "/api/task/add", Summary: "添加任务", Body: model.Task{}},
+	{Method: http.MethodDelete, Path: "/api/task/delete", Summary: "删除任务", Body: idParam{}},
+	{Method: http.MethodGet, Path: "/api/task/list", Summary: "任务列表", Resp: []model.TaskInfo{},
+		Query: []apiParam{queryParam("project_id", "integer", "工程 id")}},
+	{Method: http.MethodPost, Path: "/api/task/start", Summary: "开始编译", Body: startParam{}},
+	{Method: http.MethodPost, Path: "/api/task/auto-build", Summary: "设置自动编译", Body: v1AutoBuildParam{}},
+	{Method: http.MethodPost, Path: "/api/task/cron", Summary: "设置定时编译", Body: v1CronParam{}},
+	{Method: http.MethodPost, Path: "/api/task/labels", Summary: "设置 agent 标签选择,为空时在服务端编译", Body: v1LabelsParam{}},
+	{Method: http.MethodPost, Path: "/api/task/image", Summary: "设置在容器中编译使用的镜像,为空时在主机上编译", Body: v1ImageParam{}},
+
+	{Method: http.MethodPost, Path: "/api/member/add", Summary: "添加或修改工程成员", Body: model.ProjectMember{}},
+	{Method: http.MethodGet, Path: "/api/member/list", Summary: "工程成员", Resp: []model.ProjectMemberInfo{},
+		Query: []apiParam{requiredParam("project_id", "integer", "工程 id")}},
+	{Method: http.MethodDelete, Path: "/api/member/delete", Summary: "删除工程成员", Body: model.ProjectMember{}},
+
+	{Method: http.MethodPost, Path: "/api/secret/add", Summary: "添加或修改加密变量", Body: model.SecretVar{}},
+	{Method: http.MethodGet, Path: "/api/secret/list", Summary: "加密变量,值不返回", Resp: []model.SecretVar{},
+		Query: []apiParam{requiredParam("project_id", "integer", "工程 id"), requiredParam("task_id", "integer", "任务 id,-1 为所有")}},
+	{Method: http.MethodDelete, Path: "/api/secret/delete", Summary: "删除加密变量", Body: idParam{}},
+
+	{Method: http.MethodGet, Path: "/api/task/log/list", Summary: "编译记录,总数在 X-Total-Count 中", Resp: []model.TaskLogInfo{},
+		Query: append(taskLogParams, pageParams...)},
+	{Method: http.MethodGet, Path: "/api/task/log/info", Summary: "编译记录详情,config 为编译时的配置快照", Resp: model.TaskLog{},
+		Query: []apiParam{requiredParam("task_log_id", "integer", "编译记录 id")}},
+	{Method: http.MethodGet, Path: "/api/task/log/output", Summary: "编译输出", Resp: "",
+		Query: []apiParam{requiredParam("task_log_id", "integer", "编译记录 id")}},
+	{Method: http.MethodGet, Path: "/api/task/log/changelog", Summary: "本次编译和上一次成功编译之间的提交", Resp: changelog{},
+		Query: []apiParam{requiredParam("task_log_id", "integer", "编译记录 id")}},
+	{Method: http.MethodPost, Path: "/api/task/log/rebuild", Summary: "使用相同的 commit 和配置重新编译", Body: rebuildParam{}},
+	{Method: http.MethodPost, Path: "/api/task/log/cancel", Summary: "取消等待或正在进行的编译", Body: rebuildParam{}},
+
+	// v2
+	{Method: http.MethodPost, Path: "/api/v2/session", Summary: "登录", Body: loginParam{}, Resp: loginResult{}, Status: http.StatusCreated, Public: true},
+	{Method: http.MethodDelete, Path: "/api/v2/session", Summary: "退出登录", Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/api/v2/me", Summary: "当前用户", Resp: model.User{}},
+	{Method: http.MethodPut, Path: "/api/v2/me/password", Summary: "修改密码", Body: passwordParam{}, Status: http.StatusNoContent},
+
+	{Method: http.MethodGet, Path: "/api/v2/users", Summary: "用户列表(admin),工程维护者只返回 id 和 name", Resp: []model.User{}},
+	{Method: http.MethodPost, Path: "/api/v2/users", Summary: "添加用户(admin)", Body: userParam{}, Resp: model.User{}, Status: http.StatusCreated},
+	{Method: http.MethodDelete, Path: "/api/v2/users/{id}", Summary: "删除用户(admin)", Status: http.StatusNoContent},
+
+	{Method: http.MethodGet, Path: "/api/v2/tokens", Summary: "个人 token 列表", Resp: []model.ApiToken{}},
+	{Method: http.MethodPost, Path: "/api/v2/tokens", Summary: "创建个人 token", Body: tokenParam{}, Resp: tokenResult{}, Status: http.StatusCreated},
+	{Method: http.MethodDelete, Path: "/api/v2/tokens/{id}", Summary: "删除个人 token", Status: http.StatusNoContent},
+
+	{Method: http.MethodPost, Path: "/api/v2/output-links", Summary: "生成编译结果的签名下载链接", Body: outputLinkParam{}, Resp: outputLink{}, Status: http.StatusCreated},
+
+	{Method: http.MethodGet, Path: "/api/v2/home", Summary: "首页编译统计", Resp: CommonInfo{}},
+	{Method: http.MethodGet, Path: "/api/v2/goenvs", Summary: "已安装的 go 版本", Resp: []string{}},
+	{Method: http.MethodPost, Path: "/api/v2/goenvs", Summary: "安装 go 版本(admin),在后台进行", Body: goEnvParam{}, Status: http.StatusAccepted},
+	{Method: http.MethodDelete, Path: "/api/v2/goenvs/{version}", Summary: "删除 go 版本(admin)", Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/api/v2/agents", Summary: "agent 列表(admin)", Resp: []model.Agent{}},
+	{Method: http.MethodPut, Path: "/api/v2/agents/{id}/approval", Summary: "批准 agent 领取编译(admin)", Body: approvalParam{}, Status: http.StatusNoContent},
+	{Method: http.MethodDelete, Path: "/api/v2/agents/{id}", Summary: "删除 agent(admin),中断它的编译", Status: http.StatusNoContent},
+
+	{Method: http.MethodGet, Path: "/api/v2/projects", Summary: "工程列表", Resp: []model.Project{},
+		Query: []apiParam{queryParam("name", "string", "工程名")}},
+	{Method: http.MethodPost, Path: "/api/v2/projects", Summary: "添加工程(admin)", Body: model.Project{}, Resp: model.Project{}, Status: http.StatusCreated},
+	{Method: http.MethodGet, Path: "/api/v2/projects/{id}", Summary: "工程详情", Resp: model.Project{}},
+	{Method: http.MethodDelete, Path: "/api/v2/projects/{id}", Summary: "删除工程(admin)", Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/api/v2/projects/{id}/branches", Summary: "工程的远端分支", Resp: []string{}},
+	{Method: http.MethodPut, Path: "/api/v2/projects/{id}/poll", Summary: "设置轮询间隔(分钟)", Body: pollParam{}, Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/api/v2/projects/{id}/members", Summary: "工程成员", Resp: []model.ProjectMemberInfo{}},
+	{Method: http.MethodPut, Path: "/api/v2/projects/{id}/members/{user_id}", Summary: "添加或修改工程成员", Body: memberParam{}, Status: http.StatusNoContent},
+	{Method: http.MethodDelete, Path: "/api/v2/projects/{id}/members/{user_id}", Summary: "删除工程成员", Status: http.StatusNoContent},
+	{Method: http.MethodGet, Path: "/api/v2/projects/{id}/secrets", Summary: "加密变量,值不返回", Resp: []model.SecretVar{},
+		Query: []apiParam{queryParam("task_id", "integer", "任务 id,默认 -1 为所有")}},
+	{Method: http.MethodPut, Path: "/api/v2/projects/{id}/secrets/{name}", Summary: "添加或修改加密变量", Body: secretParam{}, Resp: model.SecretVar{}},
+	{Method: http.MethodDelete, Path: "/api/v2/secrets/{id}", Summary: "删除加密变量", Status: http.StatusNoContent},
+
+	{Method: http.MethodGet, Path: "/api/v2/tasks", Summary: "任务列表", Resp: []model.TaskInfo{},
+		Query: []apiParam{queryParam("project_id", "integer", "工程 id")}},
+	{Method: http.MethodPost, Path: "/api/v2/tasks", Summary: "添加任务", Body: model.Task{}, Resp: model.Task{}, Status: http.StatusCreated},
+	{Method: http.MethodGet, Path: "/api/v2/tasks/{id}", Summary: "任务详情", Resp: model.Task{}},
+	{Method: http.MethodDelete, Path: "/api/v2/tasks/{id}", Summary: "删除任务", Status: http.StatusNoContent},
+	{Method: http.MethodPut, Path: "/api/v2/tasks/{id}/auto-build", Summary: "设置自动编译", Body: autoBuildParam{}, Status: http.StatusNoContent},
+	{Method: http.MethodPut, Path: "/api/v2/tasks/{id}/cron", Summary: "设置定时编译", Body: cronParam{}, Status: http.StatusNoContent},
+	{Method: http.MethodPut, Path: "/api/v2/tasks/{id}/labels", Summary: "设置 agent 标签选择,为空时在服务端编译", Body: labelsParam{}, Status: http.StatusNoContent},
+	{Method: http.MethodPut, Path: "/api/v2/tasks/{id}/image", Summary: "设置在容器中编译使用的镜像,为空时在主机上编译", Body: imageParam{}, Status: http.StatusNoContent},
+	{Method: http.MethodPost, Path: "/api/v2/tasks/{id}/builds", Summary: "开始编译,在后台进行", Resp: model.TaskLog{}, Status: http.StatusAccepted},
+
+	{Method: http.MethodGet, Path: "/api/v2/task-logs", Summary: "编译记录", Resp: taskLogPage{},
+		Query: append(taskLogParams, pageParams...)},
+	{Method: http.MethodGet, Path: "/api/v2/task-logs/{id}", Summary: "编译记录详情,config 为编译时的配置快照", Resp: model.TaskLog{}},
+	{Method: http.MethodGet, Path: "/api/v2/task-logs/{id}/output", Summary: "编译输出", Text: "text/plain"},
+	{Method: http.MethodGet, Path: "/logs/{id}", Summary: "编译输出,commit status 中的链接,需要登录", Text: "text/plain"},
+	{Method: http.MethodGet, Path: "/api/v2/task-logs/{id}/changelog", Summary: "本次编译和上一次成功编译之间的提交", Resp: changelog{}},
+	{Method: http.MethodPost, Path: "/api/v2/task-logs/{id}/rebuild", Summary: "使用相同的 commit 和配置重新编译", Resp: model.TaskLog{}, Status: http.StatusAccepted},
+	{Method: http.MethodPost, Path: "/api/v2/task-logs/{id}/cancel", Summary: "取消等待或正在进行的编译", Status: http.StatusNoContent},
+
+	{Method: http.MethodGet, Path: "/api/v2/audit-logs", Summary: "审计日志", Resp: []model.AuditLog{},
+		Query: append(auditParams, pageParams...)},
+}
+
+var (
+	specOnce sync.Once
+	specData []byte
+)
+
+// OpenApi 返回所有接口的 openapi 3 文档
+func OpenApi(wr http.ResponseWriter, r *http.Request) {
+	specOnce.Do(func() {
+		var err error
+		specData, err = json.Marshal(openApiSpec(apiOps))
+		if err != nil {
+			panic(err)
+		}
+	})
+
+	wr.Header().Set("Content-type", "application/json")
+	wr.Header().Set("Access-Control-Allow-Origin", "*")
+	wr.Write(specData)
+}
+
+type object = map[string]interface{}
+
+var pathVar = regexp.MustCompile(`\{(\w+)\}`)
+
+func openApiSpec(ops []apiOp) object {
+	g := &schemaGen{schemas: object{}}
+	errorRef := g.schema(reflect.TypeOf(errorBody{}))
+
+	paths := object{}
+	for _, op := range ops {
+		o := object{"summary": op.Summary}
+		if op.Public {
+			o["security"] = []object{}
+		}
+
+		params := make([]object, 0)
+		for _, m := range pathVar.FindAllStringSubmatch(op.Path, -1) {
+			typ := "string"
+			if m[1] == "id" || strings.HasSuffix(m[1], "_id") {
+				typ = "integer"
+			}
+			params = append(params, object{"name": m[1], "in": "path", "required": true, "schema": object{"type": typ}})
+		}
+		for _, p := range op.Query {
+			params = append(params, object{"name": p.Name, "in": "query", "required": p.Required,
+				"description": p.Desc, "schema": object{"type": p.Type}})
+		}
+		if len(params) > 0 {
+			o["parameters"] = params
+		}
+
+		if op.Body != nil {
+			o["requestBody"] = object{"required": true, "content": object{
+				"application/json": object{"schema": g.schema(reflect.TypeOf(op.Body))}}}
+		}
+
+		v2 := strings.HasPrefix(op.Path, "/api/v2/")
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		resp := object{"description": http.StatusText(status)}
+		switch {
+		case len(op.Text) > 0:
+			resp["content"] = object{op.Text: object{"schema": object{"type": "string"}}}
+		case !v2:
+			// v1 接口的错误也是 200,通过 code 区分
+			env := object{"code": object{"type": "string"}, "msg": object{"type": "string"}}
+			if op.Resp != nil {
+				env["data"] = g.schema(reflect.TypeOf(op.Resp))
+			}
+			resp["content"] = object{"application/json": object{"schema": object{"type": "object", "properties": env}}}
+		case op.Resp != nil:
+			resp["content"] = object{"application/json": object{"schema": g.schema(reflect.TypeOf(op.Resp))}}
+		}
+
+		responses := object{strconv.Itoa(status): resp}
+		if v2 {
+			responses["default"] = object{"description": "错误", "content": object{
+				"application/json": object{"schema": errorRef}}}
+		}
+		o["responses"] = responses
+
+		item, ok := paths[op.Path].(object)
+		if !ok {
+			item = object{}
+			paths[op.Path] = item
+		}
+		item[strings.ToLower(op.Method)] = o
+	}
+
+	return object{
+		"openapi": "3.0.3",
+		"info":    object{"title": "auto-build", "version": "2"},
+		"paths":   paths,
+		"components": object{
+			"schemas": g.schemas,
+			"securitySchemes": object{
+				"bearer":  object{"type": "http", "scheme": "bearer"},
+				"session": object{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+			},
+		},
+		"security": []object{{"bearer": []string{}}, {"session": []string{}}},
+	}
+}
+
+// schemaGen 根据 json tag 生成类型的 schema,结构体放到 components 中
+type schemaGen struct {
+	schemas object
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func (g *schemaGen) schema(t reflect.Type) object {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return object{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return object{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// 先占位,避免递归的类型死循环
+			g.schemas[t.Name()] = object{}
+			props := object{}
+			g.fields(t, props)
+			g.schemas[t.Name()] = object{"type": "object", "properties": props}
+		}
+		return object{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return object{}
+}
+
+// fields 匿名结构体的字段展开到外层,和 encoding/json 一致
+func (g *schemaGen) fields(t reflect.Type, props object) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if f.Anonymous && len(name) == 0 && f.Type.Kind() == reflect.Struct {
+			g.fields(f.Type, props)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		props[name] = g.schema(f.Type)
+	}
+}
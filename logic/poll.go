@@ -0,0 +1,136 @@
+package logic
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/hash-rabbit/auto-build/util"
+	"github.com/subchen/go-log"
+)
+
+// 轮询中的工程,避免上一次轮询还没结束又开始下一次
+var polling = struct {
+	sync.Mutex
+	ids map[int64]bool
+}{ids: make(map[int64]bool)}
+
+// pollProject 拉取 bare 仓库,分支有新提交时编译,和 webhook 的行为一致
+func pollProject(projectid int64) {
+	polling.Lock()
+	if polling.ids[projectid] {
+		polling.Unlock()
+		return
+	}
+	polling.ids[projectid] = true
+	polling.Unlock()
+
+	defer func() {
+		polling.Lock()
+		delete(polling.ids, projectid)
+		polling.Unlock()
+	}()
+
+	p, err := model.GetProject(projectid)
+	if err != nil {
+		log.Errorf("get project error:%s", err)
+		return
+	}
+
+	if err := util.Fetch(getBarePath(p.Name), "origin", credential(p)); err != nil {
+		log.Errorf("project:%s git fetch error:%s", p.Name, err)
+		return
+	}
+
+	ts, err := model.ListTask(p.Id)
+	if err != nil {
+		log.Errorf("list task error:%s", err)
+		return
+	}
+
+	for _, t := range ts {
+		if !t.AutoBuild {
+			continue
+		}
+
+		head, err := util.BranchHead(getBarePath(p.Name), "origin", t.Branch)
+		if err != nil {
+			log.Errorf("project:%s get branch:%s head error:%s", p.Name, t.Branch, err)
+			continue
+		}
+
+		if !needPollBuild(t.Id, head) {
+			continue
+		}
+
+		if msg, err := util.CommitMessage(getBarePath(p.Name), head); err == nil && skipCI(msg) {
+			log.Infof("project:%s branch:%s commit:%s skip ci", p.Name, t.Branch, head)
+			continue
+		}
+
+		log.Infof("project:%s branch:%s moved to %s, start build task:%d", p.Name, t.Branch, head, t.Id)
+		taskid := t.Id
+		debounceBuild(strconv.FormatInt(taskid, 10), t.Debounce, func() {
+			autobuild(taskid, &source{trigger: model.TriggerPoll, after: head}, nil)
+		})
+	}
+}
+
+// needPollBuild 最近一次编译的提交不是 head 且没有正在进行的编译时需要编译
+func needPollBuild(taskid int64, head string) bool {
+	tl, err := model.GetLastTaskLog(taskid)
+	if err != nil {
+		return true
+	}
+
+	if tl.Status == model.Init || tl.Status == model.Running {
+		return false
+	}
+
+	return tl.Commit != head
+}
+
+func setProjectPoll(r *http.Request, id int64, interval int) error {
+	if err := requireRole(r, id, model.RoleMaintainer); err != nil {
+		return err
+	}
+
+	if interval < 0 {
+		return errInvalid("poll_interval", "poll interval must not be negative")
+	}
+
+	old, err := model.GetProject(id)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return errQuery(err)
+	}
+
+	err = model.UpdateProjectPoll(id, interval)
+	if err != nil {
+		log.Errorf("update sql error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "project.poll", "project", id, id,
+		map[string]interface{}{"poll_interval": old.PollInterval}, map[string]interface{}{"poll_interval": interval})
+
+	ReloadSchedule()
+	return nil
+}
+
+func SetProjectPoll(wr http.ResponseWriter, r *http.Request) {
+	p := &model.Project{}
+	err := ParseParam(r, p)
+	if err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := setProjectPoll(r, p.Id, p.PollInterval); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "更新成功")
+}
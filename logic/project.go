@@ -1,10 +1,8 @@
 package logic
 
 import (
-	"errors"
 	"fmt"
 	"net/http"
-	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -17,96 +15,106 @@ import (
 	"github.com/subchen/go-log"
 )
 
-func AddPorject(wr http.ResponseWriter, r *http.Request) {
-	p := &model.Project{}
-	var err error
-	if err := ParseParam(r, p); err != nil {
-		log.Errorf("check param error:%s", err)
-		writeError(wr, "param error", err.Error())
-		return
+// createProject 检查参数,clone bare 仓库后保存工程
+func createProject(r *http.Request, p *model.Project) error {
+	if err := requireAdmin(r); err != nil {
+		return err
 	}
 	log.Debugf("recv param:%+v", p)
 
 	if err := checkProject(p); err != nil {
 		log.Errorf("check param error:%s", err)
-		writeError(wr, "param error", err.Error())
-		return
+		return legacy(err, "param error")
 	}
 	log.Debugf("project:%s check success", p.Name)
 
+	var err error
 	if p.GoMod {
 		p.WorkSpace = config.C.DefaultGoPath
 	} else if len(p.WorkSpace) > 0 {
 		p.WorkSpace, _ = filepath.Abs(p.WorkSpace)
 	} else {
 		log.Errorf("workspace not set")
-		writeError(wr, "git error", "must set workspace")
-		return
+		return legacy(errInvalid("workspace", "must set workspace"), "git error")
 	}
 	log.Debugf("set workspace path:%s", p.WorkSpace)
 
 	p.LocalPath, err = filepath.Abs(p.LocalPath)
 	if err != nil {
 		log.Errorf("filepath abs error:%s", err)
-		writeError(wr, "path error", err.Error())
-		return
+		return legacy(errInvalid("path", err.Error()), "path error")
 	}
 
 	if path_exist, err := PathExists(p.LocalPath); err != nil {
 		log.Errorf("path %s check error:%s", p.LocalPath, err)
-		writeError(wr, "path error", err.Error())
-		return
+		return legacy(errInvalid("path", err.Error()), "path error")
 	} else if path_exist {
 		log.Errorf("path %s has exist", p.LocalPath)
-		writeError(wr, "path error", "local path has exist")
-		return
+		return legacy(errConflict("local path has exist"), "path error")
 	}
 
 	if pathExist, err := PathExists(getBarePath(p.Name)); err != nil {
-		writeError(wr, "path error", err.Error())
-		return
+		return legacy(errInternal(err), "path error")
 	} else if pathExist {
 		os.RemoveAll(getBarePath(p.Name))
 	}
 
 	if err := os.MkdirAll(getBarePath(p.Name), os.ModePerm); err != nil {
 		log.Errorf("mkdir %s error:%s", getBarePath(p.Name), err)
-		writeError(wr, "path error", "make die error")
-		return
+		return legacy(errInternal(fmt.Errorf("make dir error:%s", err)), "path error")
 	}
 
-	if err := util.CloenWithBare(getBarePath(p.Name), p.Url, p.Token); err != nil {
+	if err := util.CloenWithBare(getBarePath(p.Name), p.Url, credential(p)); err != nil {
 		log.Errorf("clone bare error:%s", err)
-		writeError(wr, "git error", "clone bare error")
-		return
+		return errGit(fmt.Errorf("clone bare error:%s", err))
 	}
 	log.Debugf("clone to %s success", getBarePath(p.Name))
 
 	if err := model.InsertProject(p); err != nil {
 		log.Errorf("insert sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return legacy(errInternal(err), "sql error")
 	}
 
-	writeSuccess(wr, "add project ok")
+	audit(r, "project.add", "project", p.Id, p.Id, nil, p)
+
+	if p.PollInterval > 0 {
+		ReloadSchedule()
+	}
+	return nil
 }
 
 func getBarePath(projectName string) string {
 	return filepath.Join(config.C.BarePath, projectName)
 }
 
+// credential 工程仓库的认证信息
+func credential(p *model.Project) *util.Credential {
+	return &util.Credential{
+		Token:      string(p.Token),
+		SshKey:     string(p.SshKey),
+		KnownHosts: config.C.KnownHosts,
+	}
+}
+
 func checkProject(p *model.Project) error {
 	if match, _ := regexp.MatchString("[0-9|a-z|A-Z|-|_]{1,30}", p.Name); !match {
-		return errors.New("project name not allowed")
+		return errInvalid("name", "project name not allowed")
 	}
 
 	if _, err := model.GetProjectByName(p.Name); err == nil {
-		return fmt.Errorf("name:%s 已存在", p.Name)
+		return errConflict("name:%s 已存在", p.Name)
 	}
 
-	_, err := url.Parse(p.Url)
-	if err != nil {
-		return err
+	if p.PollInterval < 0 {
+		return errInvalid("poll_interval", "poll interval must not be negative")
+	}
+
+	if err := util.CheckUrl(p.Url); err != nil {
+		return errInvalid("url", err.Error())
+	}
+
+	if util.IsSshUrl(p.Url) && len(p.SshKey) == 0 {
+		return errInvalid("ssh_key", "ssh url must set ssh key")
 	}
 
 	return nil
@@ -125,88 +133,162 @@ func PathExists(path string) (bool, error) {
 	return os.IsExist(err), nil
 }
 
-func ListPorject(wr http.ResponseWriter, r *http.Request) {
-	ps, err := model.ListProject(r.FormValue("project_name"))
+// listProjects 只返回当前用户可以查看的工程
+func listProjects(r *http.Request, name string) ([]*model.Project, error) {
+	ps, err := model.ListProject(name)
 	if err != nil {
 		log.Errorf("selet sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return nil, errInternal(err)
 	}
-	writeJson(wr, ps)
+
+	ids, err := visibleProjectIds(r)
+	if err != nil {
+		log.Errorf("selet sql error:%s", err)
+		return nil, errInternal(err)
+	}
+	if ids != nil {
+		visible := make([]*model.Project, 0, len(ps))
+		for _, p := range ps {
+			if containsId(ids, p.Id) {
+				visible = append(visible, p)
+			}
+		}
+		ps = visible
+	}
+	return ps, nil
 }
 
-func DelPorject(wr http.ResponseWriter, r *http.Request) {
-	p := &model.Project{}
-	err := ParseParam(r, p)
+func getProject(r *http.Request, id int64) (*model.Project, error) {
+	p, err := model.GetProject(id)
 	if err != nil {
-		log.Errorf("check param error:%s", err)
-		writeError(wr, "param error", err.Error())
-		return
+		log.Errorf("selet sql error:%s", err)
+		return nil, errQuery(err)
 	}
 
-	pro, err := model.GetProject(p.Id)
+	if err := requireRole(r, p.Id, model.RoleViewer); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// deleteProject 工程下还有任务时不能删除
+func deleteProject(r *http.Request, id int64) error {
+	if err := requireAdmin(r); err != nil {
+		return err
+	}
+
+	pro, err := model.GetProject(id)
 	if err != nil {
 		log.Errorf("selet sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return legacy(errQuery(err), "sql error")
 	}
 
-	ts, err := model.ListTask(p.Id)
+	ts, err := model.ListTask(id)
 	if err != nil {
 		log.Errorf("selet sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return legacy(errInternal(err), "sql error")
 	}
 
 	if len(ts) > 0 {
-		writeError(wr, "logic error", "请先删除该工程的任务")
-		return
+		return legacy(errConflict("请先删除该工程的任务"), "logic error")
 	}
 
 	err = model.DelProject(pro.Id)
 	if err != nil {
 		log.Errorf("delete sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return legacy(errInternal(err), "sql error")
 	}
 
-	os.RemoveAll(getBarePath(p.Name))
+	audit(r, "project.delete", "project", pro.Id, pro.Id, pro, nil)
 
-	writeSuccess(wr, "删除成功")
+	os.RemoveAll(getBarePath(pro.Name))
+
+	if pro.PollInterval > 0 {
+		ReloadSchedule()
+	}
+	return nil
 }
 
-func ListBranch(wr http.ResponseWriter, r *http.Request) {
-	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+// listBranches 拉取 bare 仓库后返回远端的分支
+func listBranches(r *http.Request, id int64) ([]string, error) {
+	p, err := getProject(r, id)
 	if err != nil {
-		log.Errorf("parse param id error:%s", err)
+		return nil, legacy(err, "sql error")
+	}
+
+	err = util.Fetch(getBarePath(p.Name), "origin", credential(p))
+	if err != nil {
+		log.Errorf("git fetch error:%s", err)
+		return nil, legacy(errGit(err), "logic error")
+	}
+
+	branchs, err := util.BranchList(getBarePath(p.Name), "origin", credential(p))
+	if err != nil {
+		log.Errorf("get branch list error:%s", err)
+		return nil, legacy(errGit(err), "logic error")
+	}
+
+	sort.Slice(branchs, func(i, j int) bool {
+		return branchs[i] < branchs[j]
+	})
+	return branchs, nil
+}
+
+func AddPorject(wr http.ResponseWriter, r *http.Request) {
+	p := &model.Project{}
+	if err := ParseParam(r, p); err != nil {
+		log.Errorf("check param error:%s", err)
 		writeError(wr, "param error", err.Error())
 		return
 	}
 
-	p, err := model.GetProject(id)
+	if err := createProject(r, p); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+
+	writeSuccess(wr, "add project ok")
+}
+
+func ListPorject(wr http.ResponseWriter, r *http.Request) {
+	ps, err := listProjects(r, r.FormValue("project_name"))
 	if err != nil {
-		log.Errorf("selet sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
+		writeV1Error(wr, legacy(err, "sql error"))
 		return
 	}
+	writeJson(wr, ps)
+}
 
-	err = util.Fetch(getBarePath(p.Name), "origin", p.Token)
+func DelPorject(wr http.ResponseWriter, r *http.Request) {
+	p := &model.Project{}
+	err := ParseParam(r, p)
 	if err != nil {
-		log.Errorf("git fetch error:%s", err)
-		writeError(wr, "logic error", err.Error())
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "param error", err.Error())
+		return
+	}
+
+	if err := deleteProject(r, p.Id); err != nil {
+		writeV1Error(wr, err)
 		return
 	}
 
-	branchs, err := util.BranchList(getBarePath(p.Name), "origin", p.Token)
+	writeSuccess(wr, "删除成功")
+}
+
+func ListBranch(wr http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
 	if err != nil {
-		log.Errorf("get branch list error:%s", err)
-		writeError(wr, "logic error", err.Error())
+		log.Errorf("parse param id error:%s", err)
+		writeError(wr, "param error", err.Error())
 		return
 	}
 
-	sort.Slice(branchs, func(i, j int) bool {
-		return branchs[i] < branchs[j]
-	})
+	branchs, err := listBranches(r, id)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
 
 	writeJson(wr, branchs)
 }
@@ -0,0 +1,143 @@
+package logic
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/hash-rabbit/auto-build/util"
+	"github.com/subchen/go-log"
+)
+
+// 重启时没有完成的编译的处理方式
+const (
+	OrphanInterrupt = "interrupt"
+	OrphanRequeue   = "requeue"
+)
+
+// RecoverOrphans 处理进程退出时没有完成的编译:标记为中断,清理工作目录和固定 commit 的 ref,
+// requeue 时使用相同的 commit 和配置重新编译。需要在接收请求和开始定时任务之前调用,此时没有正在进行的编译
+func RecoverOrphans(policy string) {
+	if len(policy) == 0 {
+		policy = OrphanInterrupt
+	}
+	if policy != OrphanInterrupt && policy != OrphanRequeue {
+		log.Warnf("unknown orphan_policy:%s, use %s", policy, OrphanInterrupt)
+		policy = OrphanInterrupt
+	}
+
+	tls, err := model.ListUnfinishedTaskLog()
+	if err != nil {
+		log.Errorf("list unfinished task log error:%s", err)
+		return
+	}
+
+	queue := make([]*task, 0)
+	for _, tl := range tls {
+		// agent 上的编译不受服务端重启影响,等待领取的编译继续等待
+		if len(tl.Selector) > 0 || tl.AgentId > 0 {
+			continue
+		}
+		log.Warnf("task log:%d status:%d interrupted by restart", tl.Id, tl.Status)
+		model.UpdateTaskLog(tl.Id, model.Interrupted)
+		appendOutput(tl.OutFilePath, "build interrupted by server restart")
+
+		tk, err := model.GetTask(tl.TaskId)
+		if err != nil {
+			log.Errorf("get task error:%s", err)
+			continue
+		}
+		p, err := model.GetProject(tk.ProjectId)
+		if err != nil {
+			log.Errorf("get project error:%s", err)
+			continue
+		}
+
+		if len(p.LocalPath) > 0 {
+			os.RemoveAll(p.LocalPath)
+		}
+		if err := util.RemoveRef(getBarePath(p.Name), pinRef(tl.Id)); err == nil {
+			log.Infof("task log:%d remove pinned ref", tl.Id)
+		}
+
+		orphan := &task{id: tl.Id, p: p, t: tk, mr: tl.MergeRequest, sha: tl.Commit}
+		orphan.report(util.StatusFailed)
+
+		if policy == OrphanRequeue {
+			if t := requeue(p, tk, tl); t != nil {
+				queue = append(queue, t)
+			}
+		}
+	}
+
+	// 同一个工程的编译使用相同的工作目录,依次编译
+	if len(queue) > 0 {
+		go func() {
+			for _, t := range queue {
+				t.start()
+			}
+		}()
+	}
+}
+
+// requeue 为中断的编译创建新的编译记录,保留原来的触发来源,新记录的 rebuild_of 为中断的记录
+func requeue(p *model.Project, tk *model.Task, orig *model.TaskLog) *task {
+	// merge request 的 ref 来自 webhook 事件,没有 commit 时无法确定编译的内容
+	if orig.MergeRequest > 0 && len(orig.Commit) == 0 {
+		log.Warnf("task log:%d merge request:%d has no commit, skip requeue", orig.Id, orig.MergeRequest)
+		return nil
+	}
+
+	slot, err := acquireBuild()
+	if err != nil {
+		log.Errorf("task log:%d requeue error:%s", orig.Id, err)
+		return nil
+	}
+
+	tl := &model.TaskLog{
+		TaskId:       tk.Id,
+		MergeRequest: orig.MergeRequest,
+		Ref:          orig.Ref,
+		Status:       model.Init,
+		Trigger:      orig.Trigger,
+		RebuildOf:    orig.Id,
+		UserId:       orig.UserId,
+		UserName:     orig.UserName,
+		DeliveryId:   orig.DeliveryId,
+		PushedBy:     orig.PushedBy,
+		BeforeSha:    orig.BeforeSha,
+		AfterSha:     orig.AfterSha,
+	}
+	if err := model.InsertTaskLog(tl); err != nil {
+		slot.release()
+		log.Errorf("insert sql error:%s", err)
+		return nil
+	}
+	log.Infof("task log:%d requeued as %d", orig.Id, tl.Id)
+
+	return &task{
+		id:    tl.Id,
+		p:     p,
+		t:     tk,
+		tl:    tl,
+		mr:    orig.MergeRequest,
+		pin:   orig.Commit,
+		cfg:   orig.Config,
+		slot:  slot,
+		files: make([]*os.File, 0),
+	}
+}
+
+// appendOutput 在编译输出的最后追加一行
+func appendOutput(filename, msg string) {
+	if len(filename) == 0 {
+		return
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s\n", time.Now().Format("2006-01-02 15:04:05"), msg)
+}
@@ -0,0 +1,142 @@
+package logic
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/hash-rabbit/auto-build/env"
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/hash-rabbit/auto-build/util"
+	"github.com/subchen/go-log"
+)
+
+// ReloadSchedule 根据任务的定时编译和工程的轮询配置重新注册定时任务,任务或工程变更后需要调用
+func ReloadSchedule() {
+	ts, err := model.ListCronTask()
+	if err != nil {
+		log.Errorf("list cron task error:%s", err)
+		return
+	}
+
+	ps, err := model.ListPollProject()
+	if err != nil {
+		log.Errorf("list poll project error:%s", err)
+		return
+	}
+
+	ss := make([]*env.Schedule, 0, len(ts)+len(ps))
+	for _, t := range ts {
+		taskid := t.Id
+		ss = append(ss, &env.Schedule{
+			Name: fmt.Sprintf("task:%d", taskid),
+			Spec: t.Cron,
+			Job:  func() { cronBuild(taskid) },
+		})
+	}
+
+	for _, p := range ps {
+		projectid := p.Id
+		ss = append(ss, &env.Schedule{
+			Name: fmt.Sprintf("poll project:%s", p.Name),
+			Spec: fmt.Sprintf("@every %dm", p.PollInterval),
+			Job:  func() { pollProject(projectid) },
+		})
+	}
+
+	// 中断失去联系的 agent 上的编译
+	ss = append(ss, &env.Schedule{
+		Name: "check agent",
+		Spec: "@every 1m",
+		Job:  checkAgents,
+	})
+
+	env.Reload(ss)
+	log.Infof("reload %d cron task, %d poll project", len(ts), len(ps))
+}
+
+func cronBuild(taskid int64) {
+	tk, err := model.GetTask(taskid)
+	if err != nil {
+		log.Errorf("get task error:%s", err)
+		return
+	}
+
+	if tk.CronSkip && !branchChanged(tk) {
+		log.Infof("task:%d branch:%s not changed since last success build, skip cron build", tk.Id, tk.Branch)
+		return
+	}
+
+	log.Infof("task:%d cron build", tk.Id)
+	autobuild(taskid, &source{trigger: model.TriggerCron}, nil)
+}
+
+// branchChanged 分支最新提交和最近一次成功编译的提交不同时返回 true,无法判断时也返回 true
+func branchChanged(tk *model.Task) bool {
+	p, err := model.GetProject(tk.ProjectId)
+	if err != nil {
+		log.Errorf("get project error:%s", err)
+		return true
+	}
+
+	if err := util.Fetch(getBarePath(p.Name), "origin", credential(p)); err != nil {
+		log.Errorf("git fetch error:%s", err)
+		return true
+	}
+
+	head, err := util.BranchHead(getBarePath(p.Name), "origin", tk.Branch)
+	if err != nil {
+		log.Errorf("get branch:%s head error:%s", tk.Branch, err)
+		return true
+	}
+
+	tl, err := model.GetLastSuccessTaskLog(tk.Id)
+	if err != nil {
+		log.Debugf("get last success task log error:%s", err)
+		return true
+	}
+
+	return tl.Commit != head
+}
+
+func setTaskCron(r *http.Request, id int64, spec string, skip bool) error {
+	old, err := requireTaskRole(r, id, model.RoleMaintainer)
+	if err != nil {
+		return err
+	}
+
+	if len(spec) > 0 {
+		if err := env.CheckSpec(spec); err != nil {
+			log.Errorf("check cron error:%s", err)
+			return errInvalid("cron", err.Error())
+		}
+	}
+
+	err = model.UpdateTaskCron(id, spec, skip)
+	if err != nil {
+		log.Errorf("update sql error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "task.cron", "task", old.Id, old.ProjectId,
+		map[string]interface{}{"cron": old.Cron, "cron_skip": old.CronSkip},
+		map[string]interface{}{"cron": spec, "cron_skip": skip})
+
+	ReloadSchedule()
+	return nil
+}
+
+func SetTaskCron(wr http.ResponseWriter, r *http.Request) {
+	t := &model.Task{}
+	err := ParseParam(r, t)
+	if err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := setTaskCron(r, t.Id, t.Cron, t.CronSkip); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "更新成功")
+}
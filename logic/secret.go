@@ -0,0 +1,211 @@
+package logic
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/subchen/go-log"
+)
+
+var secretNameReg = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// saveSecret 同一作用域下同名的变量会被覆盖
+func saveSecret(r *http.Request, v *model.SecretVar) error {
+	if err := requireRole(r, v.ProjectId, model.RoleMaintainer); err != nil {
+		return err
+	}
+
+	if err := checkSecret(v); err != nil {
+		log.Errorf("check secret error:%s", err)
+		return err
+	}
+
+	if err := model.SaveSecretVar(v); err != nil {
+		log.Errorf("save sql error:%s", err)
+		return errInternal(err)
+	}
+
+	// 值在 json 中会被隐藏
+	audit(r, "secret.save", "secret", v.Id, v.ProjectId, nil, v)
+	return nil
+}
+
+func checkSecret(v *model.SecretVar) error {
+	if !secretNameReg.MatchString(v.Name) {
+		return errInvalid("name", "secret name not allowed")
+	}
+
+	if len(v.Value) == 0 {
+		return errInvalid("value", "secret value not set")
+	}
+
+	if _, err := model.GetProject(v.ProjectId); err != nil {
+		return errInvalid("project_id", err.Error())
+	}
+
+	if v.TaskId > 0 {
+		t, err := model.GetTask(v.TaskId)
+		if err != nil {
+			return errInvalid("task_id", err.Error())
+		}
+		if t.ProjectId != v.ProjectId {
+			return errInvalid("task_id", "task not belong to project")
+		}
+	}
+
+	return nil
+}
+
+// listSecrets 只返回变量名,值不会返回,taskid 小于 0 时返回工程下所有变量
+func listSecrets(r *http.Request, projectid, taskid int64) ([]*model.SecretVar, error) {
+	if err := requireRole(r, projectid, model.RoleMaintainer); err != nil {
+		return nil, err
+	}
+
+	vs, err := model.ListSecretVar(projectid, taskid)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return nil, errInternal(err)
+	}
+	return vs, nil
+}
+
+func deleteSecret(r *http.Request, id int64) error {
+	old, err := model.GetSecretVar(id)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return errQuery(err)
+	}
+
+	if err := requireRole(r, old.ProjectId, model.RoleMaintainer); err != nil {
+		return err
+	}
+
+	if err := model.DelSecretVar(id); err != nil {
+		log.Errorf("delete sql error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "secret.delete", "secret", old.Id, old.ProjectId, old, nil)
+	return nil
+}
+
+func AddSecret(wr http.ResponseWriter, r *http.Request) {
+	v := &model.SecretVar{}
+	if err := ParseParam(r, v); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := saveSecret(r, v); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+
+	writeSuccess(wr, "save secret ok")
+}
+
+func ListSecret(wr http.ResponseWriter, r *http.Request) {
+	projectid, err := strconv.ParseInt(r.FormValue("project_id"), 10, 64)
+	if err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	// 不传 task_id 时返回工程下所有变量
+	taskid, err := strconv.ParseInt(r.FormValue("task_id"), 10, 64)
+	if err != nil {
+		taskid = -1
+	}
+
+	vs, err := listSecrets(r, projectid, taskid)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, vs)
+}
+
+func DelSecret(wr http.ResponseWriter, r *http.Request) {
+	v := &model.SecretVar{}
+	if err := ParseParam(r, v); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := deleteSecret(r, v.Id); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+
+	writeSuccess(wr, "删除成功")
+}
+
+// maskWriter 将编译输出中的 secret 替换为 ******,按行缓存避免 secret 被拆分到两次写入中
+type maskWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	secrets [][]byte
+	buf     []byte
+}
+
+// 没有换行的输出超过该长度时直接写入
+const maskBufferSize = 64 * 1024
+
+func newMaskWriter(w io.Writer, secrets []string) *maskWriter {
+	m := &maskWriter{w: w}
+	for _, s := range secrets {
+		if len(s) > 0 {
+			m.secrets = append(m.secrets, []byte(s))
+		}
+	}
+	return m
+}
+
+func (m *maskWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.buf = append(m.buf, p...)
+	i := bytes.LastIndexByte(m.buf, '\n')
+	if i < 0 && len(m.buf) < maskBufferSize {
+		return len(p), nil
+	}
+	if i < 0 {
+		i = len(m.buf) - 1
+	}
+
+	if _, err := m.w.Write(m.mask(m.buf[:i+1])); err != nil {
+		return 0, err
+	}
+	m.buf = append(m.buf[:0], m.buf[i+1:]...)
+	return len(p), nil
+}
+
+// Flush 写入剩余的不完整行
+func (m *maskWriter) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.buf) == 0 {
+		return nil
+	}
+	_, err := m.w.Write(m.mask(m.buf))
+	m.buf = m.buf[:0]
+	return err
+}
+
+func (m *maskWriter) mask(data []byte) []byte {
+	for _, s := range m.secrets {
+		data = bytes.ReplaceAll(data, s, []byte("******"))
+	}
+	return data
+}
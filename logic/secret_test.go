@@ -0,0 +1,22 @@
+package logic
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMaskWriter(t *testing.T) {
+	var out bytes.Buffer
+	m := newMaskWriter(&out, []string{"s3cret", ""})
+
+	// secret 被拆分到两次写入中
+	m.Write([]byte("token=s3c"))
+	m.Write([]byte("ret\nnext line "))
+	m.Write([]byte("s3cret"))
+	m.Flush()
+
+	want := "token=******\nnext line ******"
+	if out.String() != want {
+		t.Errorf("mask output:%q, want:%q", out.String(), want)
+	}
+}
@@ -0,0 +1,162 @@
+package logic
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/subchen/go-log"
+)
+
+// 正在进行的编译,关闭服务时等待它们完成
+var builds = struct {
+	sync.Mutex
+	wg       sync.WaitGroup
+	draining bool
+	slots    map[*buildSlot]bool
+}{slots: make(map[*buildSlot]bool)}
+
+// cancelWait 取消编译后等待编译进程退出的时间
+var cancelWait = 10 * time.Second
+
+// buildSlot 一次编译占用的位置,关闭服务或用户取消时通过 ctx 取消编译
+type buildSlot struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+	id     int64 // 编译记录 id,开始编译后设置
+
+	mu     sync.Mutex
+	reason string // 取消的原因
+}
+
+// acquireBuild 登记一次新的编译,服务正在关闭时返回错误
+func acquireBuild() (*buildSlot, error) {
+	builds.Lock()
+	defer builds.Unlock()
+
+	if builds.draining {
+		return nil, errUnavailable("server is shutting down, no new build accepted")
+	}
+
+	s := &buildSlot{}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	builds.slots[s] = true
+	builds.wg.Add(1)
+	return s, nil
+}
+
+// release 编译结束,可以重复调用
+func (s *buildSlot) release() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		builds.Lock()
+		delete(builds.slots, s)
+		builds.Unlock()
+
+		s.cancel()
+		builds.wg.Done()
+	})
+}
+
+// bind 记录正在进行的编译,用于按编译记录取消
+func (s *buildSlot) bind(id int64) {
+	if s == nil {
+		return
+	}
+	builds.Lock()
+	s.id = id
+	builds.Unlock()
+}
+
+// stop 取消编译,只记录第一次取消的原因
+func (s *buildSlot) stop(reason string) {
+	s.mu.Lock()
+	if len(s.reason) == 0 {
+		s.reason = reason
+	}
+	s.mu.Unlock()
+	s.cancel()
+}
+
+// cancelReason 取消的原因,没有记录时为关闭服务
+func (s *buildSlot) cancelReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.reason) == 0 {
+		return "server shutdown"
+	}
+	return s.reason
+}
+
+// cancelBuild 取消本机正在进行的编译,没有找到时返回 false
+func cancelBuild(id int64, reason string) bool {
+	builds.Lock()
+	defer builds.Unlock()
+	for s := range builds.slots {
+		if s.id == id {
+			s.stop(reason)
+			return true
+		}
+	}
+	return false
+}
+
+// cancelled 编译是否被取消
+func (s *buildSlot) cancelled() bool {
+	return s != nil && s.ctx.Err() != nil
+}
+
+func (s *buildSlot) context() context.Context {
+	if s == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// Shutdown 停止接收新的编译,等待正在进行的编译完成,超过 grace 后取消剩余的编译,
+// 取消后仍未退出的编译在下次启动时由 RecoverOrphans 处理
+func Shutdown(grace time.Duration) {
+	builds.Lock()
+	builds.draining = true
+	n := len(builds.slots)
+	builds.Unlock()
+
+	stopPending()
+
+	if n > 0 {
+		log.Infof("waiting %d running build to finish, grace period:%s", n, grace)
+	}
+	if waitBuilds(grace) {
+		return
+	}
+
+	builds.Lock()
+	log.Warnf("grace period exceeded, cancel %d running build", len(builds.slots))
+	for s := range builds.slots {
+		s.stop("server shutdown")
+	}
+	builds.Unlock()
+
+	if !waitBuilds(cancelWait) {
+		log.Errorf("cancelled builds not exited in %s", cancelWait)
+	}
+}
+
+// waitBuilds 等待所有编译结束,超时返回 false
+func waitBuilds(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		builds.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,66 @@
+package logic
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	defer func() {
+		builds.Lock()
+		builds.draining = false
+		builds.Unlock()
+	}()
+
+	finished, err := acquireBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stuck, err := acquireBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		finished.release()
+	}()
+	go func() {
+		// 模拟编译进程被取消后退出
+		<-stuck.ctx.Done()
+		stuck.release()
+	}()
+
+	Shutdown(50 * time.Millisecond)
+
+	// stuck 只有被取消后才会结束
+	if len(builds.slots) != 0 {
+		t.Errorf("slots:%d after shutdown", len(builds.slots))
+	}
+
+	_, err = acquireBuild()
+	if e := toApiError(err); e.Code != CodeUnavailable {
+		t.Errorf("acquire after shutdown:%v", err)
+	}
+}
+
+func TestCancelBuild(t *testing.T) {
+	s, err := acquireBuild()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.release()
+	s.bind(100)
+
+	if cancelBuild(101, "user alice") {
+		t.Error("cancel other build")
+	}
+	if !cancelBuild(100, "user alice") || !s.cancelled() {
+		t.Fatal("build not cancelled")
+	}
+	// 只记录第一次取消的原因
+	s.stop("server shutdown")
+	if reason := s.cancelReason(); reason != "user alice" {
+		t.Errorf("reason:%s", reason)
+	}
+}
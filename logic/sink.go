@@ -0,0 +1,87 @@
+package logic
+
+import (
+	"fmt"
+
+	"github.com/hash-rabbit/auto-build/model"
+	"github.com/hash-rabbit/auto-build/util"
+	"github.com/subchen/go-log"
+)
+
+// buildSink 保存编译过程中产生的状态,服务端编译时写入数据库,agent 编译时上报给服务端
+type buildSink interface {
+	secrets(t *task) ([]*model.SecretVar, error)
+	config(t *task)
+	outFile(t *task)
+	commit(t *task, c *model.TaskLog)
+	status(t *task, status int)
+	report(t *task, state string)
+	artifact(t *task) (string, error) // 保存编译结果,返回下载地址
+}
+
+// localSink 服务端编译
+type localSink struct{}
+
+func (t *task) store() buildSink {
+	if t.sink == nil {
+		return localSink{}
+	}
+	return t.sink
+}
+
+func (localSink) secrets(t *task) ([]*model.SecretVar, error) {
+	return model.ListBuildSecretVar(t.p.Id, t.t.Id)
+}
+
+func (localSink) config(t *task) {
+	if err := model.UpdateTaskLogConfig(t.id, t.cfg); err != nil {
+		log.Errorf("update task log config error:%s", err)
+	}
+}
+
+func (localSink) outFile(t *task) {
+	model.UpdateTaskLogOut(t.id, t.outfile)
+}
+
+func (localSink) commit(t *task, c *model.TaskLog) {
+	model.UpdateTaskLogCommit(t.id, c)
+}
+
+func (localSink) status(t *task, status int) {
+	model.UpdateTaskLog(t.id, status)
+}
+
+// report 将编译状态写回 git 仓库的 commit status,失败只记录日志
+func (localSink) report(t *task, state string) {
+	if len(t.sha) == 0 || len(t.p.Token) == 0 {
+		return
+	}
+
+	err := util.ReportCommitStatus(&util.CommitStatus{
+		Forge:       t.p.Forge,
+		ApiUrl:      t.p.ApiUrl,
+		RepoUrl:     t.p.Url,
+		Token:       string(t.p.Token),
+		Sha:         t.sha,
+		State:       state,
+		Context:     "auto-build/" + t.t.DestFile,
+		TargetUrl:   taskLogLink(t.id),
+		Description: fmt.Sprintf("build %s", state),
+	})
+	if err != nil {
+		log.Errorf("task log id:%d report commit status:%s error:%s", t.id, state, err)
+	}
+}
+
+// taskLogLink commit status 中的日志链接,仓库对外公开时也不能泄露编译输出,打开时需要登录
+func taskLogLink(id int64) string {
+	return fmt.Sprintf("%s/logs/%d", serverUrl(), id)
+}
+
+// TODO:查看是否输出文件,校验本地输出文件 sha2 和文件大小
+func (localSink) artifact(t *task) (string, error) {
+	url := t.artifactUrl()
+	log.Debugf("task log id:%d file url:%s", t.id, url)
+	model.UpdateTaskLogUrl(t.id, url)
+	return url, nil
+}
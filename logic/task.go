@@ -3,9 +3,9 @@ package logic
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"os/exec"
@@ -14,6 +14,8 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hash-rabbit/auto-build/config"
 	goenv "github.com/hash-rabbit/auto-build/env"
@@ -22,51 +24,66 @@ import (
 	"github.com/subchen/go-log"
 )
 
-func AddTask(wr http.ResponseWriter, r *http.Request) {
-	t := new(model.Task)
+// createTask 工程的 maintainer 可以添加任务
+func createTask(r *http.Request, t *model.Task) error {
+	log.Debugf("recv:%+v", t)
 
-	if err := ParseParam(r, t); err != nil {
-		log.Errorf("check param error:%s", err)
-		writeError(wr, "params error", err.Error())
-		return
+	if err := requireRole(r, t.ProjectId, model.RoleMaintainer); err != nil {
+		return err
 	}
-	log.Debugf("recv:%+v", t)
 
 	if err := checkTask(t); err != nil {
 		log.Errorf("check task error:%s", err)
-		writeError(wr, "check error", err.Error())
-		return
+		return legacy(err, "check error")
 	}
 
 	if _, err := model.GetProject(t.ProjectId); err != nil {
 		log.Errorf("select sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return legacy(errInvalid("project_id", err.Error()), "sql error")
 	}
 
 	if err := model.InsertTask(t); err != nil {
 		log.Errorf("insert sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return legacy(errInternal(err), "sql error")
 	}
 
-	writeSuccess(wr, "create task ok")
+	audit(r, "task.add", "task", t.Id, t.ProjectId, nil, t)
+
+	if len(t.Cron) > 0 {
+		ReloadSchedule()
+	}
+	return nil
 }
 
 func checkTask(t *model.Task) error {
 	if len(t.Branch) == 0 {
-		log.Errorf("check param error")
-		return fmt.Errorf("branch not set")
+		return errInvalid("branch", "branch not set")
 	}
 
 	if len(t.MainFile) == 0 {
-		log.Errorf("check param error")
-		return fmt.Errorf("main file not set")
+		return errInvalid("main_file", "main file not set")
 	}
 
 	if len(t.DestFile) == 0 {
-		log.Errorf("check param error")
-		return fmt.Errorf("dest file not set")
+		return errInvalid("dest_file", "dest file not set")
+	}
+
+	if t.Debounce < 0 {
+		return errInvalid("debounce", "debounce must not be negative")
+	}
+
+	if len(t.Cron) > 0 {
+		if err := goenv.CheckSpec(t.Cron); err != nil {
+			return errInvalid("cron", "cron not allowed:%s", err)
+		}
+	}
+
+	if _, err := parseSelector(t.Labels); err != nil {
+		return errInvalid("labels", err.Error())
+	}
+
+	if len(t.Image) > 0 && !imageReg.MatchString(t.Image) {
+		return errInvalid("image", "image name not allowed")
 	}
 
 	switch t.DestOs {
@@ -76,8 +93,7 @@ func checkTask(t *model.Task) error {
 	case "windows":
 	case "darwin":
 	default:
-		log.Errorf("check GOOS error")
-		return fmt.Errorf("GOOS not allowed")
+		return errInvalid("dest_os", "GOOS not allowed")
 	}
 
 	switch t.DestArch {
@@ -87,92 +103,287 @@ func checkTask(t *model.Task) error {
 	case "amd64":
 	case "arm64":
 	default:
-		log.Errorf("check GOARCH error")
-		return fmt.Errorf("GOARCH not allowed")
+		return errInvalid("dest_arch", "GOARCH not allowed")
 	}
 
 	return nil
 }
 
-func ListTask(wr http.ResponseWriter, r *http.Request) {
-	projectid, err := strconv.Atoi(r.FormValue("project_id"))
-	if err != nil {
-		log.Debugf("check param error:%s", err)
-		projectid = 0
+// listTasks projectid 为 0 时返回所有可以查看的任务
+func listTasks(r *http.Request, projectid int64) ([]*model.TaskInfo, error) {
+	if projectid > 0 {
+		if err := requireRole(r, projectid, model.RoleViewer); err != nil {
+			return nil, err
+		}
 	}
-	ts, err := model.ListTask(int64(projectid))
+
+	ts, err := model.ListTask(projectid)
 	if err != nil {
 		log.Errorf("select sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return nil, errInternal(err)
 	}
-	writeJson(wr, ts)
-}
 
-func StartTask(wr http.ResponseWriter, r *http.Request) {
-	ti, err := getTaskId(r)
+	ids, err := visibleProjectIds(r)
 	if err != nil {
 		log.Errorf("select sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return nil, errInternal(err)
+	}
+	if ids != nil {
+		visible := make([]*model.TaskInfo, 0, len(ts))
+		for _, t := range ts {
+			if containsId(ids, t.ProjectId) {
+				visible = append(visible, t)
+			}
+		}
+		ts = visible
 	}
+	return ts, nil
+}
 
-	tk, err := model.GetTask(ti)
+// startTask 手动开始编译,返回编译记录
+func startTask(r *http.Request, taskid int64) (*model.TaskLog, error) {
+	tk, err := requireTaskRole(r, taskid, model.RoleDeveloper)
 	if err != nil {
-		log.Errorf("get task error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return nil, err
 	}
 
 	p, err := model.GetProject(tk.ProjectId)
 	if err != nil {
 		log.Errorf("get project error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return nil, errQuery(err)
+	}
+
+	slot, err := acquireBuild()
+	if err != nil {
+		return nil, err
 	}
 
 	tl := &model.TaskLog{
-		TaskId: ti,
-		Status: model.Init,
+		TaskId:  taskid,
+		Status:  model.Init,
+		Trigger: model.TriggerManual,
+	}
+	if u := currentUser(r); u != nil {
+		tl.UserId = u.Id
+		tl.UserName = u.Name
 	}
 
 	err = model.InsertTaskLog(tl)
 	if err != nil {
+		slot.release()
 		log.Errorf("insert sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
+		return nil, errInternal(err)
 	}
 
+	audit(r, "task.start", "task", tk.Id, tk.ProjectId, nil, map[string]interface{}{"task_log_id": tl.Id})
+
 	t := &task{
 		id:        tl.Id,
 		goversion: p.GoVersion,
 		p:         p,
 		t:         tk,
 		tl:        tl,
+		slot:      slot,
 		files:     make([]*os.File, 0),
 	}
 
 	go t.start()
+	return tl, nil
+}
 
-	writeSuccess(wr, "start building...")
+// rebuildTaskLog 使用原编译的 commit 和配置重新编译,新的编译记录关联到原编译
+func rebuildTaskLog(r *http.Request, id int64) (*model.TaskLog, error) {
+	orig, err := model.GetTaskLog(id)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return nil, errQuery(err)
+	}
+
+	tk, err := requireTaskRole(r, orig.TaskId, model.RoleDeveloper)
+	if err != nil {
+		return nil, err
+	}
+
+	if orig.Status == model.Init || orig.Status == model.Running {
+		return nil, errConflict("task log:%d is building", orig.Id)
+	}
+	if len(orig.Commit) == 0 {
+		return nil, errConflict("task log:%d has no commit, start a new build instead", orig.Id)
+	}
+
+	p, err := model.GetProject(tk.ProjectId)
+	if err != nil {
+		log.Errorf("get project error:%s", err)
+		return nil, errQuery(err)
+	}
+
+	slot, err := acquireBuild()
+	if err != nil {
+		return nil, err
+	}
+
+	tl := &model.TaskLog{
+		TaskId:       tk.Id,
+		MergeRequest: orig.MergeRequest,
+		Ref:          orig.Ref,
+		Status:       model.Init,
+		Trigger:      model.TriggerRebuild,
+		RebuildOf:    orig.Id,
+	}
+	if u := currentUser(r); u != nil {
+		tl.UserId = u.Id
+		tl.UserName = u.Name
+	}
+	if err := model.InsertTaskLog(tl); err != nil {
+		slot.release()
+		log.Errorf("insert sql error:%s", err)
+		return nil, errInternal(err)
+	}
+	if orig.Config == nil {
+		log.Warnf("task log:%d has no config snapshot, rebuild with current config", orig.Id)
+	}
+
+	audit(r, "task.rebuild", "task", tk.Id, tk.ProjectId, nil,
+		map[string]interface{}{"task_log_id": tl.Id, "rebuild_of": orig.Id, "commit": orig.Commit})
+
+	t := &task{
+		id:    tl.Id,
+		p:     p,
+		t:     tk,
+		tl:    tl,
+		mr:    orig.MergeRequest,
+		pin:   orig.Commit,
+		cfg:   orig.Config,
+		slot:  slot,
+		files: make([]*os.File, 0),
+	}
+	go t.start()
+	return tl, nil
+}
+
+func AddTask(wr http.ResponseWriter, r *http.Request) {
+	t := new(model.Task)
+
+	if err := ParseParam(r, t); err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "params error", err.Error())
+		return
+	}
+
+	if err := createTask(r, t); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+
+	writeSuccess(wr, "create task ok")
 }
 
-func getTaskId(r *http.Request) (int64, error) {
-	param, err := checkParam(r)
+func ListTask(wr http.ResponseWriter, r *http.Request) {
+	projectid, err := strconv.Atoi(r.FormValue("project_id"))
+	if err != nil {
+		log.Debugf("check param error:%s", err)
+		projectid = 0
+	}
+
+	ts, err := listTasks(r, int64(projectid))
 	if err != nil {
+		writeV1Error(wr, legacy(err, "sql error"))
+		return
+	}
+	writeJson(wr, ts)
+}
+
+type startParam struct {
+	TaskId int64 `json:"task_id"`
+}
+
+func StartTask(wr http.ResponseWriter, r *http.Request) {
+	// 原来的接口所有错误的 code 都是 sql error
+	param := &startParam{}
+	if err := decodeBody(r, param); err != nil {
 		log.Errorf("check param error:%s", err)
-		return 0, err
+		writeV1Error(wr, legacy(err, "sql error"))
+		return
+	}
+	if param.TaskId == 0 {
+		writeV1Error(wr, legacy(errInvalid("task_id", "task_id not set"), "sql error"))
+		return
 	}
 
-	var taskid int64
-	if param["task_id"] != nil {
-		taskid = int64(param["task_id"].(float64))
-	} else {
-		log.Error("taskid is nil")
-		return 0, errors.New("task_id not allowed")
+	if _, err := startTask(r, param.TaskId); err != nil {
+		writeV1Error(wr, legacy(err, "sql error"))
+		return
+	}
+
+	writeSuccess(wr, "start building...")
+}
+
+type rebuildParam struct {
+	TaskLogId int64 `json:"task_log_id"`
+}
+
+func RebuildTaskLog(wr http.ResponseWriter, r *http.Request) {
+	param := &rebuildParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+
+	if _, err := rebuildTaskLog(r, param.TaskLogId); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "start building...")
+}
+
+// cancelTaskLog 取消等待或正在进行的编译
+func cancelTaskLog(r *http.Request, id int64) error {
+	tl, err := model.GetTaskLog(id)
+	if err != nil {
+		log.Errorf("select sql error:%s", err)
+		return errQuery(err)
+	}
+
+	tk, err := requireTaskRole(r, tl.TaskId, model.RoleDeveloper)
+	if err != nil {
+		return err
+	}
+
+	if tl.Status != model.Init && tl.Status != model.Running {
+		return errConflict("task log:%d already finished", id)
+	}
+
+	reason := "user"
+	if u := currentUser(r); u != nil {
+		reason = "user " + u.Name
+	}
+	if !cancelBuild(id, reason) {
+		// 等待 agent 和 agent 正在进行的编译没有本机的编译进程,
+		// 标记为中断后不会再分配,agent 上报输出时会取消编译
+		model.UpdateTaskLog(id, model.Interrupted)
+		appendOutput(tl.OutFilePath, "build cancelled by "+reason)
+		if t, err := agentTask(tl); err == nil {
+			t.report(util.StatusFailed)
+		}
+	}
+
+	audit(r, "task.cancel", "task", tk.Id, tk.ProjectId,
+		map[string]interface{}{"task_log_id": id, "status": tl.Status}, nil)
+	return nil
+}
+
+func CancelTaskLog(wr http.ResponseWriter, r *http.Request) {
+	param := &rebuildParam{}
+	if err := decodeBody(r, param); err != nil {
+		writeV1Error(wr, err)
+		return
 	}
 
-	return taskid, nil
+	if err := cancelTaskLog(r, param.TaskLogId); err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+	writeSuccess(wr, "build cancelled")
 }
 
 type task struct {
@@ -181,22 +392,57 @@ type task struct {
 	p         *model.Project
 	t         *model.Task
 	tl        *model.TaskLog
+	mr        int64              // merge request 编号
+	ref       string             // merge request 在 bare 仓库中的 ref,为空时编译分支
+	sha       string             // 编译的 commit
+	pin       string             // 重新编译时固定的 commit
+	cfg       *model.BuildConfig // 重新编译时使用原编译的配置,为空时使用当前配置
+	slot      *buildSlot         // 关闭服务时等待或取消编译
+	sink      buildSink          // 为空时写入本地数据库
+	exec      executor           // 执行 go build 和编译前后命令,任务设置了镜像时在容器中执行
 
 	gobin    string
 	srcfile  string
 	destfile string
+	outfile  string
+	building bool // 已经开始 go build,取消时目标文件可能不完整
 
 	files   []*os.File
 	out_log *log.Logger
+	mask    *maskWriter        // 隐藏输出中的 secret
+	secrets []*model.SecretVar // 注入到环境变量中的 secret
 
 	err error
 }
 
 func (t *task) start() {
+	t.slot.bind(t.id)
+
+	// 设置了标签的任务由 agent 编译
+	if t.sink == nil && len(t.t.Labels) > 0 {
+		t.enqueue()
+		return
+	}
+
+	defer t.slot.release()
 	defer t.checkError()
 
 	log.Infof("star build task:%d", t.id)
 
+	if t.cfg == nil {
+		t.cfg = model.NewBuildConfig(t.p, t.t)
+	} else {
+		t.cfg.Apply(t.p, t.t)
+	}
+	t.goversion = t.p.GoVersion
+	t.store().config(t)
+
+	t.secrets, t.err = t.store().secrets(t)
+	if t.err != nil {
+		log.Errorf("list secret error:%s", t.err)
+		return
+	}
+
 	t.createOutFile()
 	if t.err != nil {
 		log.Error("create out file error")
@@ -204,9 +450,43 @@ func (t *task) start() {
 	}
 	defer t.clean()
 	t.out_log.Info("create out put file success")
+	if t.tl.RebuildOf > 0 {
+		t.out_log.Infof("rebuild of task log:%d", t.tl.RebuildOf)
+	}
+
+	unlock, err := lockProject(t.slot.context(), t.p.LocalPath)
+	if err != nil {
+		t.err = err
+		return
+	}
+	defer unlock()
+	// 之前的编译异常退出时可能留下工作目录
+	os.RemoveAll(t.p.LocalPath)
+
+	ref := t.ref
+	if len(t.pin) > 0 {
+		// 重新编译时 commit 已经在 bare 仓库中,不需要 fetch
+		t.out_log.Infof("pin commit %s", t.pin)
+		ref = pinRef(t.id)
+		unpin, err := util.PinRef(getBarePath(t.p.Name), ref, t.pin)
+		if err != nil {
+			t.err = err
+			t.out_log.Error(t.err)
+			return
+		}
+		defer unpin()
+	} else if len(ref) == 0 {
+		// 先更新 bare 仓库,远端暂时无法访问时使用 bare 仓库中已有的提交编译
+		t.out_log.Infof("git fetch %s", t.p.Url)
+		if err := util.Fetch(getBarePath(t.p.Name), "origin", credential(t.p)); err != nil {
+			t.out_log.Warnf("git fetch error:%s, build from local mirror", err)
+			log.Warnf("project:%s git fetch error:%s", t.p.Name, err)
+		}
+		ref = util.RemoteBranch("origin", t.t.Branch)
+	}
 
-	t.out_log.Infof("git clone %s", t.t.Branch)
-	t.err = util.CloneSingleBranch(t.p.LocalPath, t.p.Url, t.t.Branch, t.p.Token)
+	t.out_log.Infof("git clone %s from %s", ref, getBarePath(t.p.Name))
+	t.err = util.CloneRef(t.p.LocalPath, getBarePath(t.p.Name), ref, t.dir(), nil)
 	if t.err != nil {
 		t.out_log.Error(t.err)
 		log.Error(t.err)
@@ -215,19 +495,43 @@ func (t *task) start() {
 	defer os.RemoveAll(t.p.LocalPath)
 	t.out_log.Info("git clone success")
 
-	t.gobin = path.Join(goenv.GetGoPath(t.goversion), "bin/go")
-	t.out_log.Infof("go bin:%s", t.gobin)
+	// 先记录 commit,子模块等拉取失败时也可以重新编译相同的提交
+	if t.getCommit(); t.err != nil {
+		return
+	}
 
-	t.srcfile = path.Join(t.p.LocalPath, t.t.MainFile)
-	t.out_log.Infof("src file:%s", t.srcfile)
+	// 相对路径的子模块和 lfs 都需要基于远端仓库地址
+	if t.err = util.SetRemoteUrl(t.p.LocalPath, "origin", t.p.Url); t.err != nil {
+		t.out_log.Error(t.err)
+		return
+	}
 
-	t.destfile = path.Join(config.C.DestPath, t.p.Name, t.t.Branch, t.t.DestFile)
-	t.out_log.Infof("dest file:%s", t.destfile)
+	if t.updateSubmodule(); t.err != nil {
+		return
+	}
 
-	if t.getCommit(); t.err != nil {
+	if t.lfsPull(); t.err != nil {
 		return
 	}
 
+	t.destfile = t.destPath()
+	t.out_log.Infof("dest file:%s", t.destfile)
+	os.MkdirAll(filepath.Dir(t.destfile), os.ModePerm)
+
+	t.exec = t.newExecutor()
+	defer t.exec.clean()
+	if len(t.t.Image) > 0 {
+		t.out_log.Infof("build in container, image:%s", t.t.Image)
+	}
+
+	t.gobin = t.exec.path(path.Join(goenv.GetGoPath(t.goversion), "bin/go"))
+	t.out_log.Infof("go bin:%s", t.gobin)
+
+	t.srcfile = t.exec.path(path.Join(t.p.LocalPath, t.t.MainFile))
+	t.out_log.Infof("src file:%s", t.srcfile)
+
+	t.report(util.StatusPending)
+
 	if t.pringGoEnv(); t.err != nil {
 		return
 	}
@@ -235,20 +539,27 @@ func (t *task) start() {
 	if t.runBeforeBuildCmd(); t.err != nil {
 		return
 	}
+	if t.slot.cancelled() {
+		t.err = t.slot.ctx.Err()
+		return
+	}
 
 	// go build
 	var err_out bytes.Buffer
-	c := exec.Command(t.gobin, "build", "-o", t.destfile, t.srcfile)
-	c.Dir = t.p.LocalPath
-	c.Env = t.getEnv()
+	c := t.command(t.gobin, "build", "-o", t.exec.path(t.destfile), t.srcfile)
 	c.Stdout = t.out_log.Out
 	c.Stderr = &err_out
 
 	c.Start()
-	model.UpdateTaskLog(t.id, model.Running)
+	t.building = true
+	t.store().status(t, model.Running)
+	t.report(util.StatusRunning)
 	t.out_log.Info("start building")
 
-	c.Wait()
+	if err := c.Wait(); err != nil && t.slot.cancelled() {
+		t.err = err
+		return
+	}
 	if c.Err != nil {
 		t.err = c.Err
 		return
@@ -264,19 +575,43 @@ func (t *task) start() {
 		return
 	}
 
-	// TODO:查看是否输出文件,校验本地输出文件 sha2 和文件大小
-	ip, err := util.GetLocalIp()
+	url, err := t.store().artifact(t)
 	if err != nil {
-		log.Errorf("get local ip error:%s", err)
-		ip = "127.0.0.1"
+		t.err = err
+		t.out_log.Error(err)
+		return
 	}
-	url := fmt.Sprintf("http://%s:%d/output/%s/%s/%s", ip, config.C.Port, t.p.Name, t.t.Branch, t.t.DestFile)
-	log.Debugf("task log id:%d file url:%s", t.id, url)
-	model.UpdateTaskLogUrl(t.id, url)
-
 	t.out_log.Infof("task log id:%d file url:%s", t.id, url)
 }
 
+// artifactUrl 编译结果的下载地址
+func (t *task) artifactUrl() string {
+	return fmt.Sprintf("%s/output/%s/%s/%s", serverUrl(), t.p.Name, t.dir(), t.t.DestFile)
+}
+
+// destPath 编译结果的保存路径
+func (t *task) destPath() string {
+	return path.Join(config.C.DestPath, t.p.Name, t.dir(), t.t.DestFile)
+}
+
+// outFilePath 编译输出的保存路径
+func (t *task) outFilePath() string {
+	return path.Join(config.C.RecordPath, t.p.Name, t.dir(), fmt.Sprintf("%s.%d.out.log", t.t.DestFile, t.id))
+}
+
+// pinRef 重新编译时 bare 仓库中指向固定 commit 的 ref
+func pinRef(id int64) string {
+	return fmt.Sprintf("refs/auto-build/pin/%d", id)
+}
+
+// dir 编译产物和日志所在的子目录,merge request 的编译与分支编译分开存放
+func (t *task) dir() string {
+	if t.mr > 0 {
+		return fmt.Sprintf("mr-%d", t.mr)
+	}
+	return t.t.Branch
+}
+
 func readline(str string) []string {
 	resu := make([]string, 0)
 	scanner := bufio.NewScanner(strings.NewReader(str))
@@ -286,21 +621,35 @@ func readline(str string) []string {
 	return resu
 }
 
+// command 在代码目录中执行命令,路径参数需要先经过 t.exec.path 转换
+func (t *task) command(name string, args ...string) *exec.Cmd {
+	return t.exec.command(t.slot.context(), t.p.LocalPath, t.getEnv(), name, args...)
+}
+
+// getEnv 编译使用的环境变量,主机上执行时会加上服务端的环境变量
 func (t *task) getEnv() []string {
-	env := os.Environ()
+	env := make([]string, 0)
 	if t.p.GoMod {
 		env = append(env, "GO111MODULE=on")
 	} else {
 		env = append(env, "GO111MODULE=off")
 	}
-	env = append(env, "GOBIN="+goenv.GetGoPath(t.goversion))
-	env = append(env, "GOPATH="+t.p.WorkSpace)
-	env = append(env, "GOPROXY=https://goproxy.cn,direct")
-	env = append(env, "GOCACHE="+path.Join(t.p.WorkSpace, ".cache/"))
+	env = append(env, "GOBIN="+t.exec.path(goenv.GetGoPath(t.goversion)))
+	proxy := "https://goproxy.cn,direct"
+	if e, ok := t.exec.(*containerExecutor); ok {
+		env = append(env, e.goEnv(proxy)...)
+	} else {
+		env = append(env, "GOPATH="+t.p.WorkSpace)
+		env = append(env, "GOPROXY="+proxy)
+		env = append(env, "GOCACHE="+path.Join(t.p.WorkSpace, ".cache"))
+	}
 	env = append(env, "GOOS="+t.t.DestOs)
 	env = append(env, "GOARCH="+t.t.DestArch)
 	env = append(env, readline(t.p.Env)...)
 	env = append(env, readline(t.t.Env)...)
+	for _, s := range t.secrets {
+		env = append(env, s.Name+"="+string(s.Value))
+	}
 	return env
 }
 
@@ -317,16 +666,52 @@ func (t *task) getCommit() {
 		t.err = errors.New("couldn't find git log")
 		return
 	}
-	model.UpdateTaskLogDescription(t.id, ls[0].Commit)
+	c := ls[0]
+	t.sha = c.Sha1
+	t.store().commit(t, &model.TaskLog{
+		Commit:      c.Sha1,
+		ShortSha:    util.ShortSha(c.Sha1),
+		Author:      c.Author,
+		CommitTime:  c.CommitTime,
+		Subject:     c.Subject,
+		Description: c.Commit,
+	})
+	t.out_log.Infof("commit %s %s: %s", util.ShortSha(c.Sha1), c.Author, c.Subject)
 	t.out_log.Info("git get commmit log success")
 }
 
+func (t *task) updateSubmodule() {
+	if !t.p.Submodule {
+		return
+	}
+
+	t.out_log.Info("git submodule update --init --recursive")
+	t.err = util.UpdateSubmodules(t.p.LocalPath, credential(t.p), t.out_log.Out)
+	if t.err != nil {
+		t.out_log.Error(t.err)
+		return
+	}
+	t.out_log.Info("git submodule update success")
+}
+
+func (t *task) lfsPull() {
+	if !t.p.Lfs {
+		return
+	}
+
+	t.out_log.Info("git lfs pull")
+	t.err = util.LfsPull(t.p.LocalPath, t.p.Url, credential(t.p), t.out_log.Out)
+	if t.err != nil {
+		t.out_log.Error(t.err)
+		return
+	}
+	t.out_log.Info("git lfs pull success")
+}
+
 func (t *task) goGet() {
 	// go get -insecure
 	var stderr bytes.Buffer
-	goget := exec.Command(t.gobin, "get", "-insecure", "./...")
-	goget.Dir = t.p.LocalPath
-	goget.Env = t.getEnv()
+	goget := t.command(t.gobin, "get", "-insecure", "./...")
 	goget.Stdout = t.out_log.Out
 	goget.Stderr = &stderr
 	t.out_log.Info(goget.String())
@@ -344,8 +729,7 @@ func (t *task) goGet() {
 }
 
 func (t *task) pringGoEnv() {
-	goenv := exec.Command(t.gobin, "env")
-	goenv.Dir = t.p.LocalPath
+	goenv := t.command(t.gobin, "env")
 	out, err := goenv.CombinedOutput()
 	if err != nil {
 		t.out_log.Error(t.err)
@@ -378,9 +762,7 @@ func (t *task) runCmd(cmdstr string) {
 	}
 
 	var stderr bytes.Buffer
-	c := exec.Command("/bin/sh", f.Name())
-	c.Dir = t.p.LocalPath
-	c.Env = t.getEnv()
+	c := t.command("/bin/sh", t.exec.path(f.Name()))
 	c.Stdout = t.out_log.Out
 	c.Stderr = &stderr
 
@@ -398,10 +780,9 @@ func (t *task) runCmd(cmdstr string) {
 }
 
 func (t *task) createOutFile() {
-	outfilepath := path.Join(config.C.RecordPath, t.p.Name, t.t.Branch,
-		fmt.Sprintf("%s.%d.out.log", t.t.DestFile, t.id))
-	model.UpdateTaskLogOut(t.id, outfilepath)
-	t.out_log, t.err = t.newLog(outfilepath)
+	t.outfile = t.outFilePath()
+	t.store().outFile(t)
+	t.out_log, t.err = t.newLog(t.outfile)
 }
 
 func (t *task) newLog(filename string) (*log.Logger, error) {
@@ -411,8 +792,14 @@ func (t *task) newLog(filename string) (*log.Logger, error) {
 	}
 	t.files = append(t.files, outfile)
 
+	secrets := []string{string(t.p.Token)}
+	for _, s := range t.secrets {
+		secrets = append(secrets, string(s.Value))
+	}
+	t.mask = newMaskWriter(outfile, secrets)
+
 	l := log.New()
-	l.Out = outfile
+	l.Out = t.mask
 
 	return l, nil
 }
@@ -423,91 +810,351 @@ func newLogFile(filename string) (*os.File, error) {
 }
 
 func (t *task) checkError() {
+	if t.slot.cancelled() {
+		reason := t.slot.cancelReason()
+		log.Warnf("build taskid:%d cancelled by %s", t.id, reason)
+		appendOutput(t.outfile, "build cancelled by "+reason)
+		if t.exec != nil {
+			t.exec.stop()
+		}
+		if t.building {
+			os.Remove(t.destfile)
+		}
+		t.store().status(t, model.Interrupted)
+		t.report(util.StatusFailed)
+		return
+	}
+
 	if t.err != nil {
 		log.Infof("build taskid:%d failed", t.id)
-		model.UpdateTaskLog(t.id, model.Failed)
+		t.store().status(t, model.Failed)
+		t.report(util.StatusFailed)
 	} else {
 		log.Infof("build taskid:%d success", t.id)
-		model.UpdateTaskLog(t.id, model.Success)
+		t.store().status(t, model.Success)
+		t.report(util.StatusSuccess)
 	}
 }
 
+func (t *task) report(state string) {
+	t.store().report(t, state)
+}
+
 func (t *task) clean() {
+	if t.mask != nil {
+		t.mask.Flush()
+	}
 	for _, v := range t.files {
 		v.Close()
 	}
 }
 
-// TODO:尝试编译的时候加锁
-func tryLock() {
+// 同一个工程的编译使用相同的工作目录,依次编译,key 为工作目录
+var projectLocks sync.Map
+
+// lockProject 等待同一个工作目录上的其他编译结束,编译取消时返回错误
+func lockProject(ctx context.Context, path string) (func(), error) {
+	v, _ := projectLocks.LoadOrStore(path, make(chan struct{}, 1))
+	ch := v.(chan struct{})
+	select {
+	case ch <- struct{}{}:
+		return func() { <-ch }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+var triggers = []string{model.TriggerManual, model.TriggerPush, model.TriggerMergeRequest, model.TriggerCron, model.TriggerPoll, model.TriggerRebuild}
+
+// parseTaskLogFilter 解析编译记录的查询参数,没有 merge_request 参数时使用 mr
+func parseTaskLogFilter(r *http.Request, mr int64) (*model.TaskLogFilter, error) {
+	f := &model.TaskLogFilter{
+		Branch:  r.FormValue("branch"),
+		Commit:  r.FormValue("commit"),
+		Trigger: r.FormValue("trigger"),
+		User:    r.FormValue("user"),
+		Sort:    r.FormValue("sort"),
+	}
+
+	var err error
+	if f.ProjectId, err = queryInt(r, "project_id", 0); err != nil {
+		return nil, err
+	}
+	if f.TaskId, err = queryInt(r, "task_id", 0); err != nil {
+		return nil, err
+	}
+	if f.MergeRequest, err = queryInt(r, "merge_request", mr); err != nil {
+		return nil, err
+	}
+
+	status, err := queryInt(r, "status", -1)
+	if err != nil {
+		return nil, err
+	}
+	if status > model.Interrupted {
+		return nil, errInvalid("status", "must be 0-4")
+	}
+	f.Status = int(status)
+
+	if len(f.Trigger) > 0 && !containsString(triggers, f.Trigger) {
+		return nil, errInvalid("trigger", "must be one of %s", strings.Join(triggers, ","))
+	}
+	if err := model.CheckTaskLogSort(f.Sort); err != nil {
+		return nil, errInvalid("sort", err.Error())
+	}
+
+	if f.Start, f.End, err = parseDateRange(r); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// dropInvalidInt 删除不是整数的查询参数
+func dropInvalidInt(r *http.Request, names ...string) {
+	q := r.URL.Query()
+	for _, n := range names {
+		if _, err := strconv.ParseInt(q.Get(n), 10, 64); err != nil {
+			q.Del(n)
+		}
+	}
+	r.URL.RawQuery = q.Encode()
+}
 
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
-func ListTaskLog(wr http.ResponseWriter, r *http.Request) {
-	projectid, err := strconv.ParseInt(r.FormValue("project_id"), 10, 64)
+// listTaskLogs 只返回当前用户可以查看的工程的编译记录
+func listTaskLogs(r *http.Request, f *model.TaskLogFilter, limit, offset int) ([]*model.TaskLogInfo, int64, error) {
+	ids, err := visibleProjectIds(r)
 	if err != nil {
-		log.Warnf("check param error:%s", err)
-		projectid = 0
+		log.Errorf("select sql error:%s", err)
+		return nil, 0, errInternal(err)
 	}
+	f.ProjectIds = ids
 
-	taskid, err := strconv.ParseInt(r.FormValue("task_id"), 10, 64)
+	ts, total, err := model.ListTaskLog(f, limit, offset)
 	if err != nil {
-		log.Warnf("check param error:%s", err)
-		taskid = 0
+		log.Errorf("select sql error:%s", err)
+		return nil, 0, errInternal(err)
 	}
+	return ts, total, nil
+}
 
-	limit, err := strconv.Atoi(r.FormValue("page_size"))
+func getTaskLog(r *http.Request, id int64) (*model.TaskLog, error) {
+	tl, err := model.GetTaskLog(id)
 	if err != nil {
-		log.Warnf("check param error:%s", err)
-		limit = 20
+		log.Errorf("select sql error:%s", err)
+		return nil, errQuery(err)
 	}
 
-	offset, err := strconv.Atoi(r.FormValue("page_num"))
+	// 使用编译记录中的工程校验,任务删除后仍然可以查看
+	if err := requireRole(r, tl.ProjectId, model.RoleViewer); err != nil {
+		return nil, err
+	}
+	return tl, nil
+}
+
+// taskLogOutput 编译过程的输出
+func taskLogOutput(r *http.Request, id int64) (string, error) {
+	tl, err := getTaskLog(r, id)
 	if err != nil {
-		log.Warnf("check param error:%s", err)
-		offset = 0
+		return "", legacy(err, "sql error")
 	}
 
-	ts, err := model.ListTaskLog(projectid, taskid, limit, offset)
+	data, err := os.ReadFile(tl.OutFilePath)
+	if err != nil {
+		log.Errorf("logic error:%s", err)
+		return "", legacy(errNotFound("%s", err), "logic error")
+	}
+	return string(data), nil
+}
+
+// changelog 本次编译和上一次成功编译之间的提交
+type changelog struct {
+	From       int64              `json:"from"` // 上一次成功编译的记录,0 为没有
+	FromCommit string             `json:"from_commit"`
+	ToCommit   string             `json:"to_commit"`
+	Commits    []*changelogCommit `json:"commits"`
+	More       bool               `json:"more"` // 提交超过 changelogLimit 个
+}
+
+type changelogCommit struct {
+	Sha        string    `json:"sha"`
+	ShortSha   string    `json:"short_sha"`
+	Author     string    `json:"author"`
+	Email      string    `json:"email"`
+	CommitTime time.Time `json:"commit_time"`
+	Subject    string    `json:"subject"`
+}
+
+const changelogLimit = 100
+
+// taskLogChangelog 使用 bare 仓库列出本次编译和同一任务上一次成功的分支编译之间的提交,
+// 没有成功编译时返回最近的提交
+func taskLogChangelog(r *http.Request, id int64) (*changelog, error) {
+	tl, err := getTaskLog(r, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(tl.Commit) == 0 {
+		return nil, errConflict("task log:%d has no commit", tl.Id)
+	}
+
+	tk, err := model.GetTask(tl.TaskId)
+	if err != nil {
+		log.Errorf("get task error:%s", err)
+		return nil, errQuery(err)
+	}
+	p, err := model.GetProject(tk.ProjectId)
+	if err != nil {
+		log.Errorf("get project error:%s", err)
+		return nil, errQuery(err)
+	}
+
+	cl := &changelog{ToCommit: tl.Commit, Commits: make([]*changelogCommit, 0)}
+	prev, err := model.GetPrevSuccessTaskLog(tl)
+	if err == nil {
+		cl.From = prev.Id
+		cl.FromCommit = prev.Commit
+	} else if !errors.Is(err, model.ErrNotFound) {
+		log.Errorf("select sql error:%s", err)
+		return nil, errQuery(err)
+	}
+
+	cs, more, err := util.CommitRange(getBarePath(p.Name), cl.FromCommit, cl.ToCommit, changelogLimit)
+	if err != nil {
+		log.Errorf("task log:%d changelog error:%s", tl.Id, err)
+		return nil, errGit(err)
+	}
+	for _, c := range cs {
+		cl.Commits = append(cl.Commits, &changelogCommit{
+			Sha:        c.Sha1,
+			ShortSha:   util.ShortSha(c.Sha1),
+			Author:     c.Author,
+			Email:      c.Email,
+			CommitTime: c.CommitTime,
+			Subject:    c.Subject,
+		})
+	}
+	cl.More = more
+	return cl, nil
+}
+
+func setTaskAutoBuild(r *http.Request, id int64, auto bool) error {
+	old, err := requireTaskRole(r, id, model.RoleMaintainer)
+	if err != nil {
+		return err
+	}
+
+	err = model.UpdateTaskAutoBuild(id, auto)
 	if err != nil {
 		log.Errorf("select sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
+		return errInternal(err)
+	}
+
+	audit(r, "task.auto_build", "task", old.Id, old.ProjectId,
+		map[string]interface{}{"auto_build": old.AutoBuild}, map[string]interface{}{"auto_build": auto})
+	return nil
+}
+
+func deleteTask(r *http.Request, id int64) error {
+	old, err := requireTaskRole(r, id, model.RoleMaintainer)
+	if err != nil {
+		return err
+	}
+
+	err = model.DelTask(id)
+	if err != nil {
+		log.Errorf("delete sql error:%s", err)
+		return errInternal(err)
+	}
+
+	audit(r, "task.delete", "task", old.Id, old.ProjectId, old, nil)
+
+	ReloadSchedule()
+	return nil
+}
+
+func ListTaskLog(wr http.ResponseWriter, r *http.Request) {
+	// 原来的接口这些参数格式错误时使用默认值
+	dropInvalidInt(r, "project_id", "task_id", "page_size", "page_num")
+
+	// 默认和原来一样返回所有编译,只查分支编译时指定 merge_request=0
+	f, err := parseTaskLogFilter(r, -1)
+	if err != nil {
+		writeV1Error(wr, err)
+		return
+	}
+
+	limit, offset, err := queryPage(r)
+	if err != nil {
+		writeV1Error(wr, err)
 		return
 	}
 
+	ts, total, err := listTaskLogs(r, f, limit, offset)
+	if err != nil {
+		writeV1Error(wr, legacy(err, "sql error"))
+		return
+	}
+
+	wr.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	wr.Header().Set("Access-Control-Expose-Headers", "X-Total-Count")
 	writeJson(wr, ts)
 }
 
-func GetTaskLogOutput(wr http.ResponseWriter, r *http.Request) {
-	recordid, err := strconv.Atoi(r.FormValue("task_log_id"))
+// GetTaskLogInfo 编译记录详情,包含编译时的配置快照
+func GetTaskLogInfo(wr http.ResponseWriter, r *http.Request) {
+	id, err := queryInt(r, "task_log_id", 0)
 	if err != nil {
-		log.Errorf("check param error:%s", err)
-		writeError(wr, "check param error", err.Error())
+		writeV1Error(wr, err)
 		return
 	}
 
-	tl, err := model.GetTaskLog(int64(recordid))
+	tl, err := getTaskLog(r, id)
 	if err != nil {
-		log.Errorf("select sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
+		writeV1Error(wr, err)
 		return
 	}
+	writeJson(wr, tl)
+}
 
-	f, err := os.Open(tl.OutFilePath)
+func GetTaskLogChangelog(wr http.ResponseWriter, r *http.Request) {
+	id, err := queryInt(r, "task_log_id", 0)
 	if err != nil {
-		log.Errorf("logic error:%s", err)
-		writeError(wr, "logic error", err.Error())
+		writeV1Error(wr, err)
 		return
 	}
 
-	data, err := io.ReadAll(f)
+	cl, err := taskLogChangelog(r, id)
 	if err != nil {
-		log.Errorf("logic error:%s", err)
-		writeError(wr, "logic error", err.Error())
+		writeV1Error(wr, err)
+		return
+	}
+	writeJson(wr, cl)
+}
+
+func GetTaskLogOutput(wr http.ResponseWriter, r *http.Request) {
+	recordid, err := strconv.Atoi(r.FormValue("task_log_id"))
+	if err != nil {
+		log.Errorf("check param error:%s", err)
+		writeError(wr, "check param error", err.Error())
+		return
+	}
+
+	out, err := taskLogOutput(r, int64(recordid))
+	if err != nil {
+		writeV1Error(wr, err)
 		return
 	}
 
-	writeJson(wr, string(data))
+	writeJson(wr, out)
 }
 
 func SetTaskAutoBuild(wr http.ResponseWriter, r *http.Request) {
@@ -517,10 +1164,8 @@ func SetTaskAutoBuild(wr http.ResponseWriter, r *http.Request) {
 		log.Debugf("check param error:%s", err)
 	}
 
-	err = model.UpdateTaskAutoBuild(t.Id, t.AutoBuild)
-	if err != nil {
-		log.Errorf("select sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
+	if err := setTaskAutoBuild(r, t.Id, t.AutoBuild); err != nil {
+		writeV1Error(wr, legacy(err, "sql error"))
 		return
 	}
 	writeSuccess(wr, "更新成功")
@@ -535,17 +1180,8 @@ func DelTask(wr http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = model.GetTask(t.Id)
-	if err != nil {
-		log.Errorf("select sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
-		return
-	}
-
-	err = model.DelTask(t.Id)
-	if err != nil {
-		log.Errorf("delete sql error:%s", err)
-		writeError(wr, "sql error", err.Error())
+	if err := deleteTask(r, t.Id); err != nil {
+		writeV1Error(wr, legacy(err, "sql error"))
 		return
 	}
 
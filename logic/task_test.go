@@ -0,0 +1,82 @@
+package logic
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hash-rabbit/auto-build/model"
+)
+
+// TestDeletedTaskLog 删除任务后工程成员仍然可以查看编译记录的配置快照
+func TestDeletedTaskLog(t *testing.T) {
+	dir := initTestDB(t)
+
+	p := &model.Project{Name: "deleted", LocalPath: filepath.Join(dir, "deleted")}
+	if err := model.InsertProject(p); err != nil {
+		t.Fatal(err)
+	}
+	tk := &model.Task{ProjectId: p.Id, Branch: "master", MainFile: "main.go", DestFile: "demo"}
+	if err := model.InsertTask(tk); err != nil {
+		t.Fatal(err)
+	}
+	tl := &model.TaskLog{TaskId: tk.Id, Status: model.Success, Config: model.NewBuildConfig(p, tk)}
+	if err := model.InsertTaskLog(tl); err != nil {
+		t.Fatal(err)
+	}
+	if tl.ProjectId != p.Id {
+		t.Fatalf("task log project:%d, want:%d", tl.ProjectId, p.Id)
+	}
+
+	viewer := &model.User{Id: 2, Name: "viewer"}
+	if err := model.SaveProjectMember(&model.ProjectMember{ProjectId: p.Id, UserId: viewer.Id, Role: model.RoleViewer}); err != nil {
+		t.Fatal(err)
+	}
+	if err := model.DelTask(tk.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	r := withUser(httptest.NewRequest(http.MethodGet, "/api/v2/task-logs/1", nil), viewer)
+	got, err := getTaskLog(r, tl.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Config == nil || got.Config.ProjectName != p.Name || got.Config.DestFile != "demo" {
+		t.Errorf("config:%+v", got.Config)
+	}
+
+	// 其他工程的成员不能查看
+	other := withUser(httptest.NewRequest(http.MethodGet, "/api/v2/task-logs/1", nil), &model.User{Id: 3, Name: "other"})
+	if _, err := getTaskLog(other, tl.Id); toApiError(err).Code != CodeForbidden {
+		t.Errorf("other user error:%v", err)
+	}
+}
+
+func TestLockProject(t *testing.T) {
+	unlock, err := lockProject(context.Background(), "/work/demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一个工作目录的编译等待,取消时返回
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := lockProject(ctx, "/work/demo"); err == nil {
+		t.Fatal("lock same project twice")
+	}
+	other, err := lockProject(context.Background(), "/work/other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	unlock()
+	unlock, err = lockProject(context.Background(), "/work/demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+}
@@ -1,23 +1,225 @@
 package logic
 
 import (
+	"fmt"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/hash-rabbit/auto-build/model"
+	"github.com/hash-rabbit/auto-build/util"
 	"github.com/subchen/go-log"
 )
 
 var (
 	KIND_PUSH = "push"
 	KIND_TAG  = "tag_push"
+	KIND_MR   = "merge_request" // gitlab
+	KIND_PR   = "pull_request"  // github
 )
 
+// 提交信息中包含以下标记时不触发自动编译
+var skipMarkers = []string{"[skip ci]", "[ci skip]"}
+
 type Event struct {
-	ObjectKind string `json:"object_kind"`
-	Ref        string `json:"ref"`
+	ObjectKind  string    `json:"object_kind"`
+	Ref         string    `json:"ref"`
+	CheckoutSha string    `json:"checkout_sha"` // gitlab
+	Before      string    `json:"before"`
+	After       string    `json:"after"`
+	Commits     []*Commit `json:"commits"`
+	HeadCommit  *Commit   `json:"head_commit"` // github
+
+	UserUsername string     `json:"user_username"` // gitlab push
+	User         *EventUser `json:"user"`          // gitlab merge request
+	Pusher       *EventUser `json:"pusher"`        // github push
+	Sender       *EventUser `json:"sender"`        // github
+
+	Action           string            `json:"action"`            // github pull request
+	ObjectAttributes *MergeRequestAttr `json:"object_attributes"` // gitlab merge request
+	PullRequest      *PullRequest      `json:"pull_request"`      // github pull request
+}
+
+type Commit struct {
+	Id      string `json:"id"`
+	Message string `json:"message"`
+}
+
+type EventUser struct {
+	Name     string `json:"name"`
+	Username string `json:"username"` // gitlab
+	Login    string `json:"login"`    // github sender
+}
+
+type MergeRequestAttr struct {
+	Iid          int64   `json:"iid"`
+	Action       string  `json:"action"`
+	SourceBranch string  `json:"source_branch"`
+	TargetBranch string  `json:"target_branch"`
+	OldRev       string  `json:"oldrev"` // 只有推送了新提交的 update 才有
+	LastCommit   *Commit `json:"last_commit"`
+}
+
+type PullRequest struct {
+	Number int64          `json:"number"`
+	Head   PullRequestRef `json:"head"`
+	Base   PullRequestRef `json:"base"`
+}
+
+type PullRequestRef struct {
+	Ref string `json:"ref"`
+	Sha string `json:"sha"`
+}
+
+// headCommit 返回本次 push 后分支指向的提交
+func (e *Event) headCommit() *Commit {
+	if e.HeadCommit != nil {
+		return e.HeadCommit
+	}
+
+	head := e.CheckoutSha
+	if len(head) == 0 {
+		head = e.After
+	}
+	for _, c := range e.Commits {
+		if c.Id == head {
+			return c
+		}
+	}
+
+	if len(e.Commits) > 0 {
+		return e.Commits[len(e.Commits)-1]
+	}
+	return nil
+}
+
+// pushedBy 返回推送或创建 merge request 的用户名
+func (e *Event) pushedBy() string {
+	switch {
+	case len(e.UserUsername) > 0:
+		return e.UserUsername
+	case e.User != nil && len(e.User.Username) > 0:
+		return e.User.Username
+	case e.Sender != nil && len(e.Sender.Login) > 0:
+		return e.Sender.Login
+	case e.Pusher != nil:
+		return e.Pusher.Name
+	}
+	return ""
+}
+
+// deliveryId 返回 webhook 请求的唯一 id
+func deliveryId(r *http.Request) string {
+	for _, h := range []string{"X-Gitlab-Event-UUID", "X-GitHub-Delivery", "X-Gitea-Delivery"} {
+		if id := r.Header.Get(h); len(id) > 0 {
+			return id
+		}
+	}
+	return ""
+}
+
+// source 触发编译的来源,记录到编译记录中
+type source struct {
+	trigger  string
+	delivery string
+	pushedBy string
+	before   string
+	after    string
+}
+
+// webhookSource 从 webhook 请求中获取编译来源
+func webhookSource(r *http.Request, e *Event, trigger string) *source {
+	src := &source{
+		trigger:  trigger,
+		delivery: deliveryId(r),
+		pushedBy: e.pushedBy(),
+		before:   e.Before,
+		after:    e.After,
+	}
+	if len(e.CheckoutSha) > 0 {
+		src.after = e.CheckoutSha
+	}
+
+	if a := e.ObjectAttributes; a != nil {
+		src.before = a.OldRev
+		if a.LastCommit != nil {
+			src.after = a.LastCommit.Id
+		}
+	}
+	if pr := e.PullRequest; pr != nil && len(src.after) == 0 {
+		src.after = pr.Head.Sha
+	}
+	return src
+}
+
+func (s *source) apply(tl *model.TaskLog) {
+	tl.Trigger = s.trigger
+	tl.DeliveryId = s.delivery
+	tl.PushedBy = s.pushedBy
+	tl.BeforeSha = s.before
+	tl.AfterSha = s.after
+}
+
+type mergeRequest struct {
+	id      int64
+	ref     string // 远端仓库中 merge request 的 ref
+	target  string // 目标分支
+	message string
+}
+
+// mergeRequest 解析 merge request/pull request 事件,不需要编译的事件(关闭,合并,修改标题等)返回 nil
+func (e *Event) mergeRequest() *mergeRequest {
+	if a := e.ObjectAttributes; a != nil {
+		switch a.Action {
+		case "open", "reopen":
+		case "update":
+			if len(a.OldRev) == 0 {
+				return nil
+			}
+		default:
+			return nil
+		}
+
+		mr := &mergeRequest{
+			id:     a.Iid,
+			ref:    fmt.Sprintf("refs/merge-requests/%d/head", a.Iid),
+			target: a.TargetBranch,
+		}
+		if a.LastCommit != nil {
+			mr.message = a.LastCommit.Message
+		}
+		return mr
+	}
+
+	if pr := e.PullRequest; pr != nil {
+		switch e.Action {
+		case "opened", "reopened", "synchronize":
+		default:
+			return nil
+		}
+
+		return &mergeRequest{
+			id:     pr.Number,
+			ref:    fmt.Sprintf("refs/pull/%d/head", pr.Number),
+			target: pr.Base.Ref,
+		}
+	}
+
+	return nil
+}
+
+func skipCI(message string) bool {
+	message = strings.ToLower(message)
+	for _, m := range skipMarkers {
+		if strings.Contains(message, m) {
+			return true
+		}
+	}
+	return false
 }
 
 func DoWebHook(wr http.ResponseWriter, r *http.Request) {
@@ -43,12 +245,24 @@ func DoWebHook(wr http.ResponseWriter, r *http.Request) {
 	}
 	log.Debugf("recv webhook:%+v", e)
 
-	if e.ObjectKind != KIND_PUSH {
-		log.Errorf("event kind not push:%s", e.ObjectKind)
-		writeError(wr, "params error", "event kind not push")
-		return
+	// github 的事件类型在 header 中
+	kind := e.ObjectKind
+	if len(kind) == 0 {
+		kind = r.Header.Get("X-GitHub-Event")
+	}
+
+	switch kind {
+	case KIND_PUSH:
+		doPush(wr, r, p, e)
+	case KIND_MR, KIND_PR:
+		doMergeRequest(wr, r, p, e)
+	default:
+		log.Errorf("event kind not supported:%s", kind)
+		writeError(wr, "params error", "event kind not supported")
 	}
+}
 
+func doPush(wr http.ResponseWriter, r *http.Request, p *model.Project, e *Event) {
 	branch := getBranch(e.Ref)
 	if len(branch) == 0 {
 		log.Errorf("parse branch form refs error:%s", e.Ref)
@@ -56,6 +270,12 @@ func DoWebHook(wr http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if c := e.headCommit(); c != nil && skipCI(c.Message) {
+		log.Infof("project:%s branch:%s commit:%s skip ci", p.Name, branch, c.Id)
+		writeSuccess(wr, "skip ci")
+		return
+	}
+
 	ts, err := model.ListTask(p.Id)
 	if err != nil {
 		log.Errorf("get project error:%s", err)
@@ -63,7 +283,42 @@ func DoWebHook(wr http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	go startBuild(ts, branch)
+	after := map[string]interface{}{"branch": branch}
+	if c := e.headCommit(); c != nil {
+		after["commit"] = c.Id
+	}
+	audit(r, "webhook.push", "project", p.Id, p.Id, nil, after)
+
+	go startBuild(ts, branch, webhookSource(r, e, model.TriggerPush))
+
+	writeSuccess(wr, "success")
+}
+
+func doMergeRequest(wr http.ResponseWriter, r *http.Request, p *model.Project, e *Event) {
+	mr := e.mergeRequest()
+	if mr == nil {
+		log.Debugf("project:%s ignore merge request event", p.Name)
+		writeSuccess(wr, "ignore")
+		return
+	}
+
+	if skipCI(mr.message) {
+		log.Infof("project:%s merge request:%d skip ci", p.Name, mr.id)
+		writeSuccess(wr, "skip ci")
+		return
+	}
+
+	ts, err := model.ListTask(p.Id)
+	if err != nil {
+		log.Errorf("get project error:%s", err)
+		writeError(wr, "logic error", err.Error())
+		return
+	}
+
+	audit(r, "webhook.merge_request", "project", p.Id, p.Id, nil,
+		map[string]interface{}{"merge_request": mr.id, "target": mr.target})
+
+	go startMergeRequestBuild(p, ts, mr, webhookSource(r, e, model.TriggerMergeRequest))
 
 	writeSuccess(wr, "success")
 }
@@ -75,23 +330,112 @@ func getBranch(ref string) string {
 	return ""
 }
 
-func startBuild(ts []*model.TaskInfo, branch string) {
+func startBuild(ts []*model.TaskInfo, branch string, src *source) {
 	for _, t := range ts {
 		if t.Branch == branch && t.AutoBuild {
-			autobuild(t.Id)
+			taskid := t.Id
+			debounceBuild(strconv.FormatInt(taskid, 10), t.Debounce, func() {
+				autobuild(taskid, src, nil)
+			})
+		}
+	}
+}
+
+// startMergeRequestBuild 将 merge request 拉取到 bare 仓库,然后使用目标分支的任务配置编译
+func startMergeRequestBuild(p *model.Project, ts []*model.TaskInfo, mr *mergeRequest, src *source) {
+	err := util.FetchRef(getBarePath(p.Name), "origin", mr.ref, credential(p))
+	if err != nil {
+		log.Errorf("fetch %s error:%s", mr.ref, err)
+		return
+	}
+
+	// github 的 pull request 事件中没有提交信息,从 bare 仓库中读取
+	if len(mr.message) == 0 {
+		msg, err := util.RefMessage(getBarePath(p.Name), mr.ref)
+		if err != nil {
+			log.Warnf("read %s commit message error:%s", mr.ref, err)
+		}
+		if skipCI(msg) {
+			log.Infof("project:%s merge request:%d skip ci", p.Name, mr.id)
+			return
+		}
+	}
+
+	for _, t := range ts {
+		if t.Branch == mr.target && t.AutoBuild {
+			taskid := t.Id
+			debounceBuild(fmt.Sprintf("%d-mr-%d", taskid, mr.id), t.Debounce, func() {
+				autobuild(taskid, src, mr)
+			})
 		}
 	}
 }
 
-func autobuild(taskid int64) {
+// 等待防抖的编译
+var pending = struct {
+	sync.Mutex
+	timers map[string]*time.Timer
+}{timers: make(map[string]*time.Timer)}
+
+// debounceBuild 在防抖窗口结束后才开始编译,窗口内相同 key 的新事件会替换掉尚未开始的编译
+func debounceBuild(key string, seconds int, build func()) {
+	if seconds <= 0 {
+		build()
+		return
+	}
+
+	pending.Lock()
+	defer pending.Unlock()
+
+	if old, ok := pending.timers[key]; ok && old.Stop() {
+		log.Infof("build:%s pending build superseded by newer event", key)
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(seconds)*time.Second, func() {
+		pending.Lock()
+		if pending.timers[key] == timer {
+			delete(pending.timers, key)
+		}
+		pending.Unlock()
+
+		build()
+	})
+	pending.timers[key] = timer
+	log.Debugf("build:%s will start after %ds", key, seconds)
+}
+
+// stopPending 取消所有等待防抖的编译
+func stopPending() {
+	pending.Lock()
+	defer pending.Unlock()
+
+	for key, timer := range pending.timers {
+		if timer.Stop() {
+			log.Infof("build:%s pending build cancelled", key)
+		}
+		delete(pending.timers, key)
+	}
+}
+
+// autobuild mr 为空时编译分支,否则编译 merge request,src 为触发来源
+func autobuild(taskid int64, src *source, mr *mergeRequest) {
+	slot, err := acquireBuild()
+	if err != nil {
+		log.Warnf("task:%d %s build rejected:%s", taskid, src.trigger, err)
+		return
+	}
+
 	tk, err := model.GetTask(taskid)
 	if err != nil {
+		slot.release()
 		log.Errorf("get task error:%s", err)
 		return
 	}
 
 	p, err := model.GetProject(tk.ProjectId)
 	if err != nil {
+		slot.release()
 		log.Errorf("get project error:%s", err)
 		return
 	}
@@ -100,9 +444,15 @@ func autobuild(taskid int64) {
 		TaskId: taskid,
 		Status: model.Init,
 	}
+	src.apply(tl)
+	if mr != nil {
+		tl.MergeRequest = mr.id
+		tl.Ref = mr.ref
+	}
 
 	err = model.InsertTaskLog(tl)
 	if err != nil {
+		slot.release()
 		log.Errorf("insert sql error:%s", err)
 		return
 	}
@@ -113,8 +463,13 @@ func autobuild(taskid int64) {
 		p:         p,
 		t:         tk,
 		tl:        tl,
+		slot:      slot,
 		files:     make([]*os.File, 0),
 	}
+	if mr != nil {
+		t.mr = mr.id
+		t.ref = mr.ref
+	}
 
 	t.start()
 }
@@ -0,0 +1,94 @@
+package logic
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hash-rabbit/auto-build/model"
+)
+
+func TestSkipCI(t *testing.T) {
+	cases := map[string]bool{
+		"fix typo [skip ci]":      true,
+		"[CI SKIP] update readme": true,
+		"feat: add webhook":       false,
+		"skip ci":                 false,
+	}
+	for msg, want := range cases {
+		if got := skipCI(msg); got != want {
+			t.Errorf("skipCI(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
+
+func TestHeadCommit(t *testing.T) {
+	e := &Event{
+		CheckoutSha: "b",
+		Commits: []*Commit{
+			{Id: "a", Message: "first"},
+			{Id: "b", Message: "second [skip ci]"},
+			{Id: "c", Message: "third"},
+		},
+	}
+	if c := e.headCommit(); c == nil || c.Id != "b" {
+		t.Errorf("head commit:%+v, want b", c)
+	}
+
+	e = &Event{HeadCommit: &Commit{Id: "d"}}
+	if c := e.headCommit(); c == nil || c.Id != "d" {
+		t.Errorf("head commit:%+v, want d", c)
+	}
+}
+
+func TestMergeRequest(t *testing.T) {
+	e := &Event{ObjectAttributes: &MergeRequestAttr{Iid: 7, Action: "update", TargetBranch: "master"}}
+	if mr := e.mergeRequest(); mr != nil {
+		t.Errorf("update without new commits should be ignored, got:%+v", mr)
+	}
+
+	e.ObjectAttributes.OldRev = "abc"
+	mr := e.mergeRequest()
+	if mr == nil || mr.ref != "refs/merge-requests/7/head" || mr.target != "master" {
+		t.Errorf("gitlab merge request:%+v", mr)
+	}
+
+	e = &Event{Action: "synchronize", PullRequest: &PullRequest{Number: 3, Base: PullRequestRef{Ref: "dev"}}}
+	mr = e.mergeRequest()
+	if mr == nil || mr.ref != "refs/pull/3/head" || mr.target != "dev" {
+		t.Errorf("github pull request:%+v", mr)
+	}
+
+	e.Action = "closed"
+	if mr := e.mergeRequest(); mr != nil {
+		t.Errorf("closed pull request should be ignored, got:%+v", mr)
+	}
+}
+
+func TestWebhookSource(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/webhook/demo", nil)
+	r.Header.Set("X-Gitlab-Event-UUID", "uuid-1")
+	e := &Event{Before: "a1", After: "b2", UserUsername: "alice", User: &EventUser{Username: "bob"}}
+	src := webhookSource(r, e, model.TriggerPush)
+	if src.delivery != "uuid-1" || src.pushedBy != "alice" || src.before != "a1" || src.after != "b2" {
+		t.Errorf("gitlab push source:%+v", src)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/webhook/demo", nil)
+	r.Header.Set("X-GitHub-Delivery", "guid-2")
+	e = &Event{
+		Action:      "opened",
+		Sender:      &EventUser{Login: "carol"},
+		PullRequest: &PullRequest{Number: 1, Head: PullRequestRef{Sha: "c3"}},
+	}
+	src = webhookSource(r, e, model.TriggerMergeRequest)
+	if src.delivery != "guid-2" || src.pushedBy != "carol" || src.before != "" || src.after != "c3" {
+		t.Errorf("github pull request source:%+v", src)
+	}
+
+	tl := &model.TaskLog{}
+	src.apply(tl)
+	if tl.Trigger != model.TriggerMergeRequest || tl.DeliveryId != "guid-2" || tl.PushedBy != "carol" || tl.AfterSha != "c3" {
+		t.Errorf("task log:%+v", tl)
+	}
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -18,11 +23,27 @@ import (
 
 func main() {
 	if len(os.Args) < 2 {
-		fmt.Print("usage: auto-build config.toml")
+		fmt.Print("usage: auto-build config.toml\n       auto-build rotate-key config.toml < new_key\n       auto-build passwd config.toml user < password\n       auto-build agent config.toml")
 		os.Exit(0)
 	}
 
+	switch os.Args[1] {
+	case "rotate-key":
+		rotateKey(os.Args[2:])
+		return
+	case "passwd":
+		passwd(os.Args[2:])
+		return
+	case "agent":
+		agent(os.Args[2:])
+		return
+	}
+
 	config.LoadConfig(os.Args[1])
+	// 仓库 token,ssh 私钥和 secret 变量需要加密保存
+	if len(config.C.SecretKey) == 0 {
+		log.Panicf("secret_key not set")
+	}
 
 	err := checkDir(config.C)
 	if err != nil {
@@ -34,7 +55,13 @@ func main() {
 	model.InitModel()
 	defer model.Close()
 
+	if err := logic.InitAdmin(); err != nil {
+		log.Panicf("init admin error:%s", err)
+	}
+
 	env.Init()
+	logic.RecoverOrphans(config.C.OrphanPolicy)
+	logic.ReloadSchedule()
 
 	srv := &http.Server{
 		Handler:      route(config.C),
@@ -42,17 +69,152 @@ func main() {
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
-	log.Infof("start listen port:%d", config.C.Port)
-	log.Fatal(srv.ListenAndServe())
+	go func() {
+		log.Infof("start listen port:%d", config.C.Port)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	log.Infof("receive signal:%s, shutting down", <-sig)
+	shutdown(srv)
+}
+
+// shutdown 依次停止定时任务,http 服务和编译,model.Close 在 main 返回时调用
+func shutdown(srv *http.Server) {
+	env.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("shutdown http server error:%s", err)
+	}
+
+	grace := time.Duration(config.C.ShutdownGrace) * time.Second
+	if grace <= 0 {
+		grace = 60 * time.Second
+	}
+	logic.Shutdown(grace)
+	log.Info("shutdown finished")
+}
+
+// agent 远程编译机模式,向 agent_server 领取编译,不使用数据库
+func agent(args []string) {
+	if len(args) < 1 {
+		fmt.Print("usage: auto-build agent config.toml")
+		os.Exit(1)
+	}
+
+	config.LoadConfig(args[0])
+	if len(config.C.WorkPath) == 0 {
+		config.C.WorkPath = "work"
+	}
+	config.C.WorkPath, _ = filepath.Abs(config.C.WorkPath)
+
+	if err := checkDir(config.C); err != nil {
+		log.Panicf("create dir error:%s", err)
+	}
+	l.SetLogFileName(filepath.Join(config.C.LogPath, "auto-build-agent.log"), config.C.LogLevel)
+
+	env.Init()
+	defer env.Stop()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	go func() {
+		if err := logic.RunAgent(ctx); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info("receive signal, shutting down agent")
+	grace := time.Duration(config.C.ShutdownGrace) * time.Second
+	if grace <= 0 {
+		grace = 60 * time.Second
+	}
+	logic.Shutdown(grace)
+	log.Info("shutdown finished")
+}
+
+// rotateKey 从标准输入读取新的 secret_key,重新加密数据库中的敏感字段
+func rotateKey(args []string) {
+	if len(args) < 1 {
+		fmt.Print("usage: auto-build rotate-key config.toml < new_key")
+		os.Exit(1)
+	}
+
+	config.LoadConfig(args[0])
+
+	fmt.Fprint(os.Stderr, "new secret key: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	newKey := strings.TrimSpace(line)
+	if len(newKey) == 0 {
+		fmt.Fprintf(os.Stderr, "read new key error:%v\n", err)
+		os.Exit(1)
+	}
+
+	model.InitModel()
+	defer model.Close()
+
+	n, err := model.RotateSecretKey(config.C.SecretKey, newKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rotate key error:%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("re-encrypt %d rows, please set secret_key in %s to the new key\n", n, args[0])
+}
+
+// passwd 从标准输入读取新密码,重置用户密码
+func passwd(args []string) {
+	if len(args) < 2 {
+		fmt.Print("usage: auto-build passwd config.toml user < password")
+		os.Exit(1)
+	}
+
+	config.LoadConfig(args[0])
+
+	fmt.Fprint(os.Stderr, "new password: ")
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	model.InitModel()
+	defer model.Close()
+
+	if err := logic.ResetPassword(args[1], strings.TrimSpace(line)); err != nil {
+		fmt.Fprintf(os.Stderr, "reset password error:%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("password of %s changed\n", args[1])
 }
 
 func route(c *config.Config) *mux.Router {
 	r := mux.NewRouter()
 	r.HandleFunc("/", logic.Index).Methods(http.MethodGet)
 
+	r.HandleFunc("/api/openapi.json", logic.OpenApi).Methods(http.MethodGet)
+
 	r.HandleFunc("/api/home/info", logic.HomeInfo).Methods(http.MethodGet)
 
+	r.HandleFunc("/api/user/login", logic.Login).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/user/logout", logic.Logout).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/user/info", logic.UserInfo).Methods(http.MethodGet)
+	r.HandleFunc("/api/user/password", logic.ChangePassword).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/user/add", logic.AddUser).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/user/list", logic.ListUser).Methods(http.MethodGet)
+	r.HandleFunc("/api/user/delete", logic.DelUser).Methods(http.MethodDelete, http.MethodOptions)
+	r.HandleFunc("/api/token/add", logic.AddToken).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/token/list", logic.ListToken).Methods(http.MethodGet)
+	r.HandleFunc("/api/token/delete", logic.DelToken).Methods(http.MethodDelete, http.MethodOptions)
+	r.HandleFunc("/api/output/sign", logic.SignOutput).Methods(http.MethodGet)
+	r.HandleFunc("/api/audit/list", logic.ListAuditLog).Methods(http.MethodGet)
+
 	r.HandleFunc("/api/goenv/list", logic.ListEnv).Methods(http.MethodGet)
+	r.HandleFunc("/api/agent/list", logic.ListAgent).Methods(http.MethodGet)
+	r.HandleFunc("/api/agent/approve", logic.ApproveAgent).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/agent/delete", logic.DelAgent).Methods(http.MethodDelete, http.MethodOptions)
 
 	r.HandleFunc("/api/project/add", logic.AddPorject).Methods(http.MethodPost, http.MethodOptions)
 	// r.HandleFunc("/api/project/lsdir", logic.ListDir).Methods(http.MethodGet)
@@ -60,26 +222,116 @@ func route(c *config.Config) *mux.Router {
 	r.HandleFunc("/api/project/delete", logic.DelPorject).Methods(http.MethodDelete, http.MethodOptions)
 	// r.HandleFunc("/api/project/pull", logic.PullPorject).Methods(http.MethodPost, http.MethodOptions)
 	r.HandleFunc("/api/project/list", logic.ListPorject).Methods(http.MethodGet)
+	r.HandleFunc("/api/project/poll", logic.SetProjectPoll).Methods(http.MethodPost, http.MethodOptions)
 
 	r.HandleFunc("/api/task/add", logic.AddTask).Methods(http.MethodPost, http.MethodOptions)
 	r.HandleFunc("/api/task/delete", logic.DelTask).Methods(http.MethodDelete, http.MethodOptions)
 	r.HandleFunc("/api/task/list", logic.ListTask).Methods(http.MethodGet)
 	r.HandleFunc("/api/task/start", logic.StartTask).Methods(http.MethodPost, http.MethodOptions)
 	r.HandleFunc("/api/task/auto-build", logic.SetTaskAutoBuild).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/task/cron", logic.SetTaskCron).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/task/labels", logic.SetTaskLabels).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/task/image", logic.SetTaskImage).Methods(http.MethodPost, http.MethodOptions)
+
+	r.HandleFunc("/api/member/add", logic.AddMember).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/member/list", logic.ListMember).Methods(http.MethodGet)
+	r.HandleFunc("/api/member/delete", logic.DelMember).Methods(http.MethodDelete, http.MethodOptions)
+
+	r.HandleFunc("/api/secret/add", logic.AddSecret).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/secret/list", logic.ListSecret).Methods(http.MethodGet)
+	r.HandleFunc("/api/secret/delete", logic.DelSecret).Methods(http.MethodDelete, http.MethodOptions)
 
 	r.HandleFunc("/api/task/log/list", logic.ListTaskLog).Methods(http.MethodGet)
+	r.HandleFunc("/api/task/log/info", logic.GetTaskLogInfo).Methods(http.MethodGet)
 	r.HandleFunc("/api/task/log/output", logic.GetTaskLogOutput).Methods(http.MethodGet)
+	r.HandleFunc("/api/task/log/changelog", logic.GetTaskLogChangelog).Methods(http.MethodGet)
+	r.HandleFunc("/api/task/log/rebuild", logic.RebuildTaskLog).Methods(http.MethodPost, http.MethodOptions)
+	r.HandleFunc("/api/task/log/cancel", logic.CancelTaskLog).Methods(http.MethodPost, http.MethodOptions)
+
+	routeV2(r.PathPrefix("/api/v2").Subrouter())
 
 	r.HandleFunc("/webhook/{project}", logic.DoWebHook).Methods(http.MethodPost)
 
-	r.PathPrefix("/output/").Handler(http.StripPrefix("/output/", http.FileServer(http.Dir(c.DestPath))))
+	r.HandleFunc("/agent/register", logic.RegisterAgent).Methods(http.MethodPost)
+	r.HandleFunc("/agent/poll", logic.PollAgent).Methods(http.MethodPost)
+	r.HandleFunc("/agent/jobs/{id}", logic.UpdateAgentBuild).Methods(http.MethodPost)
+	r.HandleFunc("/agent/jobs/{id}/log", logic.AppendAgentLog).Methods(http.MethodPost)
+	r.HandleFunc("/agent/jobs/{id}/artifact", logic.UploadAgentArtifact).Methods(http.MethodPut)
+
+	// commit status 中的日志链接
+	r.HandleFunc("/logs/{id}", logic.GetTaskLogOutputV2).Methods(http.MethodGet)
+
+	r.PathPrefix("/output/").Handler(logic.CheckOutput(http.StripPrefix("/output/", http.FileServer(http.Dir(c.DestPath)))))
 
 	r.PathPrefix("/web/").Handler(http.StripPrefix("/web/", http.FileServer(http.Dir(c.WebPath))))
 
 	r.Use(mux.CORSMethodMiddleware(r))
+	r.Use(logic.Auth)
 	return r
 }
 
+// routeV2 资源路径的 v2 接口,v1 接口保留兼容
+func routeV2(r *mux.Router) {
+	get, post, put, del := http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete
+
+	r.HandleFunc("/session", logic.LoginV2).Methods(post)
+	r.HandleFunc("/session", logic.LogoutV2).Methods(del)
+	r.HandleFunc("/me", logic.GetMeV2).Methods(get)
+	r.HandleFunc("/me/password", logic.ChangePasswordV2).Methods(put)
+
+	r.HandleFunc("/users", logic.ListUsersV2).Methods(get)
+	r.HandleFunc("/users", logic.CreateUserV2).Methods(post)
+	r.HandleFunc("/users/{id}", logic.DeleteUserV2).Methods(del)
+
+	r.HandleFunc("/tokens", logic.ListTokensV2).Methods(get)
+	r.HandleFunc("/tokens", logic.CreateTokenV2).Methods(post)
+	r.HandleFunc("/tokens/{id}", logic.DeleteTokenV2).Methods(del)
+
+	r.HandleFunc("/output-links", logic.CreateOutputLinkV2).Methods(post)
+
+	r.HandleFunc("/home", logic.GetHomeV2).Methods(get)
+	r.HandleFunc("/goenvs", logic.ListGoEnvsV2).Methods(get)
+	r.HandleFunc("/goenvs", logic.InstallGoEnvV2).Methods(post)
+	r.HandleFunc("/goenvs/{version}", logic.DeleteGoEnvV2).Methods(del)
+	r.HandleFunc("/agents", logic.ListAgentsV2).Methods(get)
+	r.HandleFunc("/agents/{id}/approval", logic.ApproveAgentV2).Methods(put)
+	r.HandleFunc("/agents/{id}", logic.DeleteAgentV2).Methods(del)
+
+	r.HandleFunc("/projects", logic.ListProjectsV2).Methods(get)
+	r.HandleFunc("/projects", logic.CreateProjectV2).Methods(post)
+	r.HandleFunc("/projects/{id}", logic.GetProjectV2).Methods(get)
+	r.HandleFunc("/projects/{id}", logic.DeleteProjectV2).Methods(del)
+	r.HandleFunc("/projects/{id}/branches", logic.ListBranchesV2).Methods(get)
+	r.HandleFunc("/projects/{id}/poll", logic.SetProjectPollV2).Methods(put)
+	r.HandleFunc("/projects/{id}/members", logic.ListMembersV2).Methods(get)
+	r.HandleFunc("/projects/{id}/members/{user_id}", logic.SetMemberV2).Methods(put)
+	r.HandleFunc("/projects/{id}/members/{user_id}", logic.DeleteMemberV2).Methods(del)
+	r.HandleFunc("/projects/{id}/secrets", logic.ListSecretsV2).Methods(get)
+	r.HandleFunc("/projects/{id}/secrets/{name}", logic.SetSecretV2).Methods(put)
+	r.HandleFunc("/secrets/{id}", logic.DeleteSecretV2).Methods(del)
+
+	r.HandleFunc("/tasks", logic.ListTasksV2).Methods(get)
+	r.HandleFunc("/tasks", logic.CreateTaskV2).Methods(post)
+	r.HandleFunc("/tasks/{id}", logic.GetTaskV2).Methods(get)
+	r.HandleFunc("/tasks/{id}", logic.DeleteTaskV2).Methods(del)
+	r.HandleFunc("/tasks/{id}/auto-build", logic.SetTaskAutoBuildV2).Methods(put)
+	r.HandleFunc("/tasks/{id}/cron", logic.SetTaskCronV2).Methods(put)
+	r.HandleFunc("/tasks/{id}/labels", logic.SetTaskLabelsV2).Methods(put)
+	r.HandleFunc("/tasks/{id}/image", logic.SetTaskImageV2).Methods(put)
+	r.HandleFunc("/tasks/{id}/builds", logic.StartTaskV2).Methods(post)
+
+	r.HandleFunc("/task-logs", logic.ListTaskLogsV2).Methods(get)
+	r.HandleFunc("/task-logs/{id}", logic.GetTaskLogV2).Methods(get)
+	r.HandleFunc("/task-logs/{id}/output", logic.GetTaskLogOutputV2).Methods(get)
+	r.HandleFunc("/task-logs/{id}/changelog", logic.GetTaskLogChangelogV2).Methods(get)
+	r.HandleFunc("/task-logs/{id}/rebuild", logic.RebuildTaskLogV2).Methods(post)
+	r.HandleFunc("/task-logs/{id}/cancel", logic.CancelTaskLogV2).Methods(post)
+
+	r.HandleFunc("/audit-logs", logic.ListAuditLogsV2).Methods(get)
+
+	r.PathPrefix("/").HandlerFunc(logic.OptionsV2).Methods(http.MethodOptions)
+}
+
 func checkDir(c *config.Config) error {
 	c.RecordPath, _ = filepath.Abs(c.RecordPath)
 	err := os.MkdirAll(c.RecordPath, os.ModePerm)
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/hash-rabbit/auto-build/config"
+	"github.com/hash-rabbit/auto-build/logic"
+)
+
+// TestOpenApi 注册的路由都需要在 openapi 文档中说明
+func TestOpenApi(t *testing.T) {
+	w := httptest.NewRecorder()
+	logic.OpenApi(w, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+
+	spec := &struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), spec); err != nil {
+		t.Fatalf("unmarshal spec error:%s", err)
+	}
+
+	routes := make(map[string]bool)
+	err := route(&config.Config{}).Walk(func(r *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := r.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		// PathPrefix 注册的静态文件和跨域预检没有方法或只有 OPTIONS
+		methods, err := r.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, m := range methods {
+			if m == http.MethodOptions {
+				continue
+			}
+			routes[m+" "+path] = true
+			if _, ok := spec.Paths[path][strings.ToLower(m)]; !ok {
+				t.Errorf("route %s %s missing in openapi spec", m, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk route error:%s", err)
+	}
+
+	for path, ops := range spec.Paths {
+		for m := range ops {
+			if !routes[strings.ToUpper(m)+" "+path] {
+				t.Errorf("openapi spec %s %s not registered", m, path)
+			}
+		}
+	}
+}
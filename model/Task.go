@@ -2,7 +2,10 @@ package model
 
 import (
 	"fmt"
+	"strings"
 	"time"
+
+	"xorm.io/xorm"
 )
 
 // build status
@@ -11,6 +14,17 @@ const (
 	Running
 	Success
 	Failed
+	Interrupted // 服务重启时没有完成的编译
+)
+
+// 编译的触发方式
+const (
+	TriggerManual       = "manual"
+	TriggerPush         = "push"
+	TriggerMergeRequest = "merge_request"
+	TriggerCron         = "cron"
+	TriggerPoll         = "poll"
+	TriggerRebuild      = "rebuild"
 )
 
 type Task struct {
@@ -26,22 +40,109 @@ type Task struct {
 	Env            string    `xorm:"varchar(255)" json:"env"`      // 环境变量key1=value1;key2=value2
 	BeforeBuildCmd string    `xorm:"varchar(255)" json:"before_build_cmd"`
 	AfterBuildCmd  string    `xorm:"varchar(255)" json:"after_build_cmd"`
+	Debounce       int       `xorm:"default 0" json:"debounce"`  // 自动编译防抖时间(秒),窗口内的多次 push 只编译最后一次
+	Cron           string    `xorm:"varchar(50)" json:"cron"`    // 定时编译,crontab 格式,如 "0 2 * * *","@weekly"
+	CronSkip       bool      `xorm:"Bool" json:"cron_skip"`      // 分支没有新提交时跳过定时编译
+	Labels         string    `xorm:"varchar(255)" json:"labels"` // agent 标签选择,如 "os=linux,arch=arm64",为空时在服务端编译
+	Image          string    `xorm:"varchar(255)" json:"image"`  // 在容器中编译使用的镜像,如 "debian:bookworm",为空时在主机上编译
 	DeletedAt      time.Time `xorm:"deleted" json:"-"`
 }
 
 type TaskLog struct {
-	Id          int64     `xorm:"pk" json:"id"`
-	TaskId      int64     `xorm:"index" json:"task_id"`
-	Description string    `xorm:"varchar(50)" json:"description"`
-	Status      int       `xorm:"index" json:"status"`           //0:init,1:building,2:success,3:failed TODO:100代表 success,0-100 代表进度,<0 代表失败
-	Url         string    `xorm:"varchar(50)" json:"url"`        //目标文件
-	LocalPath   string    `xorm:"varchar(50)" json:"local_path"` //生成文件本地路径
-	Size        int64     `xorm:"default 0" json:"size"`         // TODO:增加编译后本地校验
-	Sha2        string    `xorm:"varchar(50)" json:"sha2"`       // TODO:生成后生成 sha2
-	OutFilePath string    `xorm:"varchar(50)" json:"out_file_path"`
-	CreateAt    time.Time `xorm:"datetime created" json:"create_at"`
-	FinishAt    time.Time `xorm:"datetime updated" json:"finish_at"`
-	DeletedAt   time.Time `xorm:"deleted" json:"-"`
+	Id           int64        `xorm:"pk" json:"id"`
+	TaskId       int64        `xorm:"index" json:"task_id"`
+	ProjectId    int64        `xorm:"index default 0" json:"project_id"`    // 编译时任务所属的工程,任务删除后用于校验权限
+	MergeRequest int64        `xorm:"index default 0" json:"merge_request"` // merge request/pull request 编号,0 为分支编译
+	Trigger      string       `xorm:"varchar(20) index" json:"trigger"`     // 触发方式,manual/push/merge_request/cron/poll/rebuild
+	RebuildOf    int64        `xorm:"index default 0" json:"rebuild_of"`    // 重新编译或重启后重新排队的原编译记录
+	UserId       int64        `xorm:"index default 0" json:"user_id"`       // 手动编译和重新编译的用户
+	UserName     string       `xorm:"varchar(30) index" json:"user_name"`
+	DeliveryId   string       `xorm:"varchar(64)" json:"delivery_id"`     // webhook 的 delivery id
+	PushedBy     string       `xorm:"varchar(50) index" json:"pushed_by"` // webhook 中 push 或 merge request 的用户
+	BeforeSha    string       `xorm:"varchar(40)" json:"before_sha"`      // push 前分支指向的提交
+	AfterSha     string       `xorm:"varchar(40)" json:"after_sha"`       // push 后分支指向的提交
+	Config       *BuildConfig `xorm:"json text" json:"config,omitempty"`  // 编译时使用的配置快照
+	Ref          string       `xorm:"varchar(100)" json:"ref"`            // merge request 在远端仓库中的 ref
+	Selector     string       `xorm:"varchar(255)" json:"selector"`       // 在 agent 上编译时任务的标签选择
+	AgentId      int64        `xorm:"index default 0" json:"agent_id"`    // 领取编译的 agent
+	AgentName    string       `xorm:"varchar(50)" json:"agent_name"`
+	Commit       string       `xorm:"varchar(40)" json:"commit"`
+	ShortSha     string       `xorm:"varchar(12)" json:"short_sha"`
+	Author       string       `xorm:"varchar(100)" json:"author"`
+	CommitTime   time.Time    `xorm:"datetime" json:"commit_time"` // 提交时间
+	Subject      string       `xorm:"varchar(255)" json:"subject"` // 提交信息的第一行
+	Description  string       `xorm:"varchar(50)" json:"description"`
+	Status       int          `xorm:"index" json:"status"`           //0:init,1:building,2:success,3:failed,4:interrupted TODO:100代表 success,0-100 代表进度,<0 代表失败
+	Url          string       `xorm:"varchar(50)" json:"url"`        //目标文件
+	LocalPath    string       `xorm:"varchar(50)" json:"local_path"` //生成文件本地路径
+	Size         int64        `xorm:"default 0" json:"size"`         // TODO:增加编译后本地校验
+	Sha2         string       `xorm:"varchar(50)" json:"sha2"`       // TODO:生成后生成 sha2
+	OutFilePath  string       `xorm:"varchar(50)" json:"out_file_path"`
+	CreateAt     time.Time    `xorm:"datetime created" json:"create_at"`
+	FinishAt     time.Time    `xorm:"datetime updated" json:"finish_at"`
+	DeletedAt    time.Time    `xorm:"deleted" json:"-"`
+}
+
+// BuildConfig 编译时使用的工程和任务配置,修改或删除工程和任务后仍可以查看,重新编译时使用相同的配置
+type BuildConfig struct {
+	ProjectName    string `json:"project_name"`
+	RepoUrl        string `json:"repo_url"`
+	GoVersion      string `json:"go_version"`
+	GoMod          bool   `json:"go_mod"`
+	WorkSpace      string `json:"workspace"`
+	ProjectEnv     string `json:"project_env"`
+	BeforeBuildCmd string `json:"before_build_cmd"`
+	AfterBuildCmd  string `json:"after_build_cmd"`
+	Submodule      bool   `json:"submodule"`
+	Lfs            bool   `json:"lfs"`
+	Branch         string `json:"branch"`
+	MainFile       string `json:"main_file"`
+	DestFile       string `json:"dest_file"`
+	DestOs         string `json:"dest_os"`
+	DestArch       string `json:"dest_arch"`
+	TaskEnv        string `json:"task_env"`
+	Image          string `json:"image"`
+}
+
+func NewBuildConfig(p *Project, t *Task) *BuildConfig {
+	return &BuildConfig{
+		ProjectName:    p.Name,
+		RepoUrl:        p.Url,
+		GoVersion:      p.GoVersion,
+		GoMod:          p.GoMod,
+		WorkSpace:      p.WorkSpace,
+		ProjectEnv:     p.Env,
+		BeforeBuildCmd: p.BeforeBuildCmd,
+		AfterBuildCmd:  p.AfterBuildCmd,
+		Submodule:      p.Submodule,
+		Lfs:            p.Lfs,
+		Branch:         t.Branch,
+		MainFile:       t.MainFile,
+		DestFile:       t.DestFile,
+		DestOs:         t.DestOs,
+		DestArch:       t.DestArch,
+		TaskEnv:        t.Env,
+		Image:          t.Image,
+	}
+}
+
+// Apply 使用快照中的配置覆盖工程和任务的配置,工程名和仓库地址使用当前的值
+func (c *BuildConfig) Apply(p *Project, t *Task) {
+	p.GoVersion = c.GoVersion
+	p.GoMod = c.GoMod
+	p.WorkSpace = c.WorkSpace
+	p.Env = c.ProjectEnv
+	p.BeforeBuildCmd = c.BeforeBuildCmd
+	p.AfterBuildCmd = c.AfterBuildCmd
+	p.Submodule = c.Submodule
+	p.Lfs = c.Lfs
+	t.Branch = c.Branch
+	t.MainFile = c.MainFile
+	t.DestFile = c.DestFile
+	t.DestOs = c.DestOs
+	t.DestArch = c.DestArch
+	t.Env = c.TaskEnv
+	t.Image = c.Image
 }
 
 func InsertTask(t *Task) error {
@@ -62,11 +163,32 @@ func UpdateTaskAutoBuild(id int64, auto bool) error {
 }
 
 func InsertTaskLog(tl *TaskLog) error {
+	if tl.ProjectId == 0 {
+		t := &Task{}
+		has, err := engine.ID(tl.TaskId).Unscoped().Cols("project_id").Get(t)
+		if err != nil {
+			return err
+		}
+		if has {
+			tl.ProjectId = t.ProjectId
+		}
+	}
+
 	tl.Id = node.Generate().Int64()
 	_, err := engine.InsertOne(tl)
 	return err
 }
 
+// FillTaskLogProject 为历史编译记录补充工程 id
+func FillTaskLogProject() (int64, error) {
+	res, err := engine.Exec("UPDATE task_log SET project_id = (SELECT project_id FROM task WHERE task.id = task_log.task_id) " +
+		"WHERE project_id = 0 AND EXISTS (SELECT 1 FROM task WHERE task.id = task_log.task_id)")
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func UpdateTaskLog(id int64, status int) {
 	tl := &TaskLog{
 		Status: status,
@@ -74,11 +196,44 @@ func UpdateTaskLog(id int64, status int) {
 	engine.Where("id = ?", id).Cols("status").Update(tl)
 }
 
-func UpdateTaskLogDescription(id int64, desc string) {
-	tl := &TaskLog{
-		Description: desc,
+// ListUnfinishedTaskLog 返回没有完成的编译记录
+func ListUnfinishedTaskLog() ([]*TaskLog, error) {
+	tls := make([]*TaskLog, 0)
+	err := engine.In("status", Init, Running).Asc("create_at").Find(&tls)
+	return tls, err
+}
+
+// UpdateTaskLogCommit 保存编译的提交信息
+func UpdateTaskLogCommit(id int64, c *TaskLog) {
+	engine.Where("id = ?", id).Cols("commit", "short_sha", "author", "commit_time", "subject", "description").Update(c)
+}
+
+func UpdateTaskImage(id int64, image string) error {
+	_, err := engine.ID(id).Cols("image").Update(&Task{Image: image})
+	return err
+}
+
+func UpdateTaskLabels(id int64, labels string) error {
+	_, err := engine.ID(id).Cols("labels").Update(&Task{Labels: labels})
+	return err
+}
+
+func UpdateTaskCron(id int64, spec string, skip bool) error {
+	t := &Task{
+		Cron:     spec,
+		CronSkip: skip,
+	}
+	n, err := engine.Where("id = ?", id).Cols("cron", "cron_skip").Update(t)
+	if n == 1 {
+		return nil
 	}
-	engine.Where("id = ?", id).Cols("description").Update(tl)
+	return fmt.Errorf("update cols:%d err:%s", n, err)
+}
+
+func ListCronTask() ([]*Task, error) {
+	ts := make([]*Task, 0)
+	err := engine.Where("cron IS NOT NULL AND cron != ''").Find(&ts)
+	return ts, err
 }
 
 func UpdateTaskLogUrl(id int64, url string) {
@@ -88,6 +243,11 @@ func UpdateTaskLogUrl(id int64, url string) {
 	engine.Where("id = ?", id).Cols("url").Update(tl)
 }
 
+func UpdateTaskLogConfig(id int64, c *BuildConfig) error {
+	_, err := engine.Where("id = ?", id).Cols("config").Update(&TaskLog{Config: c})
+	return err
+}
+
 func UpdateTaskLogOut(id int64, filepath string) {
 	tl := &TaskLog{
 		OutFilePath: filepath,
@@ -102,7 +262,7 @@ func GetTask(id int64) (*Task, error) {
 		return nil, err
 	}
 	if !has {
-		return nil, fmt.Errorf("couldn't find task")
+		return nil, notFound("couldn't find task")
 	}
 	return t, nil
 }
@@ -131,32 +291,168 @@ type TaskLogInfo struct {
 	Version string `json:"version"`
 }
 
-func ListTaskLog(projectId, taskid int64, limit int, offset ...int) ([]*TaskLogInfo, error) {
+// TaskLogFilter 编译记录的查询条件,零值不限制
+type TaskLogFilter struct {
+	ProjectId    int64
+	TaskId       int64
+	MergeRequest int64 // <0 不限制,0 只查询分支编译
+	Status       int   // <0 不限制
+	Branch       string
+	Commit       string // 提交 sha 前缀
+	Trigger      string
+	User         string // 触发编译的用户或 webhook 中的推送者
+	Start        time.Time
+	End          time.Time
+	ProjectIds   []int64 // 可见的工程,nil 时不限制
+	Sort         string  // 排序字段,前缀 - 为倒序,默认 -create_at
+}
+
+// taskLogSort 允许排序的字段
+var taskLogSort = map[string]string{
+	"create_at": "task_log.create_at",
+	"finish_at": "task_log.finish_at",
+	"status":    "task_log.status",
+	"size":      "task_log.size",
+}
+
+// CheckTaskLogSort 检查排序字段
+func CheckTaskLogSort(sort string) error {
+	if len(sort) == 0 {
+		return nil
+	}
+	if _, ok := taskLogSort[strings.TrimPrefix(sort, "-")]; !ok {
+		return fmt.Errorf("sort by %s not allowed", sort)
+	}
+	return nil
+}
+
+// ListTaskLog 返回一页编译记录和符合条件的总数
+func ListTaskLog(f *TaskLogFilter, limit int, offset ...int) ([]*TaskLogInfo, int64, error) {
+	sort := f.Sort
+	if len(sort) == 0 {
+		sort = "-create_at"
+	}
+	col, ok := taskLogSort[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		return nil, 0, fmt.Errorf("sort by %s not allowed", sort)
+	}
+
+	cs := taskLogSession(f)
+	defer cs.Close()
+	total, err := cs.Count(new(TaskLog))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	s := taskLogSession(f)
+	defer s.Close()
+	if strings.HasPrefix(sort, "-") {
+		s.Desc(col)
+	} else {
+		s.Asc(col)
+	}
+
 	tls := make([]*TaskLogInfo, 0)
+	err = s.Desc("task_log.id").Limit(limit, offset...).Find(&tls)
+	return tls, total, err
+}
+
+// taskLogSession 编译记录的查询条件,count 和 find 各使用一个 session
+func taskLogSession(f *TaskLogFilter) *xorm.Session {
 	s := engine.NewSession()
 	s.Table("task_log").Join("INNER", "task", "task.id = task_log.task_id").
 		Join("INNER", "project", "task.project_id = project.id")
 
-	if projectId > 0 {
-		s.Where("project.id = ?", projectId)
+	if f.ProjectId > 0 {
+		s.Where("project.id = ?", f.ProjectId)
+	}
+	if f.TaskId > 0 {
+		s.Where("task.id = ?", f.TaskId)
+	}
+	if f.ProjectIds != nil {
+		s.In("project.id", f.ProjectIds)
+	}
+	if f.MergeRequest >= 0 {
+		s.Where("task_log.merge_request = ?", f.MergeRequest)
+	}
+	if f.Status >= 0 {
+		s.Where("task_log.status = ?", f.Status)
+	}
+	if len(f.Branch) > 0 {
+		s.Where("task.branch = ?", f.Branch)
+	}
+	if len(f.Commit) > 0 {
+		s.Where("task_log.`commit` LIKE ?", f.Commit+"%")
+	}
+	if len(f.Trigger) > 0 {
+		s.Where("task_log.`trigger` = ?", f.Trigger)
+	}
+	if len(f.User) > 0 {
+		s.Where("(task_log.user_name = ? OR task_log.pushed_by = ?)", f.User, f.User)
+	}
+	if !f.Start.IsZero() {
+		s.Where("task_log.create_at >= ?", f.Start)
+	}
+	if !f.End.IsZero() {
+		s.Where("task_log.create_at < ?", f.End)
+	}
+	return s
+}
+
+// GetTaskLog 任务删除后仍然可以查看编译记录和配置快照
+func GetTaskLog(record_id int64) (*TaskLog, error) {
+	t := &TaskLog{}
+	has, err := engine.Where("id = ?", record_id).Unscoped().Get(t)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, notFound("couldn't find record id:%d", record_id)
+	}
+
+	return t, nil
+}
+
+// GetLastTaskLog 获取任务最近一次分支编译
+func GetLastTaskLog(taskid int64) (*TaskLog, error) {
+	t := &TaskLog{}
+	has, err := engine.Where("task_id = ?", taskid).And("merge_request = 0").Desc("create_at").Get(t)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, notFound("couldn't find record of task:%d", taskid)
 	}
 
-	if taskid > 0 {
-		s.Where("task.id = ?", taskid)
+	return t, nil
+}
+
+// GetPrevSuccessTaskLog 获取 tl 之前同一任务最近一次成功的分支编译
+func GetPrevSuccessTaskLog(tl *TaskLog) (*TaskLog, error) {
+	prev := &TaskLog{}
+	has, err := engine.Where("task_id = ?", tl.TaskId).And("status = ?", Success).
+		And("merge_request = 0").And("`commit` != ''").And("create_at < ?", tl.CreateAt).
+		Desc("create_at").Get(prev)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, notFound("couldn't find successful build of task:%d before %d", tl.TaskId, tl.Id)
 	}
 
-	err := s.Desc("create_at").Limit(limit, offset...).Find(&tls)
-	return tls, err
+	return prev, nil
 }
 
-func GetTaskLog(record_id int64) (*TaskLog, error) {
+// GetLastSuccessTaskLog 获取任务最近一次成功的分支编译
+func GetLastSuccessTaskLog(taskid int64) (*TaskLog, error) {
 	t := &TaskLog{}
-	has, err := engine.Where("id = ?", record_id).Get(t)
+	has, err := engine.Where("task_id = ?", taskid).And("status = ?", Success).
+		And("merge_request = 0").Desc("create_at").Get(t)
 	if err != nil {
 		return nil, err
 	}
 	if !has {
-		return nil, fmt.Errorf("couldn't find record id:%d", record_id)
+		return nil, notFound("couldn't find success record of task:%d", taskid)
 	}
 
 	return t, nil
@@ -184,6 +480,10 @@ func DelTask(id int64) error {
 		return err
 	}
 
+	if _, err = s.Where("task_id = ?", id).Delete(new(SecretVar)); err != nil {
+		return err
+	}
+
 	return s.Commit()
 }
 
@@ -0,0 +1,132 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// Agent 远程编译机,通过 http 向服务端领取编译
+type Agent struct {
+	Id       int64     `xorm:"pk" json:"id"`
+	Name     string    `xorm:"varchar(50) not null unique" json:"name"`
+	Labels   []string  `xorm:"json text" json:"labels"` // key=value,同一个 key 可以有多个值,如 go=go1.20
+	Hash     string    `xorm:"varchar(64)" json:"-"`    // agent 凭证的 sha256,第一次注册时生成
+	Approved bool      `xorm:"Bool" json:"approved"`    // admin 批准后才可以领取编译
+	Version  string    `xorm:"varchar(20)" json:"version"`
+	Ip       string    `xorm:"varchar(50)" json:"ip"`
+	LastSeen time.Time `xorm:"datetime" json:"last_seen"`
+	CreateAt time.Time `xorm:"datetime created" json:"create_at"`
+}
+
+// SaveAgent 按名称新增或更新 agent,Hash 为空时不修改凭证
+func SaveAgent(a *Agent) error {
+	old := &Agent{}
+	has, err := engine.Where("name = ?", a.Name).Get(old)
+	if err != nil {
+		return err
+	}
+	if !has {
+		a.Id = node.Generate().Int64()
+		_, err = engine.InsertOne(a)
+		return err
+	}
+
+	a.Id = old.Id
+	a.CreateAt = old.CreateAt
+	a.Approved = old.Approved
+	cols := []string{"labels", "version", "ip", "last_seen"}
+	if len(a.Hash) > 0 {
+		cols = append(cols, "hash")
+	} else {
+		a.Hash = old.Hash
+	}
+	_, err = engine.ID(a.Id).Cols(cols...).Update(a)
+	return err
+}
+
+func GetAgent(id int64) (*Agent, error) {
+	a := &Agent{}
+	has, err := engine.ID(id).Get(a)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, notFound("couldn't find agent:%d", id)
+	}
+	return a, nil
+}
+
+// ApproveAgent 批准或取消批准 agent 领取编译
+func ApproveAgent(id int64, approved bool) error {
+	_, err := engine.ID(id).Cols("approved").Update(&Agent{Approved: approved})
+	return err
+}
+
+func DelAgent(id int64) error {
+	n, err := engine.ID(id).Delete(new(Agent))
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("delete agent affect line number:%d", n)
+	}
+	return nil
+}
+
+func GetAgentByName(name string) (*Agent, error) {
+	a := &Agent{}
+	has, err := engine.Where("name = ?", name).Get(a)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, notFound("couldn't find agent:%s", name)
+	}
+	return a, nil
+}
+
+func ListAgent() ([]*Agent, error) {
+	as := make([]*Agent, 0)
+	err := engine.Asc("name").Find(&as)
+	return as, err
+}
+
+// TouchAgent 更新 agent 最后一次请求的时间
+func TouchAgent(id int64) {
+	engine.ID(id).Cols("last_seen").Update(&Agent{LastSeen: time.Now()})
+}
+
+// ListLostAgent 返回 since 之后没有请求的 agent
+func ListLostAgent(since time.Time) ([]*Agent, error) {
+	as := make([]*Agent, 0)
+	err := engine.Where("last_seen < ?", since).Find(&as)
+	return as, err
+}
+
+// QueueTaskLog 编译记录等待 agent 领取,selector 为任务的标签
+func QueueTaskLog(id int64, selector string, c *BuildConfig) error {
+	_, err := engine.ID(id).Cols("selector", "config").Update(&TaskLog{Selector: selector, Config: c})
+	return err
+}
+
+// ListQueuedTaskLog 返回等待 agent 领取的编译记录,先创建的在前
+func ListQueuedTaskLog() ([]*TaskLog, error) {
+	tls := make([]*TaskLog, 0)
+	err := engine.Where("status = ?", Init).And("selector != ''").And("agent_id = 0").
+		Asc("create_at").Find(&tls)
+	return tls, err
+}
+
+// AssignTaskLog 将编译记录分配给 agent,已经被其他 agent 领取时返回 false
+func AssignTaskLog(id int64, a *Agent) (bool, error) {
+	n, err := engine.ID(id).Where("agent_id = 0").And("status = ?", Init).
+		Cols("agent_id", "agent_name").Update(&TaskLog{AgentId: a.Id, AgentName: a.Name})
+	return n == 1, err
+}
+
+// ListAgentTaskLog 返回分配给 agent 还没有完成的编译记录
+func ListAgentTaskLog(agentId int64) ([]*TaskLog, error) {
+	tls := make([]*TaskLog, 0)
+	err := engine.Where("agent_id = ?", agentId).In("status", Init, Running).Find(&tls)
+	return tls, err
+}
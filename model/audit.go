@@ -0,0 +1,67 @@
+package model
+
+import (
+	"time"
+)
+
+// AuditLog 配置修改和手动操作的记录,只追加不修改
+type AuditLog struct {
+	Id        int64     `xorm:"pk" json:"id"`
+	UserId    int64     `xorm:"index default 0" json:"user_id"` // 0 为系统触发,如 webhook
+	UserName  string    `xorm:"varchar(30)" json:"user_name"`
+	Action    string    `xorm:"varchar(30) index" json:"action"` // 如 task.delete
+	Target    string    `xorm:"varchar(20)" json:"target"`       // project/task/secret/member/user/token
+	TargetId  int64     `xorm:"index default 0" json:"target_id"`
+	ProjectId int64     `xorm:"index default 0" json:"project_id"`
+	Before    string    `xorm:"text" json:"before"` // json
+	After     string    `xorm:"text" json:"after"`  // json
+	Ip        string    `xorm:"varchar(50)" json:"ip"`
+	CreateAt  time.Time `xorm:"datetime created index" json:"create_at"`
+}
+
+type AuditFilter struct {
+	UserName  string
+	Action    string
+	Target    string
+	TargetId  int64
+	ProjectId int64
+	Start     time.Time
+	End       time.Time
+}
+
+func InsertAuditLog(a *AuditLog) error {
+	a.Id = node.Generate().Int64()
+	_, err := engine.InsertOne(a)
+	return err
+}
+
+func ListAuditLog(f *AuditFilter, limit int, offset ...int) ([]*AuditLog, error) {
+	as := make([]*AuditLog, 0)
+	s := engine.NewSession()
+	defer s.Close()
+
+	if len(f.UserName) > 0 {
+		s.Where("user_name = ?", f.UserName)
+	}
+	if len(f.Action) > 0 {
+		s.Where("action = ?", f.Action)
+	}
+	if len(f.Target) > 0 {
+		s.Where("target = ?", f.Target)
+	}
+	if f.TargetId > 0 {
+		s.Where("target_id = ?", f.TargetId)
+	}
+	if f.ProjectId > 0 {
+		s.Where("project_id = ?", f.ProjectId)
+	}
+	if !f.Start.IsZero() {
+		s.Where("create_at >= ?", f.Start)
+	}
+	if !f.End.IsZero() {
+		s.Where("create_at < ?", f.End)
+	}
+
+	err := s.Desc("create_at").Limit(limit, offset...).Find(&as)
+	return as, err
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// 工程内的角色,高级角色包含低级角色的权限
+const (
+	RoleNone       = 0
+	RoleViewer     = 1 // 查看任务/编译日志,下载编译结果
+	RoleDeveloper  = 2 // 开始编译
+	RoleMaintainer = 3 // 修改任务,变量,成员和工程配置
+	RoleAdmin      = 4 // 全局管理员,不保存在成员表中
+)
+
+type ProjectMember struct {
+	Id        int64     `xorm:"pk" json:"id"`
+	ProjectId int64     `xorm:"index" json:"project_id"`
+	UserId    int64     `xorm:"index" json:"user_id"`
+	Role      int       `xorm:"default 1" json:"role"`
+	CreateAt  time.Time `xorm:"datetime created" json:"create_at"`
+}
+
+type ProjectMemberInfo struct {
+	ProjectMember `xorm:"extends"`
+	Name          string `json:"name"` // 用户名
+}
+
+// SaveProjectMember 用户已经是成员时修改角色
+func SaveProjectMember(m *ProjectMember) error {
+	old := &ProjectMember{}
+	has, err := engine.Where("project_id = ? AND user_id = ?", m.ProjectId, m.UserId).Get(old)
+	if err != nil {
+		return err
+	}
+
+	if has {
+		m.Id = old.Id
+		_, err = engine.ID(m.Id).Cols("role").Update(m)
+		return err
+	}
+
+	m.Id = node.Generate().Int64()
+	_, err = engine.InsertOne(m)
+	return err
+}
+
+// GetProjectRole 不是成员时返回 RoleNone
+func GetProjectRole(projectId, userId int64) (int, error) {
+	m := &ProjectMember{}
+	has, err := engine.Where("project_id = ? AND user_id = ?", projectId, userId).Get(m)
+	if err != nil || !has {
+		return RoleNone, err
+	}
+	return m.Role, nil
+}
+
+func ListProjectMember(projectId int64) ([]*ProjectMemberInfo, error) {
+	ms := make([]*ProjectMemberInfo, 0)
+	err := engine.Table("project_member").Join("INNER", "user", "user.id = project_member.user_id").
+		Where("project_member.project_id = ?", projectId).Asc("user.name").Find(&ms)
+	return ms, err
+}
+
+// ListUserProjectIds 用户可以查看的工程
+func ListUserProjectIds(userId int64) ([]int64, error) {
+	ids := make([]int64, 0)
+	err := engine.Table("project_member").Where("user_id = ?", userId).Cols("project_id").Find(&ids)
+	return ids, err
+}
+
+// IsProjectMaintainer 用户是否是某个工程的维护者
+func IsProjectMaintainer(userId int64) (bool, error) {
+	n, err := engine.Where("user_id = ? AND role >= ?", userId, RoleMaintainer).Count(new(ProjectMember))
+	return n > 0, err
+}
+
+func DelProjectMember(projectId, userId int64) error {
+	n, err := engine.Where("project_id = ? AND user_id = ?", projectId, userId).Delete(new(ProjectMember))
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("delete member affect line number:%d", n)
+	}
+	return nil
+}
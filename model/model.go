@@ -1,6 +1,9 @@
 package model
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/hash-rabbit/auto-build/config"
 	"github.com/hash-rabbit/snowflake"
 	_ "github.com/mattn/go-sqlite3"
@@ -11,6 +14,19 @@ import (
 var engine *xorm.Engine
 var node *snowflake.Node
 
+// ErrNotFound 查询的记录不存在,使用 errors.Is 判断
+var ErrNotFound = errors.New("record not found")
+
+type notFoundError string
+
+func (e notFoundError) Error() string { return string(e) }
+
+func (e notFoundError) Is(target error) bool { return target == ErrNotFound }
+
+func notFound(format string, a ...interface{}) error {
+	return notFoundError(fmt.Sprintf(format, a...))
+}
+
 func InitModel() {
 	err := InitNode()
 	if err != nil {
@@ -26,6 +42,21 @@ func InitModel() {
 	if err != nil {
 		log.Panicf("auto merge table error:%s", err)
 	}
+
+	if n, err := FillTaskLogProject(); err != nil {
+		log.Panicf("fill task log project error:%s", err)
+	} else if n > 0 {
+		log.Infof("fill project id of %d task log", n)
+	}
+
+	SetSecretKey(config.C.SecretKey)
+	n, err := EncryptPlainSecrets()
+	if err != nil {
+		log.Panicf("encrypt secrets error:%s", err)
+	}
+	if n > 0 {
+		log.Infof("encrypt %d plaintext or legacy secret rows", n)
+	}
 }
 
 func InitNode() error {
@@ -50,7 +81,7 @@ func InitSqlLite(filepath string) (err error) {
 }
 
 func AuthMergeTable() error {
-	return engine.Sync(new(Project), new(Task), new(TaskLog))
+	return engine.Sync(new(Project), new(Task), new(TaskLog), new(SecretVar), new(User), new(ApiToken), new(ProjectMember), new(AuditLog), new(Agent))
 }
 
 func Close() {
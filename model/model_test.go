@@ -1,6 +1,12 @@
 package model
 
-import "testing"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestModel(t *testing.T) {
 	err := InitSqlLite("./test.db")
@@ -20,3 +26,372 @@ func TestProject(t *testing.T) {
 	p, err := GetProject(1)
 	t.Logf("project:%+v,err:%s", p, err)
 }
+
+func TestSecret(t *testing.T) {
+	TestModel(t)
+	if err := InitNode(); err != nil {
+		t.Fatal(err)
+	}
+	SetSecretKey("old key")
+	defer SetSecretKey("")
+
+	p := &Project{Name: "secret-test", LocalPath: "/tmp/secret-test", Token: "glpat-xxxx"}
+	if err := InsertProject(p); err != nil {
+		t.Fatal(err)
+	}
+	defer engine.ID(p.Id).Unscoped().Delete(new(Project))
+
+	rows, err := engine.Table("project").Cols("token").Where("id = ?", p.Id).QueryString()
+	if err != nil || len(rows) != 1 || rows[0]["token"] == "glpat-xxxx" {
+		t.Fatalf("token not encrypted:%+v err:%v", rows, err)
+	}
+
+	if _, err := RotateSecretKey("old key", "new key"); err != nil {
+		t.Fatal(err)
+	}
+	SetSecretKey("new key")
+
+	got, err := GetProject(p.Id)
+	if err != nil || got.Token != "glpat-xxxx" {
+		t.Fatalf("get project:%+v err:%v", got, err)
+	}
+
+	data, _ := json.Marshal(got)
+	if strings.Contains(string(data), "glpat-xxxx") {
+		t.Errorf("token returned in json:%s", data)
+	}
+}
+
+func TestDelSecretVar(t *testing.T) {
+	TestModel(t)
+	if err := InitNode(); err != nil {
+		t.Fatal(err)
+	}
+	SetSecretKey("test key")
+	defer SetSecretKey("")
+
+	p := &Project{Name: "secret-var-test", LocalPath: "/tmp/secret-var-test"}
+	if err := InsertProject(p); err != nil {
+		t.Fatal(err)
+	}
+	tk := &Task{ProjectId: p.Id, Branch: "master"}
+	if err := InsertTask(tk); err != nil {
+		t.Fatal(err)
+	}
+	for _, taskId := range []int64{0, tk.Id} {
+		if err := SaveSecretVar(&SecretVar{ProjectId: p.Id, TaskId: taskId, Name: "TOKEN", Value: "xxxx"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 删除任务只删除任务的变量
+	if err := DelTask(tk.Id); err != nil {
+		t.Fatal(err)
+	}
+	if vs, err := ListSecretVar(p.Id, -1); err != nil || len(vs) != 1 || vs[0].TaskId != 0 {
+		t.Errorf("after delete task vars:%+v err:%v", vs, err)
+	}
+
+	if err := DelProject(p.Id); err != nil {
+		t.Fatal(err)
+	}
+	if vs, err := ListSecretVar(p.Id, -1); err != nil || len(vs) != 0 {
+		t.Errorf("after delete project vars:%+v err:%v", vs, err)
+	}
+}
+
+func TestApiToken(t *testing.T) {
+	TestModel(t)
+	if err := InitNode(); err != nil {
+		t.Fatal(err)
+	}
+
+	forever := &ApiToken{UserId: 1, Hash: "token-test-forever"}
+	expired := &ApiToken{UserId: 1, Hash: "token-test-expired", ExpireAt: time.Now().Add(-time.Hour)}
+	for _, v := range []*ApiToken{forever, expired} {
+		if err := InsertApiToken(v); err != nil {
+			t.Fatal(err)
+		}
+		defer engine.ID(v.Id).Delete(new(ApiToken))
+	}
+
+	if _, err := DelExpiredApiToken(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetApiTokenByHash(forever.Hash); err != nil {
+		t.Errorf("token without expire deleted:%s", err)
+	}
+	if _, err := GetApiTokenByHash(expired.Hash); err == nil {
+		t.Errorf("expired token not deleted")
+	}
+}
+
+func TestProjectMember(t *testing.T) {
+	TestModel(t)
+	if err := InitNode(); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &ProjectMember{ProjectId: 1, UserId: 2, Role: RoleViewer}
+	if err := SaveProjectMember(m); err != nil {
+		t.Fatal(err)
+	}
+	defer engine.ID(m.Id).Delete(new(ProjectMember))
+
+	if err := SaveProjectMember(&ProjectMember{ProjectId: 1, UserId: 2, Role: RoleMaintainer}); err != nil {
+		t.Fatal(err)
+	}
+	if role, err := GetProjectRole(1, 2); err != nil || role != RoleMaintainer {
+		t.Errorf("role:%d err:%v", role, err)
+	}
+	if role, err := GetProjectRole(1, 3); err != nil || role != RoleNone {
+		t.Errorf("role of non member:%d err:%v", role, err)
+	}
+	if ok, err := IsProjectMaintainer(2); err != nil || !ok {
+		t.Errorf("maintainer:%v err:%v", ok, err)
+	}
+	if ok, err := IsProjectMaintainer(3); err != nil || ok {
+		t.Errorf("non member maintainer:%v err:%v", ok, err)
+	}
+
+	ids, err := ListUserProjectIds(2)
+	if err != nil || len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("project ids:%v err:%v", ids, err)
+	}
+
+	// 没有可见工程时不返回任何日志
+	tls, total, err := ListTaskLog(&TaskLogFilter{MergeRequest: -1, Status: -1, ProjectIds: []int64{}}, 20)
+	if err != nil || len(tls) != 0 || total != 0 {
+		t.Errorf("task logs:%d total:%d err:%v", len(tls), total, err)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	TestModel(t)
+	if err := InitNode(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, action := range []string{"task.add", "task.delete"} {
+		a := &AuditLog{UserName: "audit-test", Action: action, Target: "task", TargetId: 1}
+		if err := InsertAuditLog(a); err != nil {
+			t.Fatal(err)
+		}
+		defer engine.ID(a.Id).Delete(new(AuditLog))
+	}
+
+	as, err := ListAuditLog(&AuditFilter{UserName: "audit-test", Action: "task.delete"}, 20)
+	if err != nil || len(as) != 1 || as[0].Action != "task.delete" {
+		t.Errorf("audit logs:%+v err:%v", as, err)
+	}
+
+	as, err = ListAuditLog(&AuditFilter{UserName: "audit-test", Start: time.Now().Add(time.Hour)}, 20)
+	if err != nil || len(as) != 0 {
+		t.Errorf("audit logs after now:%d err:%v", len(as), err)
+	}
+}
+
+func TestListTaskLog(t *testing.T) {
+	TestModel(t)
+	if err := InitNode(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Project{Name: "log-test", LocalPath: "/tmp/log-test"}
+	if err := InsertProject(p); err != nil {
+		t.Fatal(err)
+	}
+	defer DelProject(p.Id)
+
+	tk := &Task{ProjectId: p.Id, Branch: "release"}
+	if err := InsertTask(tk); err != nil {
+		t.Fatal(err)
+	}
+	defer DelTask(tk.Id)
+
+	for i, trigger := range []string{TriggerPush, TriggerManual, TriggerCron} {
+		tl := &TaskLog{TaskId: tk.Id, Status: Success, Commit: fmt.Sprintf("abc%d", i), Trigger: trigger}
+		if i == 2 {
+			tl.Status = Failed
+		}
+		if i == 0 {
+			tl.PushedBy = "alice"
+		}
+		if i == 1 {
+			tl.UserName = "alice"
+		}
+		if err := InsertTaskLog(tl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	base := TaskLogFilter{ProjectId: p.Id, MergeRequest: -1, Status: -1}
+	cases := []struct {
+		f     func(f *TaskLogFilter)
+		total int64
+	}{
+		{func(f *TaskLogFilter) {}, 3},
+		{func(f *TaskLogFilter) { f.Status = Success }, 2},
+		{func(f *TaskLogFilter) { f.Branch = "release"; f.Trigger = TriggerCron }, 1},
+		{func(f *TaskLogFilter) { f.Commit = "abc1" }, 1},
+		{func(f *TaskLogFilter) { f.User = "alice" }, 2},
+		{func(f *TaskLogFilter) { f.User = "alice"; f.Status = Success; f.Trigger = TriggerManual }, 1},
+		{func(f *TaskLogFilter) { f.Branch = "master" }, 0},
+		{func(f *TaskLogFilter) { f.Start = time.Now().Add(time.Hour) }, 0},
+	}
+	for i, c := range cases {
+		f := base
+		c.f(&f)
+		// 只取一条,总数不受分页影响
+		tls, total, err := ListTaskLog(&f, 1)
+		if err != nil || total != c.total || int64(len(tls)) != minInt64(c.total, 1) {
+			t.Errorf("case %d: logs:%d total:%d err:%v, want total:%d", i, len(tls), total, err, c.total)
+		}
+	}
+
+	f := base
+	f.Sort = "status"
+	if tls, _, err := ListTaskLog(&f, 3); err != nil || tls[0].Status != Success || tls[2].Status != Failed {
+		t.Errorf("sort by status error:%v", err)
+	}
+	f.Sort = "name"
+	if _, _, err := ListTaskLog(&f, 3); err == nil {
+		t.Error("sort by name should fail")
+	}
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestBuildConfig(t *testing.T) {
+	TestModel(t)
+	if err := InitNode(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Project{GoVersion: "go1.20.6", Env: "A=1", Lfs: true}
+	tk := &Task{Branch: "master", DestOs: "linux", DestArch: "amd64"}
+	tl := &TaskLog{TaskId: 1, Status: Init}
+	if err := InsertTaskLog(tl); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateTaskLogConfig(tl.Id, NewBuildConfig(p, tk)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetTaskLog(tl.Id)
+	if err != nil || got.Config == nil {
+		t.Fatalf("task log:%+v err:%v", got, err)
+	}
+
+	data, _ := json.Marshal(got)
+	if !strings.Contains(string(data), `"config":{`) || !strings.Contains(string(data), `"go_version":"go1.20.6"`) {
+		t.Errorf("task log json:%s", data)
+	}
+
+	// 修改配置后使用快照恢复
+	p.GoVersion, p.Env, p.Lfs, tk.DestOs = "go1.21.0", "A=2", false, "windows"
+	got.Config.Apply(p, tk)
+	if p.GoVersion != "go1.20.6" || p.Env != "A=1" || !p.Lfs || tk.DestOs != "linux" {
+		t.Errorf("apply config:%+v %+v", p, tk)
+	}
+}
+
+func TestListUnfinishedTaskLog(t *testing.T) {
+	TestModel(t)
+	if err := InitNode(); err != nil {
+		t.Fatal(err)
+	}
+
+	tk := &Task{ProjectId: 1, Branch: "orphan"}
+	if err := InsertTask(tk); err != nil {
+		t.Fatal(err)
+	}
+	defer DelTask(tk.Id)
+
+	for _, status := range []int{Init, Running, Success, Interrupted} {
+		if err := InsertTaskLog(&TaskLog{TaskId: tk.Id, Status: status}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tls, err := ListUnfinishedTaskLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, tl := range tls {
+		if tl.TaskId == tk.Id {
+			n++
+			UpdateTaskLog(tl.Id, Interrupted)
+		}
+	}
+	if n != 2 {
+		t.Errorf("unfinished logs:%d, want 2", n)
+	}
+
+	tls, _ = ListUnfinishedTaskLog()
+	for _, tl := range tls {
+		if tl.TaskId == tk.Id {
+			t.Errorf("task log:%d still unfinished", tl.Id)
+		}
+	}
+}
+
+func TestAssignTaskLog(t *testing.T) {
+	TestModel(t)
+	if err := InitNode(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Agent{Name: "test-agent", Labels: []string{"os=linux"}}
+	if err := SaveAgent(a); err != nil {
+		t.Fatal(err)
+	}
+	b := &Agent{Name: "test-agent-2"}
+	if err := SaveAgent(b); err != nil {
+		t.Fatal(err)
+	}
+
+	tl := &TaskLog{TaskId: 1, Status: Init}
+	if err := InsertTaskLog(tl); err != nil {
+		t.Fatal(err)
+	}
+	if err := QueueTaskLog(tl.Id, "os=linux", &BuildConfig{GoVersion: "go1.20"}); err != nil {
+		t.Fatal(err)
+	}
+
+	queued := func() bool {
+		tls, _ := ListQueuedTaskLog()
+		for _, v := range tls {
+			if v.Id == tl.Id {
+				return true
+			}
+		}
+		return false
+	}
+	if !queued() {
+		t.Fatal("task log not queued")
+	}
+
+	// 只能被一个 agent 领取
+	if ok, err := AssignTaskLog(tl.Id, a); err != nil || !ok {
+		t.Fatalf("assign:%v %v", ok, err)
+	}
+	if ok, _ := AssignTaskLog(tl.Id, b); ok {
+		t.Error("task log assigned twice")
+	}
+	if queued() {
+		t.Error("assigned task log still queued")
+	}
+
+	tls, err := ListAgentTaskLog(a.Id)
+	if err != nil || len(tls) != 1 || tls[0].AgentName != a.Name {
+		t.Errorf("agent task log:%v %v", tls, err)
+	}
+}
@@ -11,13 +11,19 @@ type Project struct {
 	LocalPath      string    `xorm:"varchar(50) not null"  json:"path"`
 	Url            string    `xorm:"varchar(50)"  json:"url"`
 	MainBranch     string    `xorm:"varchar(30) default master" json:"main_branch"`
-	Token          string    `xorm:"varchar(50)"  json:"token"`
+	Token          Secret    `xorm:"varchar(255)"  json:"token"` // 加密保存,接口返回时隐藏
+	SshKey         Secret    `xorm:"text" json:"ssh_key"`        // ssh 地址使用的部署私钥,加密保存,接口返回时隐藏
 	GoVersion      string    `xorm:"index" json:"go_version_id"` // envid
 	GoMod          bool      `xorm:"bool" json:"go_mod"`
 	WorkSpace      string    `xorm:"varchar(50)" json:"workspace"` // only go path(not mod) used
 	Env            string    `xorm:"varchar(255)" json:"env"`      // 环境变量key1=value1;key2=value2
 	BeforeBuildCmd string    `xorm:"varchar(255)" json:"before_build_cmd"`
 	AfterBuildCmd  string    `xorm:"varchar(255)" json:"after_build_cmd"`
+	Forge          string    `xorm:"varchar(10)" json:"forge"`       // gitlab/github,为空时根据 url 判断
+	ApiUrl         string    `xorm:"varchar(100)" json:"api_url"`    // forge api 地址,为空时根据 url 生成
+	PollInterval   int       `xorm:"default 0" json:"poll_interval"` // 轮询仓库的间隔(分钟),0 不轮询,用于无法发送 webhook 的仓库
+	Submodule      bool      `xorm:"Bool" json:"submodule"`          // 递归初始化子模块
+	Lfs            bool      `xorm:"Bool" json:"lfs"`                // 拉取 git lfs 对象,需要安装 git-lfs
 	DeletedAt      time.Time `xorm:"deleted" json:"-"`
 }
 
@@ -36,7 +42,7 @@ func GetProject(id int64) (*Project, error) {
 		return nil, err
 	}
 	if !has {
-		return nil, fmt.Errorf("couldn't find record")
+		return nil, notFound("couldn't find record")
 	}
 	return p, err
 }
@@ -50,7 +56,7 @@ func GetProjectByName(name string) (*Project, error) {
 		return nil, err
 	}
 	if !has {
-		return nil, fmt.Errorf("couldn't find record")
+		return nil, notFound("couldn't find record")
 	}
 	return p, err
 }
@@ -67,11 +73,47 @@ func ListProject(name string) ([]*Project, error) {
 	return ps, err
 }
 
+func ListPollProject() ([]*Project, error) {
+	ps := make([]*Project, 0)
+	err := engine.Where("poll_interval > 0").Find(&ps)
+	return ps, err
+}
+
+func UpdateProjectPoll(id int64, interval int) error {
+	p := &Project{
+		PollInterval: interval,
+	}
+	n, err := engine.Where("id = ?", id).Cols("poll_interval").Update(p)
+	if n == 1 {
+		return nil
+	}
+	return fmt.Errorf("update cols:%d err:%s", n, err)
+}
+
 func DelProject(id int64) error {
+	s := engine.NewSession()
+	defer s.Close()
+
+	if err := s.Begin(); err != nil {
+		return err
+	}
+
 	p := &Project{}
-	n, err := engine.ID(id).Delete(p)
+	n, err := s.ID(id).Delete(p)
+	if err != nil {
+		return err
+	}
 	if n != 1 {
 		return fmt.Errorf("delete project affect line number:%d", n)
 	}
-	return err
+
+	if _, err = s.Where("project_id = ?", id).Delete(new(ProjectMember)); err != nil {
+		return err
+	}
+
+	if _, err = s.Where("project_id = ?", id).Delete(new(SecretVar)); err != nil {
+		return err
+	}
+
+	return s.Commit()
 }
@@ -0,0 +1,110 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hash-rabbit/auto-build/util"
+	"github.com/subchen/go-log"
+)
+
+// 配置的 secret_key,加密使用由它派生的 key,为空时不能保存敏感字段
+var secretKey string
+
+// 保存了 Secret 字段的表和列,轮换 key 时需要重新加密
+var secretColumns = map[string][]string{
+	"project":    {"token", "ssh_key"},
+	"secret_var": {"value"},
+}
+
+// Secret 加密保存到数据库的字段,接口只能写入,返回时隐藏
+type Secret string
+
+const secretMask = "******"
+
+func SetSecretKey(key string) {
+	secretKey = key
+}
+
+func (s *Secret) FromDB(data []byte) error {
+	plain, err := util.Decrypt(secretKey, string(data))
+	if err != nil {
+		return err
+	}
+	*s = Secret(plain)
+	return nil
+}
+
+func (s *Secret) ToDB() ([]byte, error) {
+	enc, err := util.Encrypt(secretKey, string(*s))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(enc), nil
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if len(s) == 0 {
+		return json.Marshal("")
+	}
+	return json.Marshal(secretMask)
+}
+
+// RotateSecretKey 使用 newKey 重新加密所有敏感字段,历史明文数据也会被加密
+func RotateSecretKey(oldKey, newKey string) (int, error) {
+	return reencrypt(oldKey, newKey, false)
+}
+
+// EncryptPlainSecrets 加密历史明文保存的敏感字段,使用历史 key 加密的字段重新加密
+func EncryptPlainSecrets() (int, error) {
+	if len(secretKey) == 0 {
+		log.Warnf("secret_key not set, tokens can not be saved")
+		return 0, nil
+	}
+	return reencrypt(secretKey, secretKey, true)
+}
+
+func reencrypt(oldKey, newKey string, onlyPlain bool) (int, error) {
+	s := engine.NewSession()
+	defer s.Close()
+
+	if err := s.Begin(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for table, cols := range secretColumns {
+		rows, err := s.Table(table).Cols(append([]string{"id"}, cols...)...).QueryString()
+		if err != nil {
+			return 0, err
+		}
+
+		for _, row := range rows {
+			values := make(map[string]interface{})
+			for _, col := range cols {
+				if len(row[col]) == 0 || (onlyPlain && util.IsEncrypted(row[col]) && !util.IsLegacy(row[col])) {
+					continue
+				}
+
+				plain, err := util.Decrypt(oldKey, row[col])
+				if err != nil {
+					return 0, fmt.Errorf("decrypt %s.%s id:%s error:%s", table, col, row["id"], err)
+				}
+				values[col], err = util.Encrypt(newKey, plain)
+				if err != nil {
+					return 0, err
+				}
+			}
+
+			if len(values) == 0 {
+				continue
+			}
+			if _, err := s.Table(table).Where("id = ?", row["id"]).Update(values); err != nil {
+				return 0, err
+			}
+			count++
+		}
+	}
+
+	return count, s.Commit()
+}
@@ -0,0 +1,91 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// SecretVar 编译时注入的加密环境变量,TaskId 为 0 时对工程下所有任务生效
+type SecretVar struct {
+	Id        int64     `xorm:"pk" json:"id"`
+	ProjectId int64     `xorm:"index" json:"project_id"`
+	TaskId    int64     `xorm:"index default 0" json:"task_id"`
+	Name      string    `xorm:"varchar(50) not null" json:"name"`
+	Value     Secret    `xorm:"text" json:"value"`
+	CreateAt  time.Time `xorm:"datetime created" json:"create_at"`
+	UpdateAt  time.Time `xorm:"datetime updated" json:"update_at"`
+}
+
+// SaveSecretVar 同一作用域下同名的变量会被覆盖
+func SaveSecretVar(v *SecretVar) error {
+	old := &SecretVar{}
+	has, err := engine.Where("project_id = ? AND task_id = ? AND name = ?", v.ProjectId, v.TaskId, v.Name).Get(old)
+	if err != nil {
+		return err
+	}
+
+	if has {
+		v.Id = old.Id
+		_, err = engine.ID(v.Id).Cols("value").Update(v)
+		return err
+	}
+
+	v.Id = node.Generate().Int64()
+	_, err = engine.InsertOne(v)
+	return err
+}
+
+func ListSecretVar(projectId, taskId int64) ([]*SecretVar, error) {
+	vs := make([]*SecretVar, 0)
+	s := engine.Where("project_id = ?", projectId)
+	if taskId >= 0 {
+		s.And("task_id = ?", taskId)
+	}
+	err := s.Asc("name").Find(&vs)
+	return vs, err
+}
+
+// ListBuildSecretVar 编译任务可用的变量,任务的变量覆盖工程的同名变量
+func ListBuildSecretVar(projectId, taskId int64) ([]*SecretVar, error) {
+	vs := make([]*SecretVar, 0)
+	err := engine.Where("project_id = ?", projectId).And("task_id = 0 OR task_id = ?", taskId).
+		Asc("task_id").Find(&vs)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make(map[string]int)
+	resu := make([]*SecretVar, 0, len(vs))
+	for _, v := range vs {
+		if i, ok := index[v.Name]; ok {
+			resu[i] = v
+			continue
+		}
+		index[v.Name] = len(resu)
+		resu = append(resu, v)
+	}
+	return resu, nil
+}
+
+func GetSecretVar(id int64) (*SecretVar, error) {
+	v := &SecretVar{}
+	has, err := engine.ID(id).Get(v)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, notFound("couldn't find secret:%d", id)
+	}
+	return v, nil
+}
+
+func DelSecretVar(id int64) error {
+	n, err := engine.ID(id).Delete(new(SecretVar))
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("delete secret affect line number:%d", n)
+	}
+	return nil
+}
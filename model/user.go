@@ -0,0 +1,133 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+type User struct {
+	Id       int64     `xorm:"pk" json:"id"`
+	Name     string    `xorm:"varchar(30) not null unique" json:"name"`
+	Password string    `xorm:"varchar(100) not null" json:"-"` // bcrypt
+	Admin    bool      `xorm:"Bool" json:"admin"`
+	CreateAt time.Time `xorm:"datetime created" json:"create_at"`
+}
+
+// ApiToken 个人 api token 和登录 session,只保存 token 的 sha256
+type ApiToken struct {
+	Id       int64     `xorm:"pk" json:"id"`
+	UserId   int64     `xorm:"index" json:"user_id"`
+	Name     string    `xorm:"varchar(50)" json:"name"`
+	Hash     string    `xorm:"varchar(64) not null unique" json:"-"`
+	Session  bool      `xorm:"Bool" json:"session"`       // 登录产生的 session
+	ExpireAt time.Time `xorm:"datetime" json:"expire_at"` // 为空时不过期
+	CreateAt time.Time `xorm:"datetime created" json:"create_at"`
+}
+
+func (t *ApiToken) Expired() bool {
+	return !t.ExpireAt.IsZero() && t.ExpireAt.Before(time.Now())
+}
+
+func InsertUser(u *User) error {
+	u.Id = node.Generate().Int64()
+	_, err := engine.InsertOne(u)
+	return err
+}
+
+func GetUser(id int64) (*User, error) {
+	u := &User{}
+	has, err := engine.ID(id).Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, notFound("couldn't find user:%d", id)
+	}
+	return u, nil
+}
+
+func GetUserByName(name string) (*User, error) {
+	u := &User{}
+	has, err := engine.Where("name = ?", name).Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, notFound("couldn't find user:%s", name)
+	}
+	return u, nil
+}
+
+func ListUser() ([]*User, error) {
+	us := make([]*User, 0)
+	err := engine.Asc("name").Find(&us)
+	return us, err
+}
+
+func CountUser() (int64, error) {
+	return engine.Count(new(User))
+}
+
+func UpdateUserPassword(id int64, password string) error {
+	_, err := engine.ID(id).Cols("password").Update(&User{Password: password})
+	return err
+}
+
+// DelUser 删除用户及其 token
+func DelUser(id int64) error {
+	n, err := engine.ID(id).Delete(new(User))
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("delete user affect line number:%d", n)
+	}
+
+	if _, err = engine.Where("user_id = ?", id).Delete(new(ApiToken)); err != nil {
+		return err
+	}
+
+	_, err = engine.Where("user_id = ?", id).Delete(new(ProjectMember))
+	return err
+}
+
+func InsertApiToken(t *ApiToken) error {
+	t.Id = node.Generate().Int64()
+	_, err := engine.InsertOne(t)
+	return err
+}
+
+func GetApiTokenByHash(hash string) (*ApiToken, error) {
+	t := &ApiToken{}
+	has, err := engine.Where("hash = ?", hash).Get(t)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, notFound("couldn't find token")
+	}
+	return t, nil
+}
+
+// ListApiToken 列出用户的个人 token,不包含 session
+func ListApiToken(userId int64) ([]*ApiToken, error) {
+	ts := make([]*ApiToken, 0)
+	err := engine.Where("user_id = ? AND session = ?", userId, false).Desc("create_at").Find(&ts)
+	return ts, err
+}
+
+func DelApiToken(id, userId int64) error {
+	n, err := engine.Where("id = ? AND user_id = ?", id, userId).Delete(new(ApiToken))
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return fmt.Errorf("delete token affect line number:%d", n)
+	}
+	return nil
+}
+
+// DelExpiredApiToken 清理过期的 token 和 session
+func DelExpiredApiToken() (int64, error) {
+	return engine.Where("expire_at IS NOT NULL AND expire_at < ?", time.Now()).Delete(new(ApiToken))
+}
@@ -0,0 +1,160 @@
+package util
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Credential 仓库认证信息,ssh 地址使用 SshKey,http 地址使用 Token
+type Credential struct {
+	Token      string // token 或 user:pass
+	SshKey     string // ssh 私钥(PEM)
+	KnownHosts string // known_hosts 文件,为空时使用 ~/.ssh/known_hosts
+}
+
+// IsSshUrl 判断是否为 ssh://host/repo 或 git@host:repo 格式的地址
+func IsSshUrl(url string) bool {
+	ep, err := transport.NewEndpoint(url)
+	return err == nil && ep.Protocol == "ssh"
+}
+
+// CheckUrl 检查仓库地址是否可以解析
+func CheckUrl(url string) error {
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return err
+	}
+
+	switch ep.Protocol {
+	case "http", "https", "ssh":
+	default:
+		return fmt.Errorf("protocol:%s not supported", ep.Protocol)
+	}
+
+	if len(ep.Host) == 0 {
+		return fmt.Errorf("couldn't parse host from url:%s", url)
+	}
+	return nil
+}
+
+// auth 根据仓库地址生成 go-git 的认证方式,c 为空时不认证
+func (c *Credential) auth(url string) (transport.AuthMethod, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	ep, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+
+	switch ep.Protocol {
+	case "ssh":
+		if len(c.SshKey) == 0 {
+			return nil, errors.New("ssh key not set")
+		}
+
+		user := ep.User
+		if len(user) == 0 {
+			user = "git"
+		}
+		keys, err := ssh.NewPublicKeys(user, []byte(c.SshKey), "")
+		if err != nil {
+			return nil, err
+		}
+
+		// 校验 known_hosts,为空时使用 ~/.ssh/known_hosts
+		files := make([]string, 0)
+		if len(c.KnownHosts) > 0 {
+			files = append(files, c.KnownHosts)
+		}
+		keys.HostKeyCallback, err = ssh.NewKnownHostsCallback(files...)
+		if err != nil {
+			return nil, err
+		}
+		return keys, nil
+	case "http", "https":
+		if auth := getAuth(c.Token); auth != nil {
+			return auth, nil
+		}
+		return nil, nil
+	default:
+		// file 等本地仓库不需要认证
+		return nil, nil
+	}
+}
+
+// gitEnv 生成 git 命令行使用的认证环境变量,返回的 clean 用于删除临时文件
+func (c *Credential) gitEnv(url string) ([]string, func(), error) {
+	clean := func() {}
+	if c == nil {
+		return nil, clean, nil
+	}
+
+	if !IsSshUrl(url) {
+		auth := getAuth(c.Token)
+		if auth == nil {
+			return nil, clean, nil
+		}
+
+		// 认证信息通过环境变量传给 git,避免出现在进程参数中
+		basic := base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		return []string{
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic " + basic,
+		}, clean, nil
+	}
+
+	f, err := os.CreateTemp("", "auto-build-key-*")
+	if err != nil {
+		return nil, clean, err
+	}
+	clean = func() { os.Remove(f.Name()) }
+
+	key := c.SshKey
+	if !strings.HasSuffix(key, "\n") {
+		key += "\n"
+	}
+	_, err = f.WriteString(key)
+	f.Close()
+	if err != nil {
+		clean()
+		return nil, func() {}, err
+	}
+
+	sshCmd := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes -o StrictHostKeyChecking=yes", f.Name())
+	if len(c.KnownHosts) > 0 {
+		sshCmd += " -o UserKnownHostsFile=" + c.KnownHosts
+	}
+	return []string{"GIT_SSH_COMMAND=" + sshCmd}, clean, nil
+}
+
+func getAuth(tokenStr string) *http.BasicAuth {
+	if len(tokenStr) == 0 {
+		return nil
+	}
+
+	token := strings.Split(tokenStr, ":")
+	switch len(token) {
+	case 1:
+		return &http.BasicAuth{
+			Username: "oauth2",
+			Password: token[0],
+		}
+	case 2:
+		return &http.BasicAuth{
+			Username: token[0],
+			Password: token[1],
+		}
+	default:
+		return nil
+	}
+}
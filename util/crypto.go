@@ -0,0 +1,142 @@
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+)
+
+// 加密后的数据前缀,没有前缀的为历史明文数据,
+// legacyPrefix 为直接使用 secret_key 的 sha256 加密的历史数据,启动时重新加密
+const (
+	encPrefix    = "enc2:"
+	legacyPrefix = "enc:"
+)
+
+// DeriveKey 由配置的 secret_key 为不同用途生成不同的 key,如加密和链接签名
+func DeriveKey(secret, purpose string) []byte {
+	if len(secret) == 0 {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// cipherKey 加密或解密 data 使用的 AES-256 key
+func cipherKey(secret, data string) []byte {
+	if IsLegacy(data) {
+		if len(secret) == 0 {
+			return nil
+		}
+		sum := sha256.Sum256([]byte(secret))
+		return sum[:]
+	}
+	return DeriveKey(secret, "encrypt")
+}
+
+func IsEncrypted(s string) bool {
+	return strings.HasPrefix(s, encPrefix) || IsLegacy(s)
+}
+
+// IsLegacy 使用历史 key 加密的数据
+func IsLegacy(s string) bool {
+	return strings.HasPrefix(s, legacyPrefix)
+}
+
+// Encrypt 使用由 secret 派生的 key 进行 AES-GCM 加密,secret 为空时返回错误,不保存明文
+func Encrypt(secret, plain string) (string, error) {
+	if len(plain) == 0 {
+		return plain, nil
+	}
+	key := cipherKey(secret, "")
+	if len(key) == 0 {
+		return "", errors.New("secret key not set")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	data := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return encPrefix + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Decrypt 解密 Encrypt 的结果,没有加密前缀的数据原样返回
+func Decrypt(secret, s string) (string, error) {
+	if !IsEncrypted(s) {
+		return s, nil
+	}
+	key := cipherKey(secret, s)
+	if len(key) == 0 {
+		return "", errors.New("secret key not set")
+	}
+
+	s = strings.TrimPrefix(strings.TrimPrefix(s, encPrefix), legacyPrefix)
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("cipher text too short")
+	}
+
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// RandomToken 生成 n 字节的随机数,hex 编码
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken 数据库中只保存 token 的 sha256
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign 使用由 secret 派生的 key 进行 HMAC-SHA256 签名,用于生成有过期时间的下载链接
+func Sign(secret, data string) string {
+	mac := hmac.New(sha256.New, DeriveKey(secret, "url-sign"))
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func CheckSign(secret, data, sign string) bool {
+	return hmac.Equal([]byte(Sign(secret, data)), []byte(sign))
+}
@@ -0,0 +1,63 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	key := "test key"
+	enc, err := Encrypt(key, "glpat-xxxx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(enc) {
+		t.Errorf("encrypted:%s without prefix", enc)
+	}
+
+	plain, err := Decrypt(key, enc)
+	if err != nil || plain != "glpat-xxxx" {
+		t.Errorf("decrypt:%s err:%v", plain, err)
+	}
+
+	if _, err := Decrypt("other key", enc); err == nil {
+		t.Error("decrypt with wrong key should fail")
+	}
+
+	if _, err := Encrypt("", "glpat-xxxx"); err == nil {
+		t.Error("encrypt without key should fail")
+	}
+
+	// 历史明文数据原样返回
+	if plain, err := Decrypt(key, "plain-token"); err != nil || plain != "plain-token" {
+		t.Errorf("decrypt plain:%s err:%v", plain, err)
+	}
+
+	// 历史数据直接使用 secret_key 的 sha256 加密
+	sum := sha256.Sum256([]byte(key))
+	gcm, _ := newGCM(sum[:])
+	nonce := make([]byte, gcm.NonceSize())
+	legacy := legacyPrefix + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte("old-token"), nil))
+	if !IsEncrypted(legacy) || !IsLegacy(legacy) || IsLegacy(enc) {
+		t.Errorf("legacy prefix:%s %s", legacy, enc)
+	}
+	if plain, err := Decrypt(key, legacy); err != nil || plain != "old-token" {
+		t.Errorf("decrypt legacy:%s err:%v", plain, err)
+	}
+}
+
+// TestDeriveKey 加密和链接签名使用不同的 key
+func TestDeriveKey(t *testing.T) {
+	enc, sign := DeriveKey("test key", "encrypt"), DeriveKey("test key", "url-sign")
+	if len(enc) != 32 || bytes.Equal(enc, sign) {
+		t.Errorf("derived keys:%x %x", enc, sign)
+	}
+	if DeriveKey("", "encrypt") != nil {
+		t.Error("empty secret should not derive key")
+	}
+	if !CheckSign("test key", "data", Sign("test key", "data")) || CheckSign("other key", "data", Sign("test key", "data")) {
+		t.Error("sign check failed")
+	}
+}
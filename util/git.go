@@ -1,11 +1,20 @@
 package util
 
 import (
+	"fmt"
 	"io"
+	"os"
+	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 )
 
@@ -35,50 +44,198 @@ func Clone(path, url string, token ...string) error {
 	return err
 }
 
-func CloneSingleBranch(path, url, branch, token string) error {
+func CloneSingleBranch(path, url, branch string, cred *Credential) error {
+	auth, err := cred.auth(url)
+	if err != nil {
+		return err
+	}
+
 	op := &git.CloneOptions{
 		URL:           url,
-		Auth:          getAuth(token),
+		Auth:          auth,
 		ReferenceName: plumbing.NewBranchReferenceName(branch),
 		SingleBranch:  true,
 		Depth:         1,
 		Tags:          git.NoTags,
 	}
 
-	_, err := git.PlainClone(path, false, op)
+	_, err = git.PlainClone(path, false, op)
 	return err
 }
 
-func CloenWithBare(path, url, token string) error {
-	op := &git.CloneOptions{
-		URL:          url,
-		Auth:         getAuth(token),
-		SingleBranch: false,
+// 同一个仓库同时只允许一个 fetch,key 为仓库路径
+var repoLocks sync.Map
+
+func lockRepo(path string) func() {
+	v, _ := repoLocks.LoadOrStore(path, new(sync.Mutex))
+	m := v.(*sync.Mutex)
+	m.Lock()
+	return m.Unlock
+}
+
+// RemoteBranch 远端分支在本地仓库中的 ref,如 refs/remotes/origin/master
+func RemoteBranch(remote, branch string) string {
+	return plumbing.NewRemoteReferenceName(remote, branch).String()
+}
+
+func remoteAuth(r *git.Repository, remote string, cred *Credential) (transport.AuthMethod, error) {
+	re, err := r.Remote(remote)
+	if err != nil {
+		return nil, err
 	}
-	_, err := git.PlainClone(path, true, op)
-	return err
+	return cred.auth(re.Config().URLs[0])
 }
 
-func getAuth(tokenStr string) *http.BasicAuth {
-	if len(tokenStr) == 0 {
-		return nil
+// CloneRef 拉取 url 上任意 ref(如 refs/merge-requests/1/head)并检出到 path 的 branch 分支,
+// 失败时和 PlainClone 一样删除 path
+func CloneRef(path, url, ref, branch string, cred *Credential) error {
+	auth, err := cred.auth(url)
+	if err != nil {
+		return err
 	}
 
-	token := strings.Split(tokenStr, ":")
-	switch len(token) {
-	case 1:
-		return &http.BasicAuth{
-			Username: "oauth2",
-			Password: token[0],
+	r, err := git.PlainInit(path, false)
+	if err != nil {
+		return err
+	}
+	if err := checkoutRef(r, url, ref, branch, auth); err != nil {
+		os.RemoveAll(path)
+		return err
+	}
+	return nil
+}
+
+func checkoutRef(r *git.Repository, url, ref, branch string, auth transport.AuthMethod) error {
+	_, err := r.CreateRemote(&config.RemoteConfig{
+		Name: git.DefaultRemoteName,
+		URLs: []string{url},
+	})
+	if err != nil {
+		return err
+	}
+
+	local := plumbing.NewBranchReferenceName(branch)
+	err = r.Fetch(&git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", ref, local))},
+		Auth:       auth,
+		Depth:      1,
+		Tags:       git.NoTags,
+	})
+	if err != nil {
+		return err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+
+	return w.Checkout(&git.CheckoutOptions{
+		Branch: local,
+		Force:  true,
+	})
+}
+
+// SetRemoteUrl 修改 remote 的地址
+func SetRemoteUrl(path, remote, url string) error {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := r.Config()
+	if err != nil {
+		return err
+	}
+
+	rc, ok := cfg.Remotes[remote]
+	if !ok {
+		return fmt.Errorf("remote:%s not found", remote)
+	}
+	rc.URLs = []string{url}
+
+	return r.SetConfig(cfg)
+}
+
+// UpdateSubmodules 递归初始化并更新子模块,相对路径的子模块基于 origin 的地址
+func UpdateSubmodules(path string, cred *Credential, out io.Writer) error {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return err
+	}
+
+	w, err := r.Worktree()
+	if err != nil {
+		return err
+	}
+
+	subs, err := w.Submodules()
+	if err != nil {
+		return err
+	}
+
+	origin, err := r.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range subs {
+		fmt.Fprintf(out, "submodule update %s (%s)\n", s.Config().Path, s.Config().URL)
+
+		url := s.Config().URL
+		if strings.HasPrefix(url, "./") || strings.HasPrefix(url, "../") {
+			url = origin.Config().URLs[0]
 		}
-	case 2:
-		return &http.BasicAuth{
-			Username: token[0],
-			Password: token[1],
+		auth, err := cred.auth(url)
+		if err != nil {
+			return err
+		}
+
+		err = s.Update(&git.SubmoduleUpdateOptions{
+			Init:              true,
+			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+			Auth:              auth,
+		})
+		if err != nil {
+			return fmt.Errorf("update submodule %s error:%s", s.Config().Path, err)
 		}
-	default:
-		return nil
 	}
+
+	return nil
+}
+
+// LfsPull 使用 git lfs 拉取 origin 上的 lfs 对象,需要安装 git-lfs
+func LfsPull(path, url string, cred *Credential, out io.Writer) error {
+	env, clean, err := cred.gitEnv(url)
+	if err != nil {
+		return err
+	}
+	defer clean()
+
+	c := exec.Command("git", "lfs", "pull")
+	c.Dir = path
+	c.Env = append(os.Environ(), env...)
+	c.Stdout = out
+	c.Stderr = out
+
+	fmt.Fprintf(out, "%s\n", c.String())
+	return c.Run()
+}
+
+func CloenWithBare(path, url string, cred *Credential) error {
+	auth, err := cred.auth(url)
+	if err != nil {
+		return err
+	}
+
+	op := &git.CloneOptions{
+		URL:          url,
+		Auth:         auth,
+		SingleBranch: false,
+	}
+	_, err = git.PlainClone(path, true, op)
+	return err
 }
 
 // 请确保目前在 branch 分支上,否则会自动进行合并 branch 到当前分支
@@ -109,16 +266,53 @@ func Pull(path, remote, branch string) error {
 	return err
 }
 
-func Fetch(path, remote, token string) error {
+func Fetch(path, remote string, cred *Credential) error {
+	defer lockRepo(path)()
+
 	r, err := git.PlainOpen(path)
 	if err != nil {
 		return err
 	}
 
+	auth, err := remoteAuth(r, remote, cred)
+	if err != nil {
+		return err
+	}
+
+	op := &git.FetchOptions{
+		RemoteName: remote,
+		Auth:       auth,
+		Force:      true,
+	}
+
+	err = r.Fetch(op)
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+
+	return err
+}
+
+// FetchRef 拉取 remote 上的 ref 到本地同名 ref,用于拉取 merge request 等非分支引用
+func FetchRef(path, remote, ref string, cred *Credential) error {
+	defer lockRepo(path)()
+
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return err
+	}
+
+	auth, err := remoteAuth(r, remote, cred)
+	if err != nil {
+		return err
+	}
+
 	op := &git.FetchOptions{
 		RemoteName: remote,
-		Auth:       getAuth(token),
+		RefSpecs:   []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", ref, ref))},
+		Auth:       auth,
 		Force:      true,
+		Tags:       git.NoTags,
 	}
 
 	err = r.Fetch(op)
@@ -129,7 +323,7 @@ func Fetch(path, remote, token string) error {
 	return err
 }
 
-func BranchList(path, remote, token string) ([]string, error) {
+func BranchList(path, remote string, cred *Credential) ([]string, error) {
 	r, err := git.PlainOpen(path)
 	if err != nil {
 		return nil, err
@@ -141,8 +335,13 @@ func BranchList(path, remote, token string) ([]string, error) {
 		return nil, err
 	}
 
+	auth, err := cred.auth(re.Config().URLs[0])
+	if err != nil {
+		return nil, err
+	}
+
 	refs, err := re.List(&git.ListOptions{
-		Auth: getAuth(token),
+		Auth: auth,
 	})
 	if err != nil {
 		return nil, err
@@ -157,9 +356,123 @@ func BranchList(path, remote, token string) ([]string, error) {
 	return resu, nil
 }
 
+// BranchHead 返回 bare 仓库中远端分支指向的 commit
+func BranchHead(path, remote, branch string) (string, error) {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := r.Reference(plumbing.NewRemoteReferenceName(remote, branch), true)
+	if err != nil {
+		return "", err
+	}
+
+	return ref.Hash().String(), nil
+}
+
+// PinRef 在 bare 仓库中创建指向 sha 的 ref,用于按提交 clone,返回删除 ref 的函数
+func PinRef(path, ref, sha string) (func(), error) {
+	defer lockRepo(path)()
+
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := plumbing.NewHash(sha)
+	if _, err := r.CommitObject(hash); err != nil {
+		return nil, fmt.Errorf("commit %s: %s", sha, err)
+	}
+
+	name := plumbing.ReferenceName(ref)
+	if err := r.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+		return nil, err
+	}
+
+	return func() { RemoveRef(path, ref) }, nil
+}
+
+// RemoveRef 删除 bare 仓库中的 ref
+func RemoveRef(path, ref string) error {
+	defer lockRepo(path)()
+
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return err
+	}
+	return r.Storer.RemoveReference(plumbing.ReferenceName(ref))
+}
+
+// CommitMessage 返回 commit 的提交信息
+func CommitMessage(path, sha string) (string, error) {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return "", err
+	}
+
+	c, err := r.CommitObject(plumbing.NewHash(sha))
+	if err != nil {
+		return "", err
+	}
+
+	return c.Message, nil
+}
+
+// RefMessage 返回 ref 指向的 commit 的提交信息
+func RefMessage(path, ref string) (string, error) {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return "", err
+	}
+
+	h, err := r.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return "", err
+	}
+
+	c, err := r.CommitObject(*h)
+	if err != nil {
+		return "", err
+	}
+	return c.Message, nil
+}
+
 type LogItem struct {
-	Sha1   string
-	Commit string
+	Sha1       string
+	Commit     string // 完整的提交信息
+	Subject    string // 提交信息的第一行
+	Author     string
+	Email      string
+	CommitTime time.Time
+}
+
+func newLogItem(c *object.Commit) *LogItem {
+	return &LogItem{
+		Sha1:       c.Hash.String(),
+		Commit:     c.Message,
+		Subject:    Subject(c.Message),
+		Author:     c.Author.Name,
+		Email:      c.Author.Email,
+		CommitTime: c.Committer.When,
+	}
+}
+
+// Subject 返回提交信息的第一行
+func Subject(message string) string {
+	message = strings.TrimSpace(message)
+	if i := strings.IndexByte(message, '\n'); i >= 0 {
+		message = message[:i]
+	}
+	return strings.TrimSpace(message)
+}
+
+// ShortSha 返回 sha 的前 8 位
+func ShortSha(sha string) string {
+	if len(sha) > 8 {
+		return sha[:8]
+	}
+	return sha
 }
 
 func GitLog(path string, n int) ([]*LogItem, error) {
@@ -185,10 +498,47 @@ func GitLog(path string, n int) ([]*LogItem, error) {
 		if err != nil {
 			return nil, err
 		}
-		resu = append(resu, &LogItem{
-			Sha1:   commit.Hash.String(),
-			Commit: commit.Message,
-		})
+		resu = append(resu, newLogItem(commit))
 	}
 	return resu, nil
 }
+
+// CommitRange 返回 to 可以到达而 from 不能到达的提交,按提交时间倒序,最多 n 个,
+// from 为空时返回 to 最近的 n 个提交,超过 n 个时 more 为 true
+func CommitRange(path, from, to string, n int) (resu []*LogItem, more bool, err error) {
+	r, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	head, err := r.CommitObject(plumbing.NewHash(to))
+	if err != nil {
+		return nil, false, fmt.Errorf("commit %s: %s", to, err)
+	}
+
+	exclude := make(map[plumbing.Hash]bool)
+	if len(from) > 0 {
+		base, err := r.CommitObject(plumbing.NewHash(from))
+		if err != nil {
+			return nil, false, fmt.Errorf("commit %s: %s", from, err)
+		}
+		err = object.NewCommitIterCTime(base, nil, nil).ForEach(func(c *object.Commit) error {
+			exclude[c.Hash] = true
+			return nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	resu = make([]*LogItem, 0)
+	err = object.NewCommitIterCTime(head, exclude, nil).ForEach(func(c *object.Commit) error {
+		if len(resu) == n {
+			more = true
+			return storer.ErrStop
+		}
+		resu = append(resu, newLogItem(c))
+		return nil
+	})
+	return resu, more, err
+}
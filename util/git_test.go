@@ -0,0 +1,117 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitFile 在仓库中提交一个文件,返回 commit sha
+func commitFile(t *testing.T, r *git.Repository, dir, content string) string {
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("main.go"); err != nil {
+		t.Fatal(err)
+	}
+	h, err := w.Commit(content, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h.String()
+}
+
+func TestPinRef(t *testing.T) {
+	src := t.TempDir()
+	r, err := git.PlainInit(src, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := commitFile(t, r, src, "v1")
+	commitFile(t, r, src, "v2")
+
+	unpin, err := PinRef(src, "refs/pin/1", first)
+	if err != nil {
+		t.Fatalf("pin ref error:%s", err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "work")
+	if err := CloneRef(dst, src, "refs/pin/1", "master", nil); err != nil {
+		t.Fatalf("clone pinned ref error:%s", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "main.go")); string(data) != "v1" {
+		t.Errorf("pinned clone content:%s", data)
+	}
+
+	if msg, err := RefMessage(src, "refs/pin/1"); err != nil || msg != "v1" {
+		t.Errorf("pinned ref message:%q %v", msg, err)
+	}
+
+	unpin()
+	if _, err := r.Reference(plumbing.ReferenceName("refs/pin/1"), false); err == nil {
+		t.Error("pinned ref not removed")
+	}
+
+	// 失败时删除工作目录,下次编译可以重新 clone
+	if err := CloneRef(dst+"-missing", src, "refs/pin/1", "master", nil); err == nil {
+		t.Error("clone removed ref should fail")
+	}
+	if _, err := os.Stat(dst + "-missing"); !os.IsNotExist(err) {
+		t.Errorf("work dir left after failed clone:%v", err)
+	}
+
+	if _, err := PinRef(src, "refs/pin/2", "0123456789012345678901234567890123456789"); err == nil {
+		t.Error("pin unknown commit should fail")
+	}
+}
+
+func TestCommitRange(t *testing.T) {
+	dir := t.TempDir()
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := commitFile(t, r, dir, "v1")
+	second := commitFile(t, r, dir, "v2\n\nbody")
+	third := commitFile(t, r, dir, "v3")
+
+	cs, more, err := CommitRange(dir, first, third, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more || len(cs) != 2 || cs[0].Sha1 != third || cs[1].Sha1 != second {
+		t.Fatalf("commits:%d more:%v", len(cs), more)
+	}
+	if cs[1].Subject != "v2" || cs[1].Author != "test" || cs[1].CommitTime.IsZero() {
+		t.Errorf("commit:%+v", cs[1])
+	}
+
+	cs, more, err = CommitRange(dir, "", third, 2)
+	if err != nil || !more || len(cs) != 2 {
+		t.Errorf("limited commits:%d more:%v err:%v", len(cs), more, err)
+	}
+
+	if _, _, err := CommitRange(dir, first, "0123456789012345678901234567890123456789", 10); err == nil {
+		t.Error("unknown commit should fail")
+	}
+}
+
+func TestSubject(t *testing.T) {
+	if s := Subject("  fix build\n\nlong description\n"); s != "fix build" {
+		t.Errorf("subject:%q", s)
+	}
+	if s := ShortSha("0123456789abcdef"); s != "01234567" {
+		t.Errorf("short sha:%q", s)
+	}
+}
@@ -0,0 +1,159 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+const (
+	ForgeGitlab = "gitlab"
+	ForgeGithub = "github"
+)
+
+// commit status
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+)
+
+var statusClient = &http.Client{Timeout: 10 * time.Second}
+
+type CommitStatus struct {
+	Forge       string // gitlab/github,为空时根据 RepoUrl 判断
+	ApiUrl      string // 为空时根据 RepoUrl 生成
+	RepoUrl     string
+	Token       string
+	Sha         string
+	State       string
+	Context     string
+	TargetUrl   string
+	Description string
+}
+
+// ReportCommitStatus 将编译状态写回 gitlab/github 的 commit status
+func ReportCommitStatus(s *CommitStatus) error {
+	forge := s.Forge
+	if len(forge) == 0 {
+		forge = GuessForge(s.RepoUrl)
+	}
+
+	base, repo, err := parseRepoUrl(s.RepoUrl)
+	if err != nil {
+		return err
+	}
+
+	api := strings.TrimSuffix(s.ApiUrl, "/")
+	switch forge {
+	case ForgeGitlab:
+		if len(api) == 0 {
+			api = base + "/api/v4"
+		}
+		return postStatus(fmt.Sprintf("%s/projects/%s/statuses/%s", api, url.PathEscape(repo), s.Sha),
+			"PRIVATE-TOKEN", apiToken(s.Token), map[string]string{
+				"state":       s.State,
+				"name":        s.Context,
+				"target_url":  s.TargetUrl,
+				"description": s.Description,
+			})
+	case ForgeGithub:
+		if len(api) == 0 {
+			api = "https://api.github.com"
+		}
+		return postStatus(fmt.Sprintf("%s/repos/%s/statuses/%s", api, repo, s.Sha),
+			"Authorization", "Bearer "+apiToken(s.Token), map[string]string{
+				"state":       githubState(s.State),
+				"context":     s.Context,
+				"target_url":  s.TargetUrl,
+				"description": s.Description,
+			})
+	default:
+		return fmt.Errorf("forge:%s not supported", forge)
+	}
+}
+
+func postStatus(api, header, token string, body map[string]string) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, api, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(header, token)
+
+	res, err := statusClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("post %s status:%s body:%s", api, res.Status, msg)
+	}
+	return nil
+}
+
+// github 没有 running,失败为 failure
+func githubState(state string) string {
+	switch state {
+	case StatusRunning:
+		return "pending"
+	case StatusFailed:
+		return "failure"
+	default:
+		return state
+	}
+}
+
+// apiToken token 为 user:pass 时使用 pass 访问 api
+func apiToken(token string) string {
+	if i := strings.Index(token, ":"); i >= 0 {
+		return token[i+1:]
+	}
+	return token
+}
+
+func GuessForge(repoUrl string) string {
+	ep, err := transport.NewEndpoint(repoUrl)
+	if err == nil && ep.Host == "github.com" {
+		return ForgeGithub
+	}
+	return ForgeGitlab
+}
+
+// parseRepoUrl 解析仓库地址,返回 web 地址 scheme://host 和 group/name,ssh 地址默认 web 使用 https
+func parseRepoUrl(repoUrl string) (string, string, error) {
+	ep, err := transport.NewEndpoint(repoUrl)
+	if err != nil {
+		return "", "", err
+	}
+
+	repo := strings.TrimSuffix(strings.Trim(ep.Path, "/"), ".git")
+	if len(ep.Host) == 0 || len(repo) == 0 {
+		return "", "", fmt.Errorf("couldn't parse repo url:%s", repoUrl)
+	}
+
+	switch ep.Protocol {
+	case "http", "https":
+		if ep.Port > 0 {
+			return fmt.Sprintf("%s://%s:%d", ep.Protocol, ep.Host, ep.Port), repo, nil
+		}
+		return fmt.Sprintf("%s://%s", ep.Protocol, ep.Host), repo, nil
+	default:
+		return "https://" + ep.Host, repo, nil
+	}
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReportCommitStatus(t *testing.T) {
+	var path, token string
+	body := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+		token = r.Header.Get("PRIVATE-TOKEN") + r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	err := ReportCommitStatus(&CommitStatus{
+		ApiUrl:  srv.URL,
+		RepoUrl: "https://git.example.com/group/repo.git",
+		Token:   "user:secret",
+		Sha:     "abc",
+		State:   StatusRunning,
+		Context: "auto-build",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/projects/group%2Frepo/statuses/abc" || token != "secret" || body["state"] != "running" {
+		t.Errorf("gitlab path:%s token:%s body:%+v", path, token, body)
+	}
+
+	err = ReportCommitStatus(&CommitStatus{
+		Forge:   ForgeGithub,
+		ApiUrl:  srv.URL,
+		RepoUrl: "https://github.com/owner/repo",
+		Token:   "secret",
+		Sha:     "abc",
+		State:   StatusFailed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/repos/owner/repo/statuses/abc" || token != "Bearer secret" || body["state"] != "failure" {
+		t.Errorf("github path:%s token:%s body:%+v", path, token, body)
+	}
+}
+
+func TestParseRepoUrl(t *testing.T) {
+	cases := map[string][2]string{
+		"https://git.example.com/group/sub/repo.git": {"https://git.example.com", "group/sub/repo"},
+		"http://git.example.com:8080/group/repo":     {"http://git.example.com:8080", "group/repo"},
+		"git@github.com:owner/repo.git":              {"https://github.com", "owner/repo"},
+		"ssh://git@git.example.com:2222/group/repo":  {"https://git.example.com", "group/repo"},
+	}
+	for u, want := range cases {
+		base, repo, err := parseRepoUrl(u)
+		if err != nil || base != want[0] || repo != want[1] {
+			t.Errorf("parseRepoUrl(%s) = %s, %s, %v", u, base, repo, err)
+		}
+	}
+}